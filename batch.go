@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// readBatch reads the urls listed in the file at name, one per line. Blank
+// lines and lines starting with # are skipped.
+func readBatch(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var urls []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("%v does not list any urls", name)
+	}
+	return urls, nil
+}
+
+// batchOutputPath returns the path in dir to stream the ith video of a batch,
+// at rawurl, to. The file is named filename, as suggested by the server, or
+// otherwise after the last element of the url's path, or numbered if it has
+// none. HLS playlists are named as the MPEG-TS video their segments
+// concatenate to. The name is then formatted by template, if set, in which
+// {index} is replaced by i+1, {name} by the name, and {basename} and {ext} by
+// the name without and with only its extension. The path is suffixed with
+// " (n)" if it has already been used by the batch.
+func batchOutputPath(dir, template, rawurl, filename string, i int, used map[string]bool) string {
+	name := sanitizeFilename(filename)
+	if name == "" {
+		if u, err := url.Parse(rawurl); err == nil {
+			name = sanitizeFilename(path.Base(u.Path))
+		}
+	}
+	if name == "" {
+		name = fmt.Sprintf("video%d.mkv", i+1)
+	}
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	if strings.EqualFold(ext, ".m3u8") {
+		ext = ".ts"
+	}
+	if template != "" {
+		name = strings.NewReplacer(
+			"{index}", strconv.Itoa(i+1),
+			"{name}", stem+ext,
+			"{basename}", stem,
+			"{ext}", ext,
+		).Replace(template)
+		ext = filepath.Ext(name)
+		stem = strings.TrimSuffix(name, ext)
+	}
+
+	out := filepath.Join(dir, stem+ext)
+	for n := 1; used[out]; n++ {
+		out = filepath.Join(dir, fmt.Sprintf("%v (%d)%v", stem, n, ext))
+	}
+	used[out] = true
+	return out
+}
+
+// runBatch streams each of urls to dir in turn using streamVideo, reporting
+// progress to out. The videos are named by template, or after the filename
+// returned for them by filename, if not nil, as described by
+// batchOutputPath. A failed video doesn't stop the batch; the failures are
+// summarized once every video has been attempted, and returned together.
+// Interrupting the batch stops it.
+func runBatch(urls []string, dir, template string, out io.Writer, filename func(videourl string) string, streamVideo func(videourl, outpath string) error) error {
+	used := make(map[string]bool)
+	var failures []error
+	for i, videourl := range urls {
+		var suggested string
+		if filename != nil {
+			suggested = filename(videourl)
+		}
+		outpath := batchOutputPath(dir, template, videourl, suggested, i, used)
+		fmt.Fprintf(out, "[%v/%v] Streaming %v to %v\n", i+1, len(urls), videourl, outpath)
+		if err := streamVideo(videourl, outpath); err != nil {
+			if errors.Is(err, errInterrupted) {
+				return err
+			}
+			failures = append(failures, fmt.Errorf("%v: %w", videourl, err))
+		}
+	}
+
+	fmt.Fprintf(out, "Streamed %v of %v videos.\n", len(urls)-len(failures), len(urls))
+	if len(failures) > 0 {
+		fmt.Fprintln(os.Stderr, "Failed to stream:")
+		for _, err := range failures {
+			fmt.Fprintf(os.Stderr, "  %v\n", err)
+		}
+	}
+	return errors.Join(failures...)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadBatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# movies\nhttp://example.com/a.mkv\n\n  http://example.com/b.mp4  \n")
+	f.Close()
+
+	urls, err := readBatch(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://example.com/a.mkv", "http://example.com/b.mp4"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Fatalf("expected %v, got %v", want, urls)
+	}
+}
+
+func TestBatchOutputPath(t *testing.T) {
+	used := make(map[string]bool)
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://example.com/movies/a.mkv?token=1", "a.mkv"},
+		{"http://example.com/other/a.mkv", "a (1).mkv"},
+		{"http://example.com/", "video3.mkv"},
+		{"http://example.com/show/index.m3u8", "index.ts"},
+	}
+	for i, test := range tests {
+		want := filepath.Join("out", test.want)
+		if got := batchOutputPath("out", "", test.url, "", i, used); got != want {
+			t.Errorf("batchOutputPath(%v) = %v, wanted %v", test.url, got, want)
+		}
+	}
+}
+
+func TestBatchOutputPathTemplate(t *testing.T) {
+	used := make(map[string]bool)
+	tests := []struct {
+		template string
+		url      string
+		filename string
+		want     string
+	}{
+		{"{index}-{basename}.mkv", "http://example.com/a.mp4", "", "1-a.mkv"},
+		{"{index}-{name}", "http://example.com/a.mp4", "Movie.mp4", "2-Movie.mp4"},
+		{"", "http://example.com/a.mp4", "../../etc/passwd", "passwd"},
+		{"", "http://example.com/b.mp4", "..", "b.mp4"},
+		{"{basename}{ext}", "http://example.com/show/index.m3u8", "", "index.ts"},
+		{"{basename}{ext}", "http://example.com/other/index.m3u8", "", "index (1).ts"},
+	}
+	for i, test := range tests {
+		want := filepath.Join("out", test.want)
+		if got := batchOutputPath("out", test.template, test.url, test.filename, i, used); got != want {
+			t.Errorf("batchOutputPath(%q, %v, %q) = %v, wanted %v", test.template, test.url, test.filename, got, want)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	errFailed := errors.New("failed")
+	var streamed []string
+	streamVideo := func(videourl, outpath string) error {
+		streamed = append(streamed, outpath)
+		if videourl == "http://example.com/bad.mkv" {
+			return errFailed
+		}
+		return nil
+	}
+
+	urls := []string{"http://example.com/a.mkv", "http://example.com/bad.mkv", "http://example.com/c.mkv"}
+	err := runBatch(urls, "out", "", ioutil.Discard, nil, streamVideo)
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("expected %v, got %v", errFailed, err)
+	}
+	if len(streamed) != len(urls) {
+		t.Fatalf("expected the batch to continue after a failure, streamed %v", streamed)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// headerFlag is a repeatable flag collecting HTTP headers of the form
+// "Name: value".
+type headerFlag map[string]string
+
+func (hf headerFlag) String() string {
+	var headers []string
+	for k, v := range hf {
+		headers = append(headers, k+": "+v)
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (hf headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("header %q is not of the form \"Name: value\"", s)
+	}
+	hf[strings.TrimSpace(s[:i])] = strings.TrimSpace(s[i+1:])
+	return nil
+}
+
+// resolveFlag is a repeatable flag collecting the IP addresses to connect to
+// for hosts, of the form "host:address".
+type resolveFlag map[string]string
+
+func (rf resolveFlag) String() string {
+	var overrides []string
+	for host, addr := range rf {
+		overrides = append(overrides, host+":"+addr)
+	}
+	return strings.Join(overrides, ", ")
+}
+
+func (rf resolveFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 || net.ParseIP(s[i+1:]) == nil {
+		return fmt.Errorf("%q is not of the form \"host:address\"", s)
+	}
+	rf[s[:i]] = s[i+1:]
+	return nil
+}
+
+// cookieFlag is a repeatable flag collecting HTTP cookies of the form
+// "name=value".
+type cookieFlag []*http.Cookie
+
+func (cf *cookieFlag) String() string {
+	var cookies []string
+	for _, c := range *cf {
+		cookies = append(cookies, c.Name+"="+c.Value)
+	}
+	return strings.Join(cookies, "; ")
+}
+
+func (cf *cookieFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("cookie %q is not of the form \"name=value\"", s)
+	}
+	*cf = append(*cf, &http.Cookie{Name: strings.TrimSpace(s[:i]), Value: strings.TrimSpace(s[i+1:])})
+	return nil
+}
+
+// errInterrupted is returned by run when autobuffer is interrupted by a
+// signal.
+var errInterrupted = errors.New("interrupted")
+
+// errUsage is returned by run when autobuffer is invoked incorrectly.
+var errUsage = errors.New("invalid usage")
+
+// Exit codes distinguishing how autobuffer failed, so that scripts can react
+// accordingly.
+const (
+	exitError   = 1
+	exitUsage   = 2
+	exitNetwork = 3
+	exitAuth    = 4
+	// the conventional exit code for SIGINT.
+	exitInterrupted = 130
+)
+
+// exitCode returns the exit code for an error returned by run.
+func exitCode(err error) int {
+	var se *statusError
+	switch {
+	case err == nil || errors.Is(err, errHelp):
+		return 0
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.Is(err, errUsage) || errors.Is(err, ErrUnsupportedScheme):
+		return exitUsage
+	case errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden):
+		return exitAuth
+	case temporary(err) || errors.Is(err, ErrShortStream):
+		return exitNetwork
+	}
+	return exitError
+}
+
+func main() {
+	if code := exitCode(run(os.Args[1:])); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// commands are autobuffer's subcommands, each run with the arguments
+// following its name.
+var commands = map[string]func(args []string) error{
+	"download": runDownload,
+	"estimate": runEstimate,
+	"info":     runInfo,
+}
+
+// run runs autobuffer with the given command line arguments, returning any
+// error after reporting it to the user. The first argument names the
+// subcommand; without one, the arguments are those of download.
+func run(args []string) error {
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			return cmd(args[1:])
+		}
+	}
+	return runDownload(args)
+}
+
+// newFlagSet returns the flag set of the subcommand name, whose usage prints
+// synopsis and description followed by the flags.
+func newFlagSet(name, synopsis, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: autobuffer %v\n\n%v\n\n", synopsis, description)
+		if name == "download" {
+			fmt.Fprintf(fs.Output(), "The download subcommand may be omitted. Other subcommands are estimate and info.\n\n")
+		}
+		fmt.Fprintln(fs.Output(), "Flags:")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args with fs, returning the url of the video given by
+// -url or as the first argument, if any. Asking for help returns errHelp.
+func parseFlags(fs *flag.FlagSet, args []string, videourl *string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", errHelp
+		}
+		return "", errUsage
+	}
+	if videourl != nil && *videourl != "" {
+		return *videourl, nil
+	}
+	return fs.Arg(0), nil
+}
+
+// errHelp is returned by subcommands whose usage was asked for. It isn't
+// reported as an error.
+var errHelp = errors.New("help requested")
+
+// requestFlags are the flags describing how to request the video, shared by
+// every subcommand.
+type requestFlags struct {
+	username       *string
+	password       *string
+	method         *string
+	data           *string
+	headers        headerFlag
+	userAgent      *string
+	cookies        cookieFlag
+	disableHTTP2   *bool
+	preferIPv4     *bool
+	preferIPv6     *bool
+	resolve        resolveFlag
+	connectTimeout *time.Duration
+	pinnedCert     *string
+	allowHosts     *string
+	timeout        *time.Duration
+}
+
+func addRequestFlags(fs *flag.FlagSet) *requestFlags {
+	rf := &requestFlags{headers: make(headerFlag), resolve: make(resolveFlag)}
+	rf.username = fs.String("username", "", "Username to use for HTTP basic auth. Defaults to $AUTOBUFFER_USER, or the login for the host in ~/.netrc")
+	rf.password = fs.String("password", "", "Password to use for HTTP basic auth. Defaults to $AUTOBUFFER_PASS, or the password for the host in ~/.netrc")
+	rf.method = fs.String("method", http.MethodGet, "HTTP method used to request the video")
+	rf.data = fs.String("data", "", "Body to send with each request for the video, such as JSON for servers requiring a POST")
+	fs.Var(rf.headers, "header", "Extra HTTP header to send, as \"Name: value\". May be repeated")
+	rf.userAgent = fs.String("user-agent", defaultUserAgent, "User-Agent header to send with each request")
+	fs.Var(&rf.cookies, "cookie", "Cookie to send, such as a session cookie, as \"name=value\". May be repeated")
+	rf.disableHTTP2 = fs.Bool("disable-http2", false, "Request the video over HTTP/1.1 even if the server supports HTTP/2")
+	rf.preferIPv4 = fs.Bool("prefer-ipv4", false, "Connect to the server over IPv4 in preference to IPv6")
+	rf.preferIPv6 = fs.Bool("prefer-ipv6", false, "Connect to the server over IPv6 in preference to IPv4")
+	fs.Var(rf.resolve, "resolve", "Connect to host at the given IP address instead of resolving it, as \"host:address\". May be repeated")
+	rf.connectTimeout = fs.Duration("connect-timeout", 0, "Maximum time to wait when connecting to the server, or 0 for no limit")
+	rf.pinnedCert = fs.String("pin-sha256", "", "Hex encoded SHA-256 fingerprint of the server's TLS certificate, refusing to connect to a server presenting any other")
+	rf.allowHosts = fs.String("allow-hosts", "", "Comma separated list of hosts the server may redirect to. If empty, redirects to any host are followed")
+	rf.timeout = fs.Duration("timeout", 0, "Maximum time to spend on the video, or 0 for no limit")
+	return rf
+}
+
+// config returns a Config requesting videos as the flags describe.
+func (rf *requestFlags) config() Config {
+	var client *http.Client
+	if *rf.connectTimeout > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{Timeout: *rf.connectTimeout}).DialContext
+		client = &http.Client{Transport: transport}
+	}
+	cfg := Config{
+		Client:           client,
+		Username:         *rf.username,
+		Password:         *rf.password,
+		Method:           *rf.method,
+		Body:             []byte(*rf.data),
+		Headers:          rf.headers,
+		UserAgent:        *rf.userAgent,
+		Cookies:          rf.cookies,
+		DisableHTTP2:     *rf.disableHTTP2,
+		PreferIPv4:       *rf.preferIPv4,
+		PreferIPv6:       *rf.preferIPv6,
+		HostOverrides:    rf.resolve,
+		PinnedCertSHA256: *rf.pinnedCert,
+		Logger:           os.Stdout,
+	}
+	if *rf.allowHosts != "" {
+		for _, host := range strings.Split(*rf.allowHosts, ",") {
+			cfg.AllowedHosts = append(cfg.AllowedHosts, strings.TrimSpace(host))
+		}
+	}
+	return cfg
+}
+
+// context returns the context of a subcommand, which is canceled by an
+// interrupt or once -timeout has passed, and the function releasing it.
+// Interrupting autobuffer cancels the stream, which closes the partially
+// downloaded file.
+func (rf *requestFlags) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if *rf.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *rf.timeout)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// bufferFlags are the flags describing how to compute the buffer time,
+// shared by download and estimate.
+type bufferFlags struct {
+	duration         *time.Duration
+	durationFile     *string
+	sample           *int64
+	probeRounds      *int
+	fudge            *float64
+	startupMargin    *time.Duration
+	playbackBitrate  *int64
+	minBufferPercent *float64
+	limitRate        *int64
+	readyLimitRate   *int64
+	quiet            *bool
+	jsonOutput       *bool
+}
+
+func addBufferFlags(fs *flag.FlagSet) *bufferFlags {
+	return &bufferFlags{
+		duration:         fs.Duration("duration", 0, "Duration of the video to stream, if it cannot be detected from an MP4 or MKV file"),
+		durationFile:     fs.String("duration-file", "", "JSON metadata file to read the duration of the video from, in seconds or as a duration such as 1h2m, falling back to -duration if it has none"),
+		sample:           fs.Int64("sample", bandwidthSampleSize, "Number of bytes to download when sampling bandwidth"),
+		probeRounds:      fs.Int("probe-rounds", 1, "Split the bandwidth sample into this many probes, discarding the fastest and slowest and averaging the rest"),
+		fudge:            fs.Float64("fudge", defaultFudgeFactor, "Factor by which to overestimate the download time, to absorb variations in bandwidth. Must be at least 1"),
+		startupMargin:    fs.Duration("startup-margin", 0, "Extra time to buffer before the video is ready, to cover the player's startup and seeking"),
+		playbackBitrate:  fs.Int64("playback-bitrate", 0, "Rate at which playback consumes the video in bytes per second, to compute the buffer time from instead of the duration"),
+		minBufferPercent: fs.Float64("min-buffer-percent", 0, "Declare the video ready to play once this percentage of it has downloaded, instead of estimating from the bandwidth"),
+		limitRate:        fs.Int64("limit-rate", 0, "Maximum download rate in bytes per second, or 0 for no limit"),
+		readyLimitRate:   fs.Int64("ready-limit-rate", 0, "Maximum download rate in bytes per second once the video is ready to play, or 0 to keep -limit-rate"),
+		quiet:            fs.Bool("quiet", false, "Suppress all output other than errors"),
+		jsonOutput:       fs.Bool("json", false, "Write progress to stdout as newline delimited JSON events instead of text"),
+	}
+}
+
+// apply sets the fields of cfg the flags describe.
+func (bf *bufferFlags) apply(cfg *Config) {
+	cfg.SampleBytes = *bf.sample
+	cfg.ProbeRounds = *bf.probeRounds
+	cfg.FudgeFactor = *bf.fudge
+	cfg.StartupMargin = *bf.startupMargin
+	cfg.PlaybackBitrate = *bf.playbackBitrate
+	cfg.MinBufferPercent = *bf.minBufferPercent
+	cfg.MaxBytesPerSecond = *bf.limitRate
+	cfg.ReadyBytesPerSecond = *bf.readyLimitRate
+}
+
+// videoDuration returns the duration of the video recorded in -duration-file,
+// or otherwise given by -duration.
+func (bf *bufferFlags) videoDuration() (time.Duration, error) {
+	if *bf.durationFile != "" {
+		d, ok, err := readDurationFile(*bf.durationFile)
+		if err != nil {
+			return 0, fmt.Errorf("invalid -duration-file: %w", err)
+		}
+		if ok {
+			return d, nil
+		}
+	}
+	return *bf.duration, nil
+}
+
+// output returns where to write informational messages: stdout, or stderr
+// with -json since stdout is reserved for events, and nowhere with -quiet.
+// Errors are always written to stderr. JSON events are written by the
+// returned eventWriter, which is nil without -json.
+func (bf *bufferFlags) output() (io.Writer, *eventWriter) {
+	out := io.Writer(os.Stdout)
+	var events *eventWriter
+	if *bf.jsonOutput {
+		out = os.Stderr
+		events = newEventWriter(os.Stdout)
+	}
+	if *bf.quiet {
+		out = ioutil.Discard
+	}
+	return out, events
+}
+
+// runDownload runs the download subcommand, which streams videos to disk
+// until they are ready to play and then to completion.
+func runDownload(args []string) error {
+	fs := newFlagSet("download", "[download] [flags] [url]", "Stream a video to disk, reporting once it has buffered enough to play without interruption.")
+	var videourl = fs.String("url", "", "HTTP url, file:// URL or local path of the video to stream. May instead be given as an argument")
+	var outpath = fs.String("out", "out.mkv", "Filepath to stream output. Defaults to the filename suggested by the server, if any")
+	var batch = fs.String("batch", "", "Path to a file listing the urls of videos to stream one after another, one per line, instead of -url")
+	var batchDir = fs.String("batch-dir", ".", "Directory to stream the videos listed by -batch to, named after their urls")
+	var batchTemplate = fs.String("batch-template", "", "Template for the names of videos streamed by -batch, such as \"{index}-{basename}.mkv\". {name}, {basename} and {ext} are taken from the server's suggested filename or the url")
+	var resume = fs.Bool("resume", false, "Resume a partially downloaded output file")
+	var resumeVerify = fs.Int64("resume-verify", 0, "Download this many bytes before the end of a partial file again when resuming, starting over if they don't match the file")
+	var appendOutput = fs.Bool("append", false, "Append the video to the output file instead of overwriting it, such as to concatenate segments")
+	var ifModifiedSince = fs.Bool("if-modified-since", false, "Skip the download if the video hasn't been modified since the output file was")
+	var start = fs.String("start", "", "Position to start streaming the video from, skipping what comes before it, as a byte offset or a time such as 45m")
+	var warmupBytes = fs.Int64("warmup", defaultWarmupBytes, "Number of bytes to download before sampling bandwidth, while the connection ramps up")
+	var warmupTime = fs.Duration("warmup-time", defaultWarmupTime, "Maximum time to spend warming up the connection before sampling bandwidth")
+	var downloadOnly = fs.Bool("download-only", false, "Just download the video, without sampling bandwidth or waiting until it is ready to play")
+	var probe = fs.Bool("probe", false, "Sample bandwidth with a separate request rather than the start of the download")
+	var retries = fs.Int("retries", 0, "Number of times to retry after a transient network error")
+	var retryDeadline = fs.Duration("retry-deadline", 0, "Total time to spend retrying after transient network errors, such as 10m, or 0 to limit retries only by -retries")
+	var retryBackoff = fs.Duration("retry-backoff", defaultRetryBackoff, "Time to wait before the first retry, doubled after each consecutive failure")
+	var stallTimeout = fs.Duration("stall-timeout", 0, "Give up if no bytes of the video are received for this long, or 0 to wait indefinitely")
+	var connections = fs.Int("connections", 1, "Number of concurrent connections to download the video over, if the server supports range requests")
+	var checksum = fs.String("sha256", "", "Expected hex encoded SHA-256 digest of the video")
+	var estimate = fs.Bool("estimate", false, "Only estimate how long the video would take to buffer, without downloading it. Deprecated: use autobuffer estimate")
+	var maxFileSize = fs.Int64("max-filesize", 0, "Refuse to download videos larger than this many bytes, or 0 for no limit")
+	var syncBytes = fs.Int64("sync-bytes", 0, "Sync the output file to disk every this many bytes, or 0 to leave it to the operating system")
+	var syncInterval = fs.Duration("sync-interval", 0, "Sync the output file to disk at this interval, or 0 to leave it to the operating system")
+	var extensions = fs.String("ext", "", "Comma separated list of extensions the output path is expected to end with, such as .mkv,.mp4")
+	var strictExt = fs.Bool("strict-ext", false, "Refuse to stream to an output path not ending with one of the -ext extensions")
+	var noClobber = fs.Bool("no-clobber", false, "Refuse to overwrite an existing output file")
+	var preallocate = fs.Bool("preallocate", false, "Extend the output file to the size of the video before streaming")
+	var writeBuffer = fs.Int("write-buffer", 0, "Buffer up to this many bytes in memory while they are written to a slow disk, so that the bandwidth sampled is the network's")
+	var compress = fs.Bool("compress", false, "Gzip the video as it is written to the output file, as is done for output paths ending with .gz")
+	var atomicWrite = fs.Bool("atomic", true, "Stream to a .part file which is renamed to the output path once complete")
+	var webhook = fs.String("webhook", "", "URL to POST a JSON summary to once each video has finished streaming, successfully or not")
+	var progressSocketPath = fs.String("progress-socket", "", "Path of a Unix domain socket to publish progress on, as newline delimited JSON events like -json's, for other processes to connect to")
+	var printCfg = fs.Bool("print-config", false, "Print the configuration each video will be streamed with to stderr as JSON before streaming it, with credentials hidden")
+	var metricsAddr = fs.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics while streaming, such as :9090")
+	rf := addRequestFlags(fs)
+	bf := addBufferFlags(fs)
+
+	url, err := parseFlags(fs, args, videourl)
+	if err != nil {
+		return err
+	}
+	if url == "" && (*batch == "" || *estimate) {
+		fmt.Fprintln(os.Stderr, "A video url is required for autobuffer.")
+		fs.Usage()
+		return errUsage
+	}
+
+	cfg := rf.config()
+	bf.apply(&cfg)
+	cfg.Resume = *resume
+	cfg.Append = *appendOutput
+	cfg.ResumeVerifyBytes = *resumeVerify
+	cfg.IfModifiedSince = *ifModifiedSince
+	cfg.WarmupBytes = *warmupBytes
+	cfg.WarmupTime = *warmupTime
+	cfg.ProbeBandwidth = *probe
+	cfg.DownloadOnly = *downloadOnly
+	cfg.SyncBytes = *syncBytes
+	cfg.SyncInterval = *syncInterval
+	cfg.MaxFileSize = *maxFileSize
+	cfg.MaxRetries = *retries
+	cfg.RetryDeadline = *retryDeadline
+	cfg.RetryBackoff = *retryBackoff
+	cfg.StallTimeout = *stallTimeout
+	cfg.ExpectedSHA256 = *checksum
+	cfg.Connections = *connections
+	cfg.DisableAtomicWrite = !*atomicWrite
+	cfg.CompressOutput = *compress
+	cfg.WriteBufferSize = *writeBuffer
+	cfg.Preallocate = *preallocate
+	cfg.NoClobber = *noClobber
+	cfg.StrictExtensions = *strictExt
+	cfg.WebhookURL = *webhook
+	if *start != "" {
+		if cfg.StartOffset, cfg.StartTime, err = parseStart(*start); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -start: %v\n", err)
+			return errUsage
+		}
+	}
+	duration, err := bf.videoDuration()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errUsage
+	}
+	if *extensions != "" {
+		for _, ext := range strings.Split(*extensions, ",") {
+			cfg.ExpectedExtensions = append(cfg.ExpectedExtensions, strings.TrimSpace(ext))
+		}
+	}
+
+	ctx, cancel := rf.context()
+	defer cancel()
+
+	out, events := bf.output()
+	if events != nil || *bf.quiet {
+		cfg.Logger = nil
+	}
+	if *progressSocketPath != "" {
+		ps, err := listenProgress(*progressSocketPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listening on the progress socket: %v\n", err)
+			return err
+		}
+		defer ps.Close()
+		if events != nil {
+			events = newEventWriter(io.MultiWriter(ps, os.Stdout))
+		} else {
+			events = newEventWriter(ps)
+		}
+	}
+	if *estimate {
+		if *printCfg {
+			printConfig(os.Stderr, url, "", duration, cfg, *rf.connectTimeout, *rf.timeout)
+		}
+		return estimateVideo(ctx, url, duration, cfg, out, events)
+	}
+	var vs *VideoStream
+	if events != nil {
+		cfg.ProgressFunc = func(downloaded, total uint64, bandwidth float64) {
+			events.progress(vs.Phase(), downloaded, total, bandwidth)
+		}
+	}
+
+	// streamVideo streams the video at videourl to outpath, reporting any
+	// error to the user.
+	streamVideo := func(videourl, outpath string) error {
+		cfg := cfg
+		cfg.Username, cfg.Password = credentials(videourl, cfg.Username, cfg.Password)
+		if *printCfg {
+			printConfig(os.Stderr, videourl, outpath, duration, cfg, *rf.connectTimeout, *rf.timeout)
+		}
+		var err error
+		vs, err = NewVideoStreamConfig(ctx, videourl, duration, outpath, cfg)
+		if err != nil {
+			if errors.Is(err, ErrNotModified) {
+				fmt.Fprintf(out, "%v is up to date.\n", outpath)
+				return nil
+			}
+			if errors.Is(err, ErrAlreadyBuffered) {
+				fmt.Fprintf(out, "%v is already buffered.\n", outpath)
+				return nil
+			}
+			if errors.Is(err, context.Canceled) {
+				fmt.Fprintln(os.Stderr, "Interrupted before streaming began")
+				return errInterrupted
+			}
+			fmt.Fprintf(os.Stderr, "Error creating video stream: %v\n", err)
+			return err
+		}
+		defer vs.Close()
+
+		stopMetrics := func() error { return nil }
+		if *metricsAddr != "" {
+			if stopMetrics, err = serveMetrics(*metricsAddr, vs); err != nil {
+				fmt.Fprintf(os.Stderr, "Error serving metrics: %v\n", err)
+				return err
+			}
+		}
+
+		res, err := vs.Stream(ctx)
+		stopMetrics()
+		if events != nil {
+			events.done(vs, res, err)
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				fmt.Fprintf(os.Stderr, "\nInterrupted after buffering %v bytes to %v\n", res.BytesWritten, vs.name)
+				if res.Ready {
+					fmt.Fprintln(os.Stderr, "The video was ready to play.")
+				} else {
+					fmt.Fprintln(os.Stderr, "The video was not yet ready to play.")
+				}
+				return errInterrupted
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				fmt.Fprintf(os.Stderr, "Timed out after %v, partially downloaded video left at %v\n", *rf.timeout, vs.name)
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Error streaming %v: %v\n", videourl, err)
+			return err
+		}
+		return nil
+	}
+
+	// filename returns the filename the server suggests for the video at
+	// videourl.
+	filename := func(videourl string) string {
+		cfg := cfg
+		cfg.Username, cfg.Password = credentials(videourl, cfg.Username, cfg.Password)
+		return suggestedFilename(ctx, videourl, cfg)
+	}
+
+	if *batch == "" {
+		// Without -out, the video is named as the server suggests, if it
+		// does. Like curl -J, a file of that name is never overwritten, so
+		// that the server can't choose which file in the working directory
+		// to replace.
+		explicitOut := false
+		fs.Visit(func(f *flag.Flag) {
+			explicitOut = explicitOut || f.Name == "out"
+		})
+		if !explicitOut {
+			if name := sanitizeFilename(filename(url)); name != "" {
+				*outpath = name
+				cfg.NoClobber = true
+			}
+		}
+		err := streamVideo(url, *outpath)
+		if errors.Is(err, ErrOutputExists) && !explicitOut {
+			fmt.Fprintf(os.Stderr, "The server suggested the name %v, which already exists. Pass -out to choose where to save the video.\n", *outpath)
+		}
+		return err
+	}
+	urls, err := readBatch(*batch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading batch: %v\n", err)
+		return err
+	}
+	return runBatch(urls, *batchDir, *batchTemplate, out, filename, streamVideo)
+}
+
+// runEstimate runs the estimate subcommand, which estimates how long a video
+// would take to buffer without downloading it.
+func runEstimate(args []string) error {
+	fs := newFlagSet("estimate", "estimate [flags] url", "Estimate how long a video would take to buffer, downloading only enough of it to sample the bandwidth.")
+	var videourl = fs.String("url", "", "HTTP url, file:// URL or local path of the video. May instead be given as an argument")
+	rf := addRequestFlags(fs)
+	bf := addBufferFlags(fs)
+	url, err := parseFlags(fs, args, videourl)
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		fmt.Fprintln(os.Stderr, "A video url is required to estimate its buffer time.")
+		fs.Usage()
+		return errUsage
+	}
+
+	duration, err := bf.videoDuration()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errUsage
+	}
+
+	cfg := rf.config()
+	bf.apply(&cfg)
+	cfg.Logger = nil
+	ctx, cancel := rf.context()
+	defer cancel()
+	out, events := bf.output()
+	return estimateVideo(ctx, url, duration, cfg, out, events)
+}
+
+// estimateVideo estimates how long the video at videourl would take to
+// buffer, reporting the estimate as text or, if events isn't nil, as a JSON
+// event.
+func estimateVideo(ctx context.Context, videourl string, duration time.Duration, cfg Config, out io.Writer, events *eventWriter) error {
+	fmt.Fprintln(out, "Sampling bandwidth, please wait...")
+	cfg.Username, cfg.Password = credentials(videourl, cfg.Username, cfg.Password)
+	est, err := EstimateBufferTime(ctx, videourl, duration, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error estimating buffer time: %v\n", err)
+		return err
+	}
+	if events != nil {
+		return events.estimate(est)
+	}
+	fmt.Fprintf(out, "Size: %v bytes\n", est.Size)
+	fmt.Fprintf(out, "Duration: %v\n", est.Duration)
+	fmt.Fprintf(out, "Average bandwidth: %v bps\n", est.Bandwidth)
+	if est.BufferTime > 0 {
+		fmt.Fprintf(out, "%v until you could safely watch this video.\n", est.BufferTime.Round(time.Second))
+	} else {
+		fmt.Fprintln(out, "You could start watching this video immediately.")
+	}
+	return nil
+}
+
+// runInfo runs the info subcommand, which describes a video from the
+// response to a HEAD request for it.
+func runInfo(args []string) error {
+	fs := newFlagSet("info", "info [flags] url", "Print the size, type and range support of a video, without downloading any of it.")
+	rf := addRequestFlags(fs)
+	url, err := parseFlags(fs, args, nil)
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		fmt.Fprintln(os.Stderr, "A video url is required to describe it.")
+		fs.Usage()
+		return errUsage
+	}
+
+	cfg := rf.config()
+	cfg.Username, cfg.Password = credentials(url, cfg.Username, cfg.Password)
+	ctx, cancel := rf.context()
+	defer cancel()
+	info, err := requestInfo(ctx, url, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error requesting %v: %v\n", url, err)
+		return err
+	}
+	info.print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// Clock tells the time and waits for it to pass, so that tests can control
+// the timing of the bandwidth measurements and the buffer time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel receiving the current time once d has
+	// passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock returns the Clock to use.
+func (cfg *Config) clock() Clock {
+	if cfg.Clock != nil {
+		return cfg.Clock
+	}
+	return realClock{}
+}
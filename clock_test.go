@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only passes when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	c := make(chan time.Time, 1)
+	fc.waiters = append(fc.waiters, fakeWaiter{fc.now.Add(d), c})
+	return c
+}
+
+// Advance moves the time forward by d, firing the channels that are due.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+	waiters := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if w.at.After(fc.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- fc.now
+	}
+	fc.waiters = waiters
+}
+
+// waiting returns the number of channels waiting to fire.
+func (fc *fakeClock) waiting() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.waiters)
+}
+
+func TestAwaitReadyClock(t *testing.T) {
+	for _, margin := range []time.Duration{0, 3 * time.Second} {
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := &fakeClock{now: start}
+		var readyAt time.Time
+		vs := &VideoStream{
+			size:      1000,
+			knownSize: true,
+			duration:  time.Minute,
+			rate:      rateWindow{window: bandwidthWindow},
+			cfg: Config{
+				FudgeFactor:   1,
+				StartupMargin: margin,
+				Clock:         clock,
+				OnReady:       func(string) { readyAt = clock.Now() },
+			},
+		}
+		atomic.StoreInt64(&vs.started, start.UnixNano())
+
+		done := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			vs.awaitReady(time.Second, done)
+		}()
+
+		// 10 bytes arrive every second, so the remaining 1000 bytes take
+		// 100s to download, and a minute of playback can start after 40s,
+		// plus the startup margin.
+		for atomic.LoadInt32(&vs.ready) == 0 {
+			for clock.waiting() == 0 && atomic.LoadInt32(&vs.ready) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if atomic.LoadInt32(&vs.ready) == 1 {
+				break
+			}
+			atomic.AddUint64(&vs.downloaded, 10)
+			clock.Advance(time.Second)
+		}
+		<-exited
+		close(done)
+		if want := start.Add(40*time.Second + margin); !readyAt.Equal(want) {
+			t.Fatalf("expected the video to be ready at %v with a %v margin, got %v", want, margin, readyAt)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+)
+
+// gzipSuffix is the extension of output files that are compressed without
+// Config.CompressOutput being set.
+const gzipSuffix = ".gz"
+
+// compressOutput reports whether the video streamed to outfile is compressed.
+func (cfg *Config) compressOutput(outfile string) bool {
+	return cfg.CompressOutput || strings.HasSuffix(strings.ToLower(outfile), gzipSuffix)
+}
+
+// finishCompressed writes the end of the compressed video to the output file
+// once the whole video has been streamed, recording the size of the file in
+// res.
+func (vs *VideoStream) finishCompressed(res *StreamResult) error {
+	if err := vs.gz.Close(); err != nil {
+		return err
+	}
+	fi, err := vs.f.Stat()
+	if err != nil {
+		return err
+	}
+	res.CompressedBytes = uint64(fi.Size())
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamCompressOutput(t *testing.T) {
+	const outfile = testFilename + ".gz"
+	os.Remove(outfile)
+	defer os.Remove(outfile)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	cfg := Config{Connections: 4, Resume: true, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, outfile, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BytesWritten != testSz {
+		t.Fatalf("expected %v bytes written, got %v", testSz, res.BytesWritten)
+	}
+	vs.Close()
+
+	fi, err := os.Stat(outfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.CompressedBytes != uint64(fi.Size()) {
+		t.Fatalf("expected %v compressed bytes, got %v", fi.Size(), res.CompressedBytes)
+	}
+	f, err := os.Open(outfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testData) {
+		t.Fatal("decompressed output did not match the video")
+	}
+}
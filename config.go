@@ -0,0 +1,536 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the optional parameters of a VideoStream.
+type Config struct {
+	// Client is used to make HTTP requests. If nil, http.DefaultClient is
+	// used. A Client with a cookie Jar sends the cookies of an existing
+	// session, such as one obtained from a login endpoint.
+	Client *http.Client
+
+	// Username and Password are sent using HTTP Basic Auth.
+	Username string
+	Password string
+
+	// Method is the HTTP method used to request the video. If empty, GET is
+	// used.
+	Method string
+
+	// Body, if set, is sent as the body of each request for the video, such
+	// as a JSON description of the asset for servers that require a POST.
+	// It is a byte slice rather than a reader since the video may be
+	// requested more than once, to resume it or download it in parallel.
+	Body []byte
+
+	// Headers are additional HTTP headers sent with each request. An
+	// Authorization header, such as a bearer token, overrides Username and
+	// Password.
+	Headers map[string]string
+
+	// UserAgent is sent as the User-Agent header of each request, since some
+	// servers refuse requests with Go's default. If empty,
+	// "autobuffer/<version>" is used. A User-Agent in Headers takes
+	// precedence.
+	UserAgent string
+
+	// Cookies are sent with each request, such as a session cookie for
+	// servers that authenticate with one rather than with Basic Auth.
+	Cookies []*http.Cookie
+
+	// DownloadOnly skips sampling the bandwidth and computing the buffer
+	// time, simply downloading the video with progress reported. The video
+	// is never announced as ready to play.
+	DownloadOnly bool
+
+	// Resume continues a previously interrupted download instead of
+	// overwriting it. If the output file already exists, only the bytes
+	// following it are requested from the server. Servers that do not
+	// support range requests, as reported by a HEAD request made first,
+	// cause the download to restart from scratch. While streaming to a file,
+	// the url, version and progress of the download are saved every few
+	// seconds to a JSON file with the suffix ".state" alongside it, so that
+	// a download interrupted even by a crash resumes from the bytes known to
+	// have reached the disk. The state file is removed once the video is
+	// complete, and a complete output file isn't downloaded again:
+	// NewVideoStreamConfig returns ErrAlreadyBuffered instead.
+	Resume bool
+
+	// ResumeVerifyBytes, if positive, is how many bytes before the end of a
+	// partially downloaded file are downloaded again when resuming, and
+	// compared with the file before trusting it, since the last write before
+	// a crash may have been torn. If they differ, the download starts over.
+	ResumeVerifyBytes int64
+
+	// Append adds the video to the end of the output file, creating it if
+	// it doesn't exist, instead of overwriting it, such as to concatenate
+	// segments captured one at a time. The file is written in place over a
+	// single connection, without Preallocate or a state file, and sizes,
+	// progress and the checksum count only the video appended.
+	// It may not be combined with Resume.
+	Append bool
+
+	// IfModifiedSince makes the request for the video conditional on it
+	// having been modified since the output file was, if it exists. If the
+	// server responds 304 Not Modified, NewVideoStreamConfig returns
+	// ErrNotModified, leaving the output file as it is.
+	IfModifiedSince bool
+
+	// StartOffset, if positive, is the byte of the video to start streaming
+	// from, such as to watch a long video from the middle. Only the rest of
+	// the video is downloaded, and written to the output from its start, and
+	// the buffer time is computed for it alone. StartTime instead starts
+	// from a time in the video, converted to a byte assuming a constant
+	// bitrate, which requires the duration of the video. Neither may be
+	// combined with Resume, and ExpectedSHA256 is the digest of the bytes
+	// downloaded.
+	StartOffset int64
+	StartTime   time.Duration
+
+	// SampleBytes is the number of bytes downloaded to estimate the available
+	// bandwidth. If zero, 10MB are sampled. Videos smaller than SampleBytes
+	// are sampled in their entirety.
+	SampleBytes int64
+
+	// ProbeRounds splits the bandwidth sample into this many consecutive
+	// probes, each timed on its own. The fastest and slowest probes are
+	// discarded and the rest averaged, for an estimate that is steadier on
+	// bursty connections. If zero or one, the sample is timed as a whole.
+	ProbeRounds int
+
+	// WarmupBytes and WarmupTime bound a warmup period read before the
+	// bandwidth is sampled, which isn't timed since throughput ramps up over
+	// the first moments of a connection. The warmup ends once WarmupBytes
+	// have been read or WarmupTime has passed, whichever comes first, and
+	// either may be zero for no limit. If both are zero, there is no warmup.
+	WarmupBytes int64
+	WarmupTime  time.Duration
+
+	// ProbeBandwidth samples the bandwidth with a separate request for the
+	// start of the video, which is discarded, rather than with the start of
+	// the download itself. This costs an extra request, but leaves the
+	// download undisturbed.
+	ProbeBandwidth bool
+
+	// ProgressFunc, if set, is called periodically while streaming with the
+	// number of bytes downloaded so far, the total size of the video, and
+	// the current bandwidth in bytes per second, measured over the last few
+	// seconds. total is zero if the server did not report the size of the
+	// video. It is called a final time before Stream returns.
+	ProgressFunc func(downloaded, total uint64, bandwidth float64)
+
+	// BufferTimeFunc, if set, is called periodically while buffering with
+	// the time remaining until the video can be safely played, recomputed
+	// from the current bandwidth. It stops being called once the video is
+	// ready to play.
+	BufferTimeFunc func(bufferTime time.Duration)
+
+	// OnReady, if set, is called once the video is ready to play with the
+	// path of the file to play it from, or the empty string for VideoStreams
+	// created with NewVideoStreamWriter. It is called at most once, and not
+	// at all if Stream fails before the video is ready.
+	OnReady func(path string)
+
+	// OnUnderrun, if set, is called when the bandwidth drops after the video
+	// was announced as ready, such that playback started then would catch
+	// up with the download. wait is how long to pause playback for to
+	// avoid stalling. It is called again only once playback would be safe
+	// again and the bandwidth drops anew. The video's duration must be known.
+	OnUnderrun func(wait time.Duration)
+
+	// Logger, if set, receives human readable status messages and a
+	// progress bar while streaming. If nil, the VideoStream is silent.
+	Logger io.Writer
+
+	// Verbose writes status messages to stdout if Logger is nil.
+	Verbose bool
+
+	// RefreshURL, if set, returns a fresh url for the video, such as a newly
+	// signed url for a CDN whose urls expire. The first request uses the url
+	// the VideoStream was created with; subsequent requests, made to probe
+	// the bandwidth, to retry or resume the download, or to download over
+	// several connections, request the url returned by RefreshURL instead.
+	// It must return a url for the same video.
+	RefreshURL func() (string, error)
+
+	// Clock, if set, replaces the system clock when measuring the bandwidth
+	// and recomputing the buffer time, so that tests can simulate the
+	// passage of time.
+	Clock Clock
+
+	// RetryDeadline, if positive, is the total time to spend retrying after
+	// transient errors, including the backoff, before giving up. Unlike
+	// MaxRetries, a burst of quick failures doesn't exhaust it. If
+	// MaxRetries is also set, retries stop at whichever limit is reached
+	// first; otherwise they are unlimited in number. Each connection of a
+	// download over several has its own deadline.
+	RetryDeadline time.Duration
+
+	// MaxRetries is the number of times a failed download is resumed after a
+	// transient error, such as a dropped connection or a 5xx response.
+	// Resuming requires the server to support range requests.
+	MaxRetries int
+
+	// RetryBackoff is how long to wait before the first retry. The wait is
+	// doubled after each consecutive failure. If zero, one second is used.
+	RetryBackoff time.Duration
+
+	// StallTimeout, if positive, is how long Stream waits for bytes of the
+	// video before giving up with ErrStalled, so that a server which holds
+	// the connection open without sending anything fails fast instead of
+	// hanging. Time spent paused isn't counted.
+	StallTimeout time.Duration
+
+	// ExpectedSHA256 is the hex encoded SHA-256 digest the downloaded video
+	// must match. If set, Stream returns ErrChecksumMismatch when the
+	// digests differ.
+	ExpectedSHA256 string
+
+	// Connections is the number of concurrent connections used to download
+	// the video. Connections greater than one requires the server to support
+	// range requests and the video to be streamed to a file; otherwise a
+	// single connection is used. The bandwidth is always sampled over a
+	// single connection. The connections are multiplexed over HTTP/2 where
+	// the server supports it, and otherwise reused between the requests for
+	// each range, for clients using an http.Transport.
+	Connections int
+
+	// DisableHTTP2 requests the video over HTTP/1.1 even if the server
+	// supports HTTP/2, for servers that handle concurrent range requests
+	// better over separate connections. It applies to clients using an
+	// http.Transport.
+	DisableHTTP2 bool
+
+	// FudgeFactor overestimates the time needed to download the video, to
+	// account for variations in bandwidth over the duration of the stream.
+	// A FudgeFactor of 1.5 assumes the download takes 50% longer than the
+	// measured bandwidth suggests, delaying playback accordingly. Steady
+	// connections can use a factor close to 1, while unreliable ones need a
+	// larger margin. If zero, 1.2 is used. It must not be less than 1.
+	FudgeFactor float64
+
+	// StartupMargin is added to the buffer time, delaying the video being
+	// announced as ready by that much, so that the player has a buffer to
+	// cover decoding and seeking as it starts. Unlike FudgeFactor, it
+	// doesn't grow with the length of the download.
+	StartupMargin time.Duration
+
+	// BufferStrategy, if set, decides how long to buffer the video instead
+	// of FudgeFactor, for example leaving an absolute margin or accounting
+	// for the variance of the bandwidth.
+	BufferStrategy BufferStrategy
+
+	// MinBufferPercent, if set, declares the video ready to play once that
+	// percentage of it has been downloaded, instead of once the rest of the
+	// download is estimated to outpace playback. It takes precedence over
+	// the bandwidth-based estimate, so FudgeFactor, BufferStrategy and the
+	// duration of the video are ignored. It must be between 0 and 100.
+	MinBufferPercent float64
+
+	// PlaybackBitrate, if positive, is the rate at which playback consumes
+	// the video, in bytes per second, for videos with a constant or known
+	// average bitrate. The buffer time is then computed so that the
+	// download stays ahead of playback at that rate, rather than from the
+	// duration of the video, which needn't be known. A video whose size
+	// isn't reported is ready to play as soon as the bandwidth outpaces
+	// playback.
+	PlaybackBitrate int64
+
+	// AllowedHosts, if set, restricts the hosts the server may redirect to.
+	// Redirects to the host of the requested url are always allowed, while
+	// redirects to any other host not listed fail with
+	// ErrRedirectNotAllowed. Regardless of AllowedHosts, the Authorization
+	// header is not sent to a host other than the one requested.
+	AllowedHosts []string
+
+	// DisableAtomicWrite streams the video directly to the output path. By
+	// default the video is streamed to a file with the suffix ".part"
+	// appended to the output path, which is renamed to the output path once
+	// the whole video has been downloaded and verified, so that a failed
+	// download never leaves a file at the output path. An interrupted
+	// download leaves only the .part file, which Resume continues. Note that
+	// the video must then be played from the .part file while streaming.
+	DisableAtomicWrite bool
+
+	// ExpectedExtensions, if set, lists the extensions the output path is
+	// expected to end with, such as ".mkv" or ".mp4", since players may not
+	// recognize a video without one. An output path ending with any other
+	// extension is warned about through the Logger, suggesting the extension
+	// of the video's Content-Type if it is a known container.
+	// StrictExtensions refuses to stream to it instead, returning
+	// ErrUnexpectedExtension.
+	ExpectedExtensions []string
+	StrictExtensions   bool
+
+	// Preallocate extends a newly created output file to the size of the
+	// video before streaming, so the filesystem can lay it out contiguously
+	// and the file has its final size from the start. It has no effect if
+	// the size of the video is unknown or a download is resumed. If the
+	// stream fails, the file is truncated to the bytes downloaded so that
+	// Resume can continue it.
+	Preallocate bool
+
+	// NoClobber refuses to stream to an output file that already exists,
+	// returning ErrOutputExists, rather than overwriting it. Resuming a
+	// download is still allowed, since it continues the file rather than
+	// overwriting it: the .part file, or the output file itself with
+	// DisableAtomicWrite.
+	NoClobber bool
+
+	// MaxBytesPerSecond, if set, limits the rate at which the video is
+	// downloaded, across all connections. The buffer time accounts for the
+	// limit, since the video can't download any faster.
+	MaxBytesPerSecond int64
+
+	// ReadyBytesPerSecond, if set, limits the rate at which the rest of the
+	// video is downloaded once it is ready to play, leaving bandwidth to
+	// other traffic. The video isn't ready until the rest can download at
+	// that rate without playback catching up.
+	ReadyBytesPerSecond int64
+
+	// PreferIPv4 connects to the server's IPv4 addresses before its IPv6
+	// addresses, and PreferIPv6 the reverse, falling back to the other if
+	// none can be reached. At most one may be set. They apply to clients
+	// using an http.Transport, whose dialer is wrapped to resolve the host
+	// itself.
+	PreferIPv4 bool
+	PreferIPv6 bool
+
+	// Resolver, if set, resolves the server's host in place of the system
+	// resolver, and HostOverrides maps host names to the IP address to
+	// connect to for them, bypassing DNS, for split-horizon setups where the
+	// server is reached at an internal address. TLS certificates are still
+	// verified against the host name. Like PreferIPv4, they apply to clients
+	// using an http.Transport.
+	Resolver      *net.Resolver
+	HostOverrides map[string]string
+
+	// PinnedCertSHA256, if set, is the hex encoded SHA-256 fingerprint of
+	// the server's TLS certificate. Connecting to a server presenting any
+	// other certificate fails with ErrCertificateMismatch, so that a
+	// compromised certificate authority can't intercept the video. The
+	// fingerprint may separate its bytes with colons. Only https urls may be
+	// requested, by a client using an http.Transport.
+	PinnedCertSHA256 string
+
+	// CopyBufferSize is the size of the buffer the video is copied through
+	// from the response body, bounding the memory used regardless of the
+	// size of the video. Each connection has its own buffer. If zero,
+	// 32KB are used.
+	CopyBufferSize int
+
+	// WriteBufferSize, if positive, is the number of bytes of the video that
+	// may be held in memory waiting to be written to the output, which is
+	// written from a separate goroutine. The download then only waits for a
+	// slow disk once the buffer is full, and the bandwidth sampled is that
+	// of the network rather than the disk. A player reading the output file
+	// may lag the download by up to this many bytes. It has no effect on
+	// downloads over several connections.
+	WriteBufferSize int
+
+	// CompressOutput gzips the video as it is written to the output file,
+	// which is also the case if the output path ends with ".gz". The
+	// checksum, progress and buffer time still count the bytes of the video
+	// received, while StreamResult.CompressedBytes reports the size of the
+	// file. A compressed download can't be resumed, preallocated, split
+	// over several connections or read with Reader.
+	CompressOutput bool
+
+	// MaxFileSize, if positive, is the largest video to download, in bytes.
+	// A video reported to be larger is refused, and a download exceeding it
+	// fails, with ErrTooLarge, so that a bogus or malicious size can't fill
+	// the disk.
+	MaxFileSize int64
+
+	// SyncBytes and SyncInterval, if positive, sync the output file to disk
+	// once that many bytes have been written to it, or that much time has
+	// passed, since it was last synced. Otherwise the operating system
+	// decides when to write the video to disk, and a power failure may lose
+	// much of what was downloaded. Syncing frequently slows the download.
+	SyncBytes    int64
+	SyncInterval time.Duration
+
+	// WebhookURL, if set, is sent a POST request with a JSON summary of the
+	// download once Stream returns, whether or not it succeeded: the url
+	// and path of the video, its size in bytes and duration in seconds, the
+	// seconds spent streaming, and whether it succeeded or the error it
+	// failed with. The request times out after a few seconds, and its
+	// failure is only logged.
+	WebhookURL string
+
+	// defaulted is set by setDefaults, so that a Config shared between
+	// downloads, as by a Streamer, keeps the client derived for it rather
+	// than deriving another each time.
+	defaulted bool
+}
+
+// ErrRedirectNotAllowed is returned when the server redirects to a host not
+// in Config.AllowedHosts.
+var ErrRedirectNotAllowed = errors.New("redirect to a host that is not allowed")
+
+// maxRedirects is the number of redirects followed before giving up, the
+// same as http.Client's default.
+const maxRedirects = 10
+
+// client returns the configured HTTP client, or http.DefaultClient if none is
+// set, to request u with. Redirects are checked by checkRedirect, and only
+// file:// URLs are served from the local filesystem, so that a remote server
+// can't have a local file read by redirecting to it.
+func (cfg *Config) client(u *url.URL) *http.Client {
+	c := http.DefaultClient
+	if cfg.Client != nil {
+		c = cfg.Client
+	}
+	client := *c
+	if u.Scheme == "file" {
+		client.Transport = fileTransport{}
+	}
+	next := c.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := cfg.checkRedirect(req, via); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		return nil
+	}
+	return &client
+}
+
+// checkRedirect refuses redirects to hosts other than the requested one that
+// aren't in AllowedHosts, and redirects from one scheme to another other than
+// between http and https. It drops the Authorization header from redirects to
+// another host so that credentials aren't leaked.
+func (cfg *Config) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %v redirects", maxRedirects)
+	}
+	if from, to := via[0].URL.Scheme, req.URL.Scheme; !strings.EqualFold(from, to) && !(isHTTP(from) && isHTTP(to)) {
+		return fmt.Errorf("%w: %v URL redirected to %v", ErrRedirectNotAllowed, from, to)
+	}
+	if cfg.PinnedCertSHA256 != "" && req.URL.Scheme == "http" {
+		return errPinnedHTTP
+	}
+	if strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return nil
+	}
+	req.Header.Del("Authorization")
+	if cfg.hostAllowed(req.URL) {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrRedirectNotAllowed, req.URL.Host)
+}
+
+// hostAllowed reports whether u is on a host in AllowedHosts, or any host if
+// none are listed.
+func (cfg *Config) hostAllowed(u *url.URL) bool {
+	if len(cfg.AllowedHosts) == 0 {
+		return true
+	}
+	for _, host := range cfg.AllowedHosts {
+		if strings.EqualFold(host, u.Hostname()) || strings.EqualFold(host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDefaults sets unset fields to their default values, and returns an error
+// if any field is invalid. Configs it has already been called on are left as
+// they are.
+func (cfg *Config) setDefaults() error {
+	if cfg.defaulted {
+		return nil
+	}
+	if cfg.SampleBytes <= 0 {
+		cfg.SampleBytes = bandwidthSampleSize
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodGet
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaultUserAgent
+	}
+	if cfg.CopyBufferSize <= 0 {
+		cfg.CopyBufferSize = defaultCopyBufferSize
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	if cfg.Verbose && cfg.Logger == nil {
+		cfg.Logger = os.Stdout
+	}
+	if cfg.FudgeFactor == 0 {
+		cfg.FudgeFactor = defaultFudgeFactor
+	}
+	if cfg.FudgeFactor < 1 {
+		return fmt.Errorf("fudge factor %v is less than 1, which would under-buffer the video", cfg.FudgeFactor)
+	}
+	if cfg.StartupMargin < 0 {
+		return fmt.Errorf("startup margin %v is negative", cfg.StartupMargin)
+	}
+	if cfg.MinBufferPercent < 0 || cfg.MinBufferPercent > 100 {
+		return fmt.Errorf("minimum buffer percentage %v is not between 0 and 100", cfg.MinBufferPercent)
+	}
+	if cfg.StartOffset < 0 || cfg.StartTime < 0 {
+		return errors.New("the start position must not be negative")
+	}
+	if cfg.MaxBytesPerSecond < 0 || cfg.ReadyBytesPerSecond < 0 {
+		return errors.New("download rate limits must not be negative")
+	}
+	if cfg.ResumeVerifyBytes < 0 {
+		return errors.New("ResumeVerifyBytes must not be negative")
+	}
+	if cfg.Resume && cfg.Append {
+		return errors.New("Append may not be combined with Resume")
+	}
+	if cfg.Resume && (cfg.StartOffset > 0 || cfg.StartTime > 0) {
+		return errors.New("a start position may not be combined with Resume")
+	}
+	if cfg.PreferIPv4 && cfg.PreferIPv6 {
+		return errors.New("only one of PreferIPv4 and PreferIPv6 may be set")
+	}
+	c := http.DefaultClient
+	if cfg.Client != nil {
+		c = cfg.Client
+	}
+	if cfg.Connections > 1 || cfg.DisableHTTP2 {
+		c = poolClient(c, cfg.Connections, cfg.DisableHTTP2)
+		cfg.Client = c
+	}
+	if cfg.PinnedCertSHA256 != "" {
+		pin, err := parsePin(cfg.PinnedCertSHA256)
+		if err != nil {
+			return err
+		}
+		if c, err = pinClient(c, pin); err != nil {
+			return err
+		}
+		cfg.Client = c
+	}
+	if cfg.PreferIPv4 || cfg.PreferIPv6 || cfg.Resolver != nil || len(cfg.HostOverrides) > 0 {
+		overrides, err := parseHostOverrides(cfg.HostOverrides)
+		if err != nil {
+			return err
+		}
+		var order func([]net.IPAddr)
+		if cfg.PreferIPv4 || cfg.PreferIPv6 {
+			v4 := cfg.PreferIPv4
+			order = func(ips []net.IPAddr) { sortIPs(ips, v4) }
+		}
+		cfg.Client = resolveClient(c, overrideLookup(cfg.Resolver, overrides), order)
+	}
+	cfg.defaulted = true
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConfigSetDefaults(t *testing.T) {
+	var cfg Config
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.FudgeFactor != defaultFudgeFactor {
+		t.Fatalf("expected default fudge factor %v, got %v", defaultFudgeFactor, cfg.FudgeFactor)
+	}
+	if cfg.SampleBytes != bandwidthSampleSize {
+		t.Fatalf("expected default sample size %v, got %v", bandwidthSampleSize, cfg.SampleBytes)
+	}
+
+	cfg = Config{FudgeFactor: 0.9}
+	if err := cfg.setDefaults(); err == nil {
+		t.Fatal("expected a fudge factor below 1 to be rejected")
+	}
+
+	cfg = Config{StartupMargin: -time.Second}
+	if err := cfg.setDefaults(); err == nil {
+		t.Fatal("expected a negative startup margin to be rejected")
+	}
+
+	cfg = Config{Connections: 4}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	client := cfg.Client
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Client != client {
+		t.Fatal("expected setting the defaults again to keep the client")
+	}
+}
+
+func TestConfigRedirect(t *testing.T) {
+	var auth string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Add("Content-Length", strconv.Itoa(1000))
+		w.Write(testData[:1000])
+	}))
+	defer target.Close()
+	origin := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer origin.Close()
+
+	tests := []struct {
+		allowed []string
+		err     error
+	}{
+		{nil, nil},
+		{[]string{target.Listener.Addr().String()}, nil},
+		{[]string{"example.com"}, ErrRedirectNotAllowed},
+	}
+	for _, test := range tests {
+		auth = ""
+		cfg := Config{
+			Username:     "user",
+			Password:     "pass",
+			AllowedHosts: test.allowed,
+		}
+		vs, err := NewVideoStreamWriter(context.Background(), origin.URL, time.Second, ioutil.Discard, cfg)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("allowed hosts %v: expected error %v, got %v", test.allowed, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		vs.Close()
+		if auth != "" {
+			t.Fatalf("allowed hosts %v: Authorization header was sent to another host", test.allowed)
+		}
+	}
+}
+
+func TestConfigRedirectToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, testData[:1000], 0666); err != nil {
+		t.Fatal(err)
+	}
+	fileURL, err := localURL(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.RedirectHandler(fileURL, http.StatusFound))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{})
+	if err == nil {
+		vs.Stream(context.Background())
+		vs.Close()
+		t.Fatal("expected a redirect to a local file to be refused")
+	}
+	if !errors.Is(err, ErrRedirectNotAllowed) {
+		t.Fatalf("expected ErrRedirectNotAllowed, got %v", err)
+	}
+	if buf.Len() > 0 {
+		t.Fatal("expected nothing to be read from the local file")
+	}
+}
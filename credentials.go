@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The environment variables that supply HTTP basic auth credentials when
+// they aren't given on the command line, keeping them out of the process
+// list and shell history.
+const (
+	usernameEnv = "AUTOBUFFER_USER"
+	passwordEnv = "AUTOBUFFER_PASS"
+)
+
+// credentials returns the HTTP basic auth credentials to request the video
+// at rawurl with. username and password, as given on the command line, are
+// preferred, followed by the AUTOBUFFER_USER and AUTOBUFFER_PASS environment
+// variables and then the entry for the url's host in the netrc file.
+func credentials(rawurl, username, password string) (string, string) {
+	if username == "" {
+		username = os.Getenv(usernameEnv)
+	}
+	if password == "" {
+		password = os.Getenv(passwordEnv)
+	}
+	if username != "" || password != "" {
+		return username, password
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return "", ""
+	}
+	login, password, _ := readNetrc(netrcPath(), u.Hostname())
+	return login, password
+}
+
+// netrcPath returns the path of the netrc file, named by the NETRC
+// environment variable or otherwise .netrc in the home directory.
+func netrcPath() string {
+	if name := os.Getenv("NETRC"); name != "" {
+		return name
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// readNetrc returns the login and password for host from the netrc file at
+// name, falling back to its default entry. ok is false if the file can't be
+// read or has no entry for host.
+func readNetrc(name, host string) (login, password string, ok bool) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Split(bufio.ScanWords)
+	var fields []string
+	for sc.Scan() {
+		fields = append(fields, sc.Text())
+	}
+
+	// Entries run from a machine or default token to the next one. Macro
+	// definitions aren't supported, so the words of their bodies are treated
+	// as tokens like any other.
+	var machine string
+	var matched, isDefault bool
+	var defLogin, defPassword string
+	var hasDefault bool
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if matched {
+				return login, password, true
+			}
+			machine, isDefault = "", false
+			if i+1 < len(fields) {
+				i++
+				machine = fields[i]
+			}
+			matched = strings.EqualFold(machine, host)
+		case "default":
+			if matched {
+				return login, password, true
+			}
+			isDefault, hasDefault = true, true
+		case "login", "password", "account":
+			if i+1 >= len(fields) {
+				break
+			}
+			i++
+			switch {
+			case matched && fields[i-1] == "login":
+				login = fields[i]
+			case matched && fields[i-1] == "password":
+				password = fields[i]
+			case isDefault && fields[i-1] == "login":
+				defLogin = fields[i]
+			case isDefault && fields[i-1] == "password":
+				defPassword = fields[i]
+			}
+		}
+	}
+	if matched {
+		return login, password, true
+	}
+	if hasDefault {
+		return defLogin, defPassword, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNetrc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, ".netrc")
+	netrc := `machine example.com
+	login alice
+	password secret
+machine other.example.com login bob password hunter2
+default login anonymous password guest
+`
+	if err := ioutil.WriteFile(name, []byte(netrc), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, login, password string
+	}{
+		{"example.com", "alice", "secret"},
+		{"EXAMPLE.com", "alice", "secret"},
+		{"other.example.com", "bob", "hunter2"},
+		{"unknown.example.com", "anonymous", "guest"},
+	}
+	for _, test := range tests {
+		login, password, ok := readNetrc(name, test.host)
+		if !ok || login != test.login || password != test.password {
+			t.Fatalf("%v: expected %v:%v, got %v:%v (ok %v)", test.host, test.login, test.password, login, password, ok)
+		}
+	}
+
+	if _, _, ok := readNetrc(filepath.Join(dir, "missing"), "example.com"); ok {
+		t.Fatal("expected no credentials from a missing netrc file")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, ".netrc")
+	if err := ioutil.WriteFile(name, []byte("machine example.com login alice password secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{"NETRC", usernameEnv, passwordEnv} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("NETRC", name)
+	os.Unsetenv(usernameEnv)
+	os.Unsetenv(passwordEnv)
+
+	if u, p := credentials("https://example.com/video.mkv", "", ""); u != "alice" || p != "secret" {
+		t.Fatalf("expected the credentials from netrc, got %v:%v", u, p)
+	}
+	if u, p := credentials("https://other.example.com/video.mkv", "", ""); u != "" || p != "" {
+		t.Fatalf("expected no credentials for a host missing from netrc, got %v:%v", u, p)
+	}
+
+	os.Setenv(usernameEnv, "carol")
+	os.Setenv(passwordEnv, "letmein")
+	if u, p := credentials("https://example.com/video.mkv", "", ""); u != "carol" || p != "letmein" {
+		t.Fatalf("expected the credentials from the environment, got %v:%v", u, p)
+	}
+	if u, p := credentials("https://example.com/video.mkv", "dave", ""); u != "dave" || p != "letmein" {
+		t.Fatalf("expected the username flag to override the environment, got %v:%v", u, p)
+	}
+}
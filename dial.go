@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// dialFunc is the signature of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// lookupFunc is the signature of net.Resolver.LookupIPAddr.
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// resolveDial returns a dialFunc which resolves the host itself with lookup
+// and dials its addresses in turn, ordered by order if it is non-nil, until
+// one can be reached.
+func resolveDial(dial dialFunc, lookup lookupFunc, order func([]net.IPAddr)) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		// A resolver may find no addresses without failing, which would
+		// otherwise leave nothing dialed and no error.
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses for host %v", host)
+		}
+		if order != nil {
+			order(ips)
+		}
+
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
+
+// sortIPs sorts the IPv4 addresses in ips first if v4 is true, or the IPv6
+// addresses first otherwise, preserving the resolver's order within each
+// family.
+func sortIPs(ips []net.IPAddr, v4 bool) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		return (ips[i].IP.To4() != nil) == v4 && (ips[j].IP.To4() != nil) != v4
+	})
+}
+
+// overrideLookup returns a lookupFunc which resolves the hosts in overrides
+// to their IP addresses, and any other host with r, or net.DefaultResolver if
+// r is nil. Hosts are matched case-insensitively, and overrides must be keyed
+// by lower case host names.
+func overrideLookup(r *net.Resolver, overrides map[string]net.IP) lookupFunc {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if ip, ok := overrides[strings.ToLower(host)]; ok {
+			return []net.IPAddr{{IP: ip}}, nil
+		}
+		return r.LookupIPAddr(ctx, host)
+	}
+}
+
+// parseHostOverrides validates the HostOverrides of a Config, returning them
+// keyed by lower case host name.
+func parseHostOverrides(overrides map[string]string) (map[string]net.IP, error) {
+	ips := make(map[string]net.IP, len(overrides))
+	for host, addr := range overrides {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q for host %v", addr, host)
+		}
+		ips[strings.ToLower(host)] = ip
+	}
+	return ips, nil
+}
+
+// resolveClient returns a copy of c whose connections resolve hosts with
+// lookup, trying their addresses in the order given by order if it is
+// non-nil. Clients not using an http.Transport are returned unchanged.
+func resolveClient(c *http.Client, lookup lookupFunc, order func([]net.IPAddr)) *http.Client {
+	return cloneTransport(c, func(t *http.Transport) {
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = resolveDial(dial, lookup, order)
+	})
+}
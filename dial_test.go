@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortIPs(t *testing.T) {
+	v6a, v4a, v6b, v4b := net.ParseIP("::1"), net.ParseIP("127.0.0.1"), net.ParseIP("2001:db8::1"), net.ParseIP("10.0.0.1")
+	ips := func() []net.IPAddr {
+		return []net.IPAddr{{IP: v6a}, {IP: v4a}, {IP: v6b}, {IP: v4b}}
+	}
+
+	tests := []struct {
+		v4   bool
+		want []net.IP
+	}{
+		{true, []net.IP{v4a, v4b, v6a, v6b}},
+		{false, []net.IP{v6a, v6b, v4a, v4b}},
+	}
+	for _, test := range tests {
+		got := ips()
+		sortIPs(got, test.v4)
+		for i := range got {
+			if !got[i].IP.Equal(test.want[i]) {
+				t.Fatalf("v4 %v: expected %v at %v, got %v", test.v4, test.want[i], i, got[i].IP)
+			}
+		}
+	}
+}
+
+func TestResolveDialNoAddresses(t *testing.T) {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		t.Fatalf("expected nothing to be dialed, got %v", addr)
+		return nil, nil
+	}
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, nil
+	}
+	conn, err := resolveDial(dial, lookup, nil)(context.Background(), "tcp", "example.com:80")
+	if conn != nil || err == nil || !strings.Contains(err.Error(), "no addresses for host example.com") {
+		t.Fatalf("expected an error for a host without addresses, got %v, %v", conn, err)
+	}
+}
+
+func TestVideoStreamPreferIPv4(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(1000))
+		w.Write(testData[:1000])
+	}))
+	defer ts.Close()
+
+	var dialed []string
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	cfg := Config{
+		Client:     &http.Client{Transport: transport},
+		PreferIPv4: true,
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialed) == 0 {
+		t.Fatal("expected the configured transport's dialer to be used")
+	}
+
+	if err := (&Config{PreferIPv4: true, PreferIPv6: true}).setDefaults(); err == nil {
+		t.Fatal("expected preferring both IPv4 and IPv6 to be rejected")
+	}
+}
+
+func TestVideoStreamHostOverrides(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(1000))
+		w.Write(testData[:1000])
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://video.internal:" + port + "/video.mkv"
+
+	// Hosts without an override are resolved by the Resolver.
+	var resolved bool
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			resolved = true
+			return nil, errors.New("no DNS server")
+		},
+	}
+	cfg := Config{Resolver: resolver}
+	if _, err := NewVideoStreamWriter(context.Background(), url, time.Second, ioutil.Discard, cfg); err == nil {
+		t.Fatal("expected the host not to resolve")
+	}
+	if !resolved {
+		t.Fatal("expected the host to be resolved by the configured Resolver")
+	}
+
+	cfg.HostOverrides = map[string]string{"Video.Internal": "127.0.0.1"}
+	vs, err := NewVideoStreamWriter(context.Background(), url, time.Second, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Config{HostOverrides: map[string]string{"video.internal": "not an address"}}).setDefaults(); err == nil {
+		t.Fatal("expected an override to an invalid address to be rejected")
+	}
+}
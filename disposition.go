@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sanitizeFilename returns name reduced to a single path element safe to
+// create, without control characters or a leading dot, or "" if nothing
+// usable remains.
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+	if name == "" || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// dispositionFilename returns the filename suggested by the
+// Content-Disposition header of res, or "" if there isn't one.
+func dispositionFilename(res *http.Response) string {
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// suggestedFilename returns the filename the server suggests for the video
+// at videourl, requesting just its headers, or "" if it doesn't suggest one.
+func suggestedFilename(ctx context.Context, videourl string, cfg Config) string {
+	if err := cfg.setDefaults(); err != nil {
+		return ""
+	}
+	res, err := requestHead(ctx, videourl, cfg)
+	if err != nil || res == nil {
+		return ""
+	}
+	return dispositionFilename(res)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDispositionFilename(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{`attachment; filename="movie.mkv"`, "movie.mkv"},
+		{`attachment; filename*=UTF-8''caf%C3%A9.mkv`, "caf\u00e9.mkv"},
+		{`inline`, ""},
+		{``, ""},
+	}
+	for _, test := range tests {
+		res := &http.Response{Header: http.Header{"Content-Disposition": {test.header}}}
+		if got := dispositionFilename(res); got != test.want {
+			t.Errorf("dispositionFilename(%q) = %q, wanted %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestSuggestedFilename(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="My Video.mkv"`)
+	}))
+	defer ts.Close()
+
+	if name := suggestedFilename(context.Background(), ts.URL, Config{}); name != "My Video.mkv" {
+		t.Fatalf("expected the filename from Content-Disposition, got %q", name)
+	}
+}
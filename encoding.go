@@ -0,0 +1,68 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodedLengthHeader is the header some servers and CDNs use to report the
+// size of a compressed resource once decoded, since Content-Length is the
+// size of the compressed body.
+const decodedLengthHeader = "X-Decompressed-Content-Length"
+
+// contentEncoding returns the Content-Encoding of res if it can be decoded,
+// or "" if the body is not encoded or the encoding is unknown, in which case
+// the body is passed through unchanged.
+func contentEncoding(res *http.Response) string {
+	switch enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))); enc {
+	case "gzip", "x-gzip", "deflate", "br":
+		return enc
+	}
+	return ""
+}
+
+// decodedLength returns the length of the body of res once decoded, or -1 if
+// it is unknown.
+func decodedLength(res *http.Response) int64 {
+	if !res.Uncompressed && contentEncoding(res) == "" {
+		return res.ContentLength
+	}
+	n, err := strconv.ParseInt(res.Header.Get(decodedLengthHeader), 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// decodingReader decompresses a body with the given Content-Encoding. The
+// decompressor is created by the first Read, since creating it reads the
+// stream header.
+type decodingReader struct {
+	r        io.Reader
+	encoding string
+	dec      io.Reader
+}
+
+func (dr *decodingReader) Read(p []byte) (int, error) {
+	if dr.dec == nil {
+		var err error
+		switch dr.encoding {
+		case "deflate":
+			dr.dec, err = zlib.NewReader(dr.r)
+		case "br":
+			dr.dec = brotli.NewReader(dr.r)
+		default:
+			dr.dec, err = gzip.NewReader(dr.r)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return dr.dec.Read(p)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestVideoStreamContentEncoding(t *testing.T) {
+	data := testData[:5000000]
+	var gz, zl, br bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(data)
+	zw.Close()
+	bw := brotli.NewWriterLevel(&br, brotli.BestSpeed)
+	bw.Write(data)
+	bw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		// transport is true if the http.Transport may decode the body.
+		transport bool
+	}{
+		{"gzip", gz.Bytes(), false},
+		{"gzip", gz.Bytes(), true},
+		{"deflate", zl.Bytes(), false},
+		{"br", br.Bytes(), false},
+		{"compress", data, false},
+	}
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", test.encoding)
+			w.Header().Set(decodedLengthHeader, strconv.Itoa(len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(test.body)))
+			w.Write(test.body)
+		}))
+
+		client := &http.Client{Transport: &http.Transport{DisableCompression: !test.transport}}
+		var buf bytes.Buffer
+		vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{Client: client})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vs.Stream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+		ts.Close()
+
+		want := data
+		if test.encoding == "compress" {
+			// unknown encodings are passed through unchanged.
+			want = test.body
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("%v (transport %v): decoded body did not match", test.encoding, test.transport)
+		}
+		if vs.size != uint64(len(data)) {
+			t.Fatalf("%v (transport %v): expected size %v, got %v", test.encoding, test.transport, len(data), vs.size)
+		}
+	}
+}
+
+func TestDecodedLength(t *testing.T) {
+	res := &http.Response{Header: http.Header{}, ContentLength: 100}
+	if n := decodedLength(res); n != 100 {
+		t.Fatalf("expected 100 for an unencoded body, got %v", n)
+	}
+	res.Header.Set("Content-Encoding", "gzip")
+	if n := decodedLength(res); n != -1 {
+		t.Fatalf("expected -1 without %v, got %v", decodedLengthHeader, n)
+	}
+	res.Header.Set(decodedLengthHeader, "250")
+	if n := decodedLength(res); n != 250 {
+		t.Fatalf("expected 250, got %v", n)
+	}
+}
+
+func TestVideoStreamUnderReportedSize(t *testing.T) {
+	data := testData[:5000000]
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set(decodedLengthHeader, strconv.Itoa(len(data)/2))
+		w.Write(gz.Bytes())
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{Client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data written to the writer did not match")
+	}
+	if vs.total() != uint64(len(data)) {
+		t.Fatalf("expected the size to grow to %v, got %v", len(data), vs.total())
+	}
+}
+
+func TestVideoStreamUnderReportedContentLength(t *testing.T) {
+	data := testData[:5000000]
+	var ranges int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranges, 1)
+			http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		// net/http won't read past the Content-Length, so the rest of the
+		// video must be requested by range.
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)/2))
+		w.Write(data[:len(data)/2])
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("expected %v bytes to be written, got %v", len(data), buf.Len())
+	}
+	if vs.total() != uint64(len(data)) {
+		t.Fatalf("expected the size to grow to %v, got %v", len(data), vs.total())
+	}
+	// the response to the request for the rest states the size, so it isn't
+	// probed past.
+	if n := atomic.LoadInt32(&ranges); n != 1 {
+		t.Fatalf("expected a request for the rest of the video, got %v", n)
+	}
+}
+
+func TestVideoStreamNoProbe(t *testing.T) {
+	data := testData[:5000000]
+	var ranges int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranges, 1)
+		}
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	// a POST isn't repeated past the end of the video.
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{Method: http.MethodPost})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&ranges); n != 0 {
+		t.Fatalf("expected no request past the end of the video, got %v", n)
+	}
+
+	// nor is a resumed download, whose Content-Range states the size.
+	defer os.Remove(testFilename)
+	if err := ioutil.WriteFile(testFilename, data[:len(data)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	removeState(testFilename)
+	if n := atomic.LoadInt32(&ranges); n != 1 {
+		t.Fatalf("expected only the request resuming the video, got %v", n)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Estimate describes how long a video would take to buffer.
+type Estimate struct {
+	// Size is the size of the video in bytes.
+	Size uint64
+	// Duration is the duration of the video, either detected from the
+	// video or as configured.
+	Duration time.Duration
+	// Bandwidth is the sampled bandwidth, in bytes per second.
+	Bandwidth float64
+	// BufferTime is how long the video would need to buffer before it could
+	// be safely played. It is zero or negative if the video could be played
+	// immediately.
+	BufferTime time.Duration
+}
+
+// EstimateBufferTime estimates how long the video at url would take to
+// buffer, without downloading it. Only the start of the video is requested,
+// to sample the bandwidth as Stream would, after the warmup and over
+// ProbeRounds probes, and to detect the duration.
+func EstimateBufferTime(ctx context.Context, url string, duration time.Duration, cfg Config) (*Estimate, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	url, err := localURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	// As with ProbeBandwidth, the length of the warmup is unknown if only
+	// its time is limited, in which case as much of the video as needed is
+	// requested.
+	var end int64
+	if cfg.WarmupBytes > 0 || cfg.WarmupTime <= 0 {
+		end = cfg.WarmupBytes + cfg.SampleBytes
+	}
+	req, err := newRequest(ctx, url, cfg, 0, end)
+	if err != nil {
+		return nil, err
+	}
+	res, err := do(req, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	size := res.ContentLength
+	if res.StatusCode == http.StatusPartialContent {
+		_, size, err = parseContentRange(res.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size == -1 {
+		return nil, fmt.Errorf("the server did not report the size of the video")
+	}
+
+	header := &headerBuffer{max: headerSize}
+	s, _, err := cfg.sample(io.TeeReader(contextReader{ctx, res.Body}, header), size)
+	if err != nil {
+		return nil, err
+	}
+
+	if d, ok := parseDuration(header.buf); ok {
+		duration = d
+	}
+	duration = cfg.playbackDuration(uint64(size), duration)
+	bw := cfg.limitBandwidth(s.Bps)
+	return &Estimate{
+		Size:       uint64(size),
+		Duration:   duration,
+		Bandwidth:  bw,
+		BufferTime: cfg.addStartupMargin(cfg.bufferTime(uint64(size), 0, []float64{bw}, duration)),
+	}, nil
+}
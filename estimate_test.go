@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEstimateBufferTime(t *testing.T) {
+	os.Remove(testFilename)
+
+	var served int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingResponseWriter{ResponseWriter: w, n: &served}
+		http.ServeContent(cw, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	const sample = 1000000
+	est, err := EstimateBufferTime(context.Background(), ts.URL, time.Second, Config{SampleBytes: sample})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Size != testSz {
+		t.Fatalf("estimated size %v, wanted %v", est.Size, testSz)
+	}
+	if est.Bandwidth <= 0 {
+		t.Fatalf("estimated non-positive bandwidth %v", est.Bandwidth)
+	}
+	if n := atomic.LoadInt64(&served); n > sample {
+		t.Fatalf("estimate downloaded %v bytes, wanted at most %v", n, sample)
+	}
+	if _, err := os.Stat(testFilename); !os.IsNotExist(err) {
+		t.Fatal("estimate created an output file")
+	}
+}
+
+func TestEstimateBufferTimeProbeRounds(t *testing.T) {
+	// after the warmup, the server sends the sample in five chunks, one of
+	// which stalls.
+	const warmup, chunk = 100000, 100000
+	delays := []time.Duration{50 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond, 2 * time.Second, 0}
+	var served int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", warmup+chunk*len(delays)-1, testSz))
+		w.Header().Set("Content-Length", strconv.Itoa(warmup+chunk*len(delays)))
+		w.WriteHeader(http.StatusPartialContent)
+		cw := &countingResponseWriter{ResponseWriter: w, n: &served}
+		cw.Write(testData[:warmup])
+		w.(http.Flusher).Flush()
+		for i, d := range delays {
+			time.Sleep(d)
+			cw.Write(testData[warmup+i*chunk : warmup+(i+1)*chunk])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	cfg := Config{SampleBytes: chunk * int64(len(delays)), WarmupBytes: warmup, ProbeRounds: len(delays)}
+	est, err := EstimateBufferTime(context.Background(), ts.URL, time.Second, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stall and the burst are discarded, leaving about 2MB/s, where the
+	// whole sample would measure under 250KB/s.
+	if est.Bandwidth < 1000000 {
+		t.Fatalf("expected the stall to be discarded from the estimated bandwidth, got %v", est.Bandwidth)
+	}
+	if n := atomic.LoadInt64(&served); n != warmup+chunk*int64(len(delays)) {
+		t.Fatalf("expected the warmup and sample to be downloaded, got %v bytes", n)
+	}
+}
+
+// countingResponseWriter counts the bytes written to a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (cw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
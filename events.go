@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// event is a newline delimited JSON event written to stdout by the -json
+// flag, and to clients of the -progress-socket.
+type event struct {
+	Phase      string  `json:"phase"`
+	Downloaded uint64  `json:"downloaded"`
+	Total      uint64  `json:"total"`
+	Bandwidth  float64 `json:"bandwidth"`
+	// ETA is the number of seconds until the download completes, omitted
+	// if it cannot be estimated.
+	ETA *float64 `json:"eta,omitempty"`
+
+	// the remaining fields are only set by the final event.
+	BufferTime float64 `json:"buffer_time,omitempty"`
+	SHA256     string  `json:"sha256,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// estimateEvent is the JSON encoding of an Estimate.
+type estimateEvent struct {
+	Size       uint64  `json:"size"`
+	Duration   float64 `json:"duration"`
+	Bandwidth  float64 `json:"bandwidth"`
+	BufferTime float64 `json:"buffer_time"`
+}
+
+// eventWriter writes JSON events to an io.Writer. Errors writing events are
+// ignored, so that a closed stdout doesn't abort the download.
+type eventWriter struct {
+	enc *json.Encoder
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{enc: json.NewEncoder(w)}
+}
+
+// progress writes a progress event. The final progress update is left to
+// done.
+func (ew *eventWriter) progress(phase Phase, downloaded, total uint64, bandwidth float64) {
+	if phase == PhaseDone {
+		return
+	}
+	ev := event{
+		Phase:      phase.String(),
+		Downloaded: downloaded,
+		Total:      total,
+		Bandwidth:  bandwidth,
+	}
+	if total >= downloaded && bandwidth > 0 {
+		eta := float64(total-downloaded) / bandwidth
+		ev.ETA = &eta
+	}
+	ew.enc.Encode(ev)
+}
+
+// done writes the final event, describing the result of streaming vs. The
+// final event is written even if streaming failed, with the error set.
+func (ew *eventWriter) done(vs *VideoStream, res *StreamResult, err error) {
+	downloaded, bandwidth := vs.progress()
+	ev := event{
+		Phase:      PhaseDone.String(),
+		Downloaded: downloaded,
+		Total:      vs.total(),
+		Bandwidth:  bandwidth,
+		BufferTime: res.BufferTime.Seconds(),
+		SHA256:     res.SHA256,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	ew.enc.Encode(ev)
+}
+
+// estimate writes est as a single event.
+func (ew *eventWriter) estimate(est *Estimate) error {
+	return ew.enc.Encode(estimateEvent{
+		Size:       est.Size,
+		Duration:   est.Duration.Seconds(),
+		Bandwidth:  est.Bandwidth,
+		BufferTime: est.BufferTime.Seconds(),
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	ew := newEventWriter(&buf)
+
+	ew.progress(PhaseSampling, 0, 1000, 0)
+	ew.progress(PhaseBuffering, 500, 1000, 100)
+	ew.progress(PhaseDone, 1000, 1000, 100)
+	vs := &VideoStream{size: 1000}
+	ew.done(vs, &StreamResult{}, errors.New("oops"))
+
+	var events []event
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var ev event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, ev)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(events))
+	}
+	if events[0].Phase != "sampling" || events[0].ETA != nil {
+		t.Fatalf("unexpected sampling event %+v", events[0])
+	}
+	if events[1].Phase != "buffering" || events[1].ETA == nil || *events[1].ETA != 5 {
+		t.Fatalf("unexpected buffering event %+v", events[1])
+	}
+	if events[2].Phase != "done" || events[2].Error != "oops" {
+		t.Fatalf("unexpected done event %+v", events[2])
+	}
+}
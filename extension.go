@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnexpectedExtension is returned when the output path doesn't end with
+// one of Config.ExpectedExtensions and Config.StrictExtensions is set.
+var ErrUnexpectedExtension = errors.New("unexpected output file extension")
+
+// containerExtensions maps the Content-Types of common video containers to
+// the extension players expect them to have.
+var containerExtensions = map[string]string{
+	"video/mp4":        ".mp4",
+	"video/x-matroska": ".mkv",
+	"video/webm":       ".webm",
+	"video/quicktime":  ".mov",
+	"video/x-msvideo":  ".avi",
+	"video/mp2t":       ".ts",
+	"video/x-flv":      ".flv",
+}
+
+// extensionFor returns the extension of the video container described by
+// contentType, or the empty string if it isn't a known container.
+func extensionFor(contentType string) string {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return containerExtensions[strings.ToLower(mediatype)]
+}
+
+// checkExtension checks that path ends with one of the ExpectedExtensions,
+// warning if it doesn't, or returning ErrUnexpectedExtension with
+// StrictExtensions. The extension of the video's contentType, if known, is
+// suggested instead.
+func (cfg *Config) checkExtension(path, contentType string) error {
+	if len(cfg.ExpectedExtensions) == 0 {
+		return nil
+	}
+	ext := filepath.Ext(path)
+	for _, want := range cfg.ExpectedExtensions {
+		if strings.EqualFold(ext, "."+strings.TrimPrefix(want, ".")) {
+			return nil
+		}
+	}
+
+	msg := fmt.Sprintf("%v does not end with one of %v", path, strings.Join(cfg.ExpectedExtensions, ", "))
+	if suggested := extensionFor(contentType); suggested != "" {
+		msg += fmt.Sprintf("; the server sent a %v video, try %v", suggested, strings.TrimSuffix(path, ext)+suggested)
+	}
+	if cfg.StrictExtensions {
+		return fmt.Errorf("%w: %v", ErrUnexpectedExtension, msg)
+	}
+	if cfg.Logger != nil {
+		fmt.Fprintf(cfg.Logger, "Warning: %v\n", msg)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExtensionFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"video/mp4", ".mp4"},
+		{"Video/X-Matroska; charset=binary", ".mkv"},
+		{"application/octet-stream", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := extensionFor(test.contentType); got != test.want {
+			t.Errorf("extensionFor(%q) = %q, wanted %q", test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestCheckExtension(t *testing.T) {
+	tests := []struct {
+		path        string
+		contentType string
+		strict      bool
+		wantErr     bool
+		wantWarning string
+	}{
+		{"video.mkv", "video/mp4", false, false, ""},
+		{"video.MP4", "video/mp4", true, false, ""},
+		{"video.mvk", "video/x-matroska", false, false, "try video.mkv"},
+		{"video", "application/octet-stream", false, false, "video does not end with"},
+		{"video.mvk", "video/x-matroska", true, true, ""},
+	}
+	for _, test := range tests {
+		var log bytes.Buffer
+		cfg := Config{
+			ExpectedExtensions: []string{".mkv", "mp4"},
+			StrictExtensions:   test.strict,
+			Logger:             &log,
+		}
+		err := cfg.checkExtension(test.path, test.contentType)
+		if test.wantErr != errors.Is(err, ErrUnexpectedExtension) {
+			t.Fatalf("%v: expected error %v, got %v", test.path, test.wantErr, err)
+		}
+		if test.wantWarning == "" && log.Len() > 0 {
+			t.Fatalf("%v: unexpected warning %q", test.path, log.String())
+		}
+		if !strings.Contains(log.String(), test.wantWarning) {
+			t.Fatalf("%v: expected a warning containing %q, got %q", test.path, test.wantWarning, log.String())
+		}
+	}
+
+	// without ExpectedExtensions, any path is accepted.
+	cfg := Config{StrictExtensions: true}
+	if err := cfg.checkExtension("video", "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+)
+
+// isFIFO reports whether the file at path is a named pipe, such as one a
+// player reads the video from as it arrives.
+func isFIFO(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode()&os.ModeNamedPipe != 0
+}
+
+// openFIFO opens the named pipe at path for writing, which waits until a
+// reader has opened it, or until ctx is done.
+func openFIFO(ctx context.Context, path string) (*os.File, error) {
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		opened <- result{f, err}
+	}()
+	select {
+	case r := <-opened:
+		return r.f, r.err
+	case <-ctx.Done():
+		// Opening the pipe for reading ourselves unblocks the pending open,
+		// so that the goroutine doesn't leak.
+		if rf, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+			defer rf.Close()
+		}
+		if r := <-opened; r.f != nil {
+			r.f.Close()
+		}
+		return nil, ctx.Err()
+	}
+}
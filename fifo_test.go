@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mkfifo creates a named pipe in a temporary directory, skipping the test
+// where that isn't possible.
+func mkfifo(t *testing.T) string {
+	if _, err := exec.LookPath("mkfifo"); err != nil {
+		t.Skip("mkfifo is not available")
+	}
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, testFilename)
+	if out, err := exec.Command("mkfifo", path).CombinedOutput(); err != nil {
+		t.Fatalf("mkfifo: %v: %s", err, out)
+	}
+	return path
+}
+
+func TestVideoStreamFIFO(t *testing.T) {
+	path := mkfifo(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	// the player reads the video as it arrives.
+	played := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadFile(path)
+		played <- data
+	}()
+
+	cfg := Config{Resume: true, Preallocate: true, Connections: 4}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Reader(); err != errReaderUnsupported {
+		t.Fatalf("expected %v, got %v", errReaderUnsupported, err)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+
+	if !bytes.Equal(<-played, testData) {
+		t.Fatal("the data read from the pipe did not match the video")
+	}
+	if !isFIFO(path) {
+		t.Fatal("expected the pipe to be left in place")
+	}
+	if _, err := os.Stat(path + stateSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected no state to be recorded for a pipe, got %v", err)
+	}
+}
+
+func TestOpenFIFOCancel(t *testing.T) {
+	path := mkfifo(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := openFIFO(ctx, path); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v without a reader, got %v", context.DeadlineExceeded, err)
+	}
+}
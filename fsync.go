@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// syncer syncs a file to disk once Config.SyncBytes have been written to it,
+// or Config.SyncInterval has passed, since it was last synced. It is safe
+// for concurrent use.
+type syncer struct {
+	bytes    int64
+	interval time.Duration
+	sync     func() error
+
+	mu       sync.Mutex
+	unsynced int64
+	last     time.Time
+}
+
+// newSyncer returns a syncer for f configured by cfg, or nil if cfg doesn't
+// ask for the file to be synced.
+func newSyncer(f *os.File, cfg Config) *syncer {
+	if cfg.SyncBytes <= 0 && cfg.SyncInterval <= 0 {
+		return nil
+	}
+	return &syncer{
+		bytes:    cfg.SyncBytes,
+		interval: cfg.SyncInterval,
+		sync:     f.Sync,
+		last:     time.Now(),
+	}
+}
+
+// wrote records that n bytes were written to the file, syncing it if due.
+func (s *syncer) wrote(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsynced += int64(n)
+	if (s.bytes <= 0 || s.unsynced < s.bytes) && (s.interval <= 0 || time.Since(s.last) < s.interval) {
+		return nil
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	s.unsynced = 0
+	s.last = time.Now()
+	return nil
+}
+
+// writer returns a writer to w, which writes to the file, that syncs the
+// file as it is written. A nil syncer returns w unchanged.
+func (s *syncer) writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &syncWriter{w: w, s: s}
+}
+
+// syncWriter is returned by syncer.writer.
+type syncWriter struct {
+	w io.Writer
+	s *syncer
+}
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, sw.s.wrote(n)
+}
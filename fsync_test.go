@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSyncer(t *testing.T) {
+	var syncs int
+	s := &syncer{bytes: 16, sync: func() error { syncs++; return nil }, last: time.Now()}
+	var buf bytes.Buffer
+	w := s.writer(&buf)
+	for i := 0; i < 10; i++ {
+		if _, err := w.Write(make([]byte, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 50 bytes cross the threshold of 16 after the 4th, 8th writes.
+	if syncs != 2 {
+		t.Fatalf("expected 2 syncs, got %v", syncs)
+	}
+
+	syncs = 0
+	s = &syncer{interval: time.Hour, sync: func() error { syncs++; return nil }, last: time.Now().Add(-2 * time.Hour)}
+	w = s.writer(&buf)
+	w.Write([]byte{0})
+	w.Write([]byte{0})
+	if syncs != 1 {
+		t.Fatalf("expected 1 sync once the interval passed, got %v", syncs)
+	}
+
+	if (*syncer)(nil).writer(&buf) != io.Writer(&buf) {
+		t.Fatal("expected a nil syncer to leave the writer unchanged")
+	}
+	if newSyncer(nil, Config{}) != nil {
+		t.Fatal("expected no syncer without SyncBytes or SyncInterval")
+	}
+}
+
+func TestVideoStreamSync(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	for _, connections := range []int{1, 4} {
+		cfg := Config{SyncBytes: 16 << 20, Connections: connections}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vs.Stream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+
+		data, err := ioutil.ReadFile(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Fatalf("%v connections: streamed file did not match the video", connections)
+		}
+		if err := os.Remove(testFilename); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hlsContentTypes are the Content-Types of HLS playlists.
+var hlsContentTypes = map[string]bool{
+	"application/vnd.apple.mpegurl": true,
+	"application/x-mpegurl":         true,
+	"audio/mpegurl":                 true,
+	"audio/x-mpegurl":               true,
+}
+
+// hlsHeadConcurrency is the number of HEAD requests made at once to learn the
+// sizes of the segments of an HLS playlist.
+const hlsHeadConcurrency = 8
+
+// errEncryptedPlaylist is returned for HLS playlists whose segments are
+// encrypted.
+var errEncryptedPlaylist = errors.New("encrypted HLS playlists are not supported")
+
+// isPlaylist reports whether res, the response to a request for rawurl, is an
+// HLS playlist, judging by its Content-Type or the extension of its URL.
+func isPlaylist(rawurl string, res *http.Response) bool {
+	if mediatype, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil && hlsContentTypes[strings.ToLower(mediatype)] {
+		return true
+	}
+	if res.Request != nil && res.Request.URL != nil {
+		rawurl = res.Request.URL.String()
+	}
+	u, err := url.Parse(rawurl)
+	return err == nil && strings.HasSuffix(strings.ToLower(u.Path), ".m3u8")
+}
+
+// hlsSegment is a segment of an HLS playlist.
+type hlsSegment struct {
+	url string
+	// ranged is set if the segment is the range of the resource at url
+	// starting at start, rather than the whole resource.
+	ranged bool
+	start  int64
+	// length is the size of the segment in bytes, or -1 if unknown.
+	length   int64
+	duration time.Duration
+}
+
+// hlsVariant is a variant stream listed by a master playlist.
+type hlsVariant struct {
+	url       string
+	bandwidth int64
+}
+
+// playlist is a parsed HLS playlist. A master playlist lists the variants of
+// a video, and a media playlist the segments of one of them.
+type playlist struct {
+	variants []hlsVariant
+	segments []hlsSegment
+}
+
+// parsePlaylist parses the HLS playlist read from r, resolving the URLs it
+// lists against base.
+func parsePlaylist(r io.Reader, base *url.URL) (*playlist, error) {
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "#EXTM3U" {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("not an HLS playlist")
+	}
+
+	var pl playlist
+	var (
+		duration  time.Duration
+		bandwidth int64
+		variant   bool
+		ranged    bool
+		start     int64
+		length    int64
+		next      int64
+		mapURL    string
+	)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(v, ","); i >= 0 {
+				v = v[:i]
+			}
+			secs, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid segment duration %q: %v", line, err)
+			}
+			duration = time.Duration(secs * float64(time.Second))
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			variant = true
+			bandwidth, _ = strconv.ParseInt(attribute(line, "BANDWIDTH"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			// the range is of the form "length[@start]", continuing from
+			// the previous segment if start is omitted.
+			v := strings.TrimPrefix(line, "#EXT-X-BYTERANGE:")
+			start = next
+			if i := strings.Index(v, "@"); i >= 0 {
+				var err error
+				if start, err = strconv.ParseInt(v[i+1:], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid byte range %q: %v", line, err)
+				}
+				v = v[:i]
+			}
+			var err error
+			if length, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid byte range %q: %v", line, err)
+			}
+			ranged = true
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			if method := attribute(line, "METHOD"); method != "" && method != "NONE" {
+				return nil, errEncryptedPlaylist
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			// fragmented MP4 segments are preceded by the initialization
+			// section they share.
+			u, err := resolvePlaylistURL(base, attribute(line, "URI"))
+			if err != nil {
+				return nil, err
+			}
+			if u.String() != mapURL {
+				mapURL = u.String()
+				pl.segments = append(pl.segments, hlsSegment{url: mapURL, length: -1})
+			}
+		case strings.HasPrefix(line, "#"):
+			// other tags and comments don't affect the concatenated
+			// video.
+		default:
+			u, err := resolvePlaylistURL(base, line)
+			if err != nil {
+				return nil, err
+			}
+			if variant {
+				pl.variants = append(pl.variants, hlsVariant{url: u.String(), bandwidth: bandwidth})
+				variant = false
+				continue
+			}
+			seg := hlsSegment{url: u.String(), length: -1, duration: duration}
+			if ranged {
+				seg.ranged, seg.start, seg.length = true, start, length
+				next = start + length
+			}
+			pl.segments = append(pl.segments, seg)
+			duration, ranged = 0, false
+		}
+	}
+	return &pl, sc.Err()
+}
+
+// resolvePlaylistURL resolves ref, a URL listed in the playlist at base. Only
+// http and https URLs, or URLs of the playlist's own scheme, may be listed,
+// so that a remote playlist can't have a local file read by listing it.
+func resolvePlaylistURL(base *url.URL, ref string) (*url.URL, error) {
+	u, err := base.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if !isHTTP(u.Scheme) && !strings.EqualFold(u.Scheme, base.Scheme) {
+		return nil, fmt.Errorf("%w: %v URL %v listed in a %v playlist", ErrUnsupportedScheme, u.Scheme, u, base.Scheme)
+	}
+	return u, nil
+}
+
+// sensitiveHeaders are the headers not sent to hosts other than the one the
+// video was requested from, as http.Client drops them from redirects to
+// another domain.
+var sensitiveHeaders = []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2"}
+
+// listedConfig returns cfg for requesting rawurl, listed by a playlist of the
+// video requested from origin. URLs on other hosts must be in AllowedHosts,
+// failing with ErrRedirectNotAllowed otherwise, and aren't sent the
+// credentials, sensitive headers and cookies meant for origin, so that a
+// playlist can't collect them.
+func listedConfig(cfg Config, origin, rawurl string) (Config, error) {
+	o, err := url.Parse(origin)
+	if err != nil {
+		return cfg, err
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return cfg, err
+	}
+	if strings.EqualFold(u.Host, o.Host) {
+		return cfg, nil
+	}
+	if !cfg.hostAllowed(u) {
+		return cfg, fmt.Errorf("%w: %v listed by the HLS playlist", ErrRedirectNotAllowed, u.Host)
+	}
+	cfg.Username, cfg.Password = "", ""
+	cfg.Cookies = nil
+	headers := make(map[string]string, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		headers[k] = v
+	}
+	for k := range headers {
+		for _, h := range sensitiveHeaders {
+			if strings.EqualFold(k, h) {
+				delete(headers, k)
+			}
+		}
+	}
+	cfg.Headers = headers
+	return cfg, nil
+}
+
+// attribute returns the unquoted value of the named attribute of an HLS tag,
+// such as the BANDWIDTH of #EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="...",
+// or the empty string if the tag doesn't have it.
+func attribute(tag, name string) string {
+	list := tag[strings.Index(tag, ":")+1:]
+	for list != "" {
+		// attributes are separated by commas outside of quoted strings.
+		quoted := false
+		i := 0
+		for ; i < len(list); i++ {
+			if list[i] == '"' {
+				quoted = !quoted
+			} else if list[i] == ',' && !quoted {
+				break
+			}
+		}
+		attr := list[:i]
+		list = strings.TrimPrefix(list[i:], ",")
+		if j := strings.Index(attr, "="); j >= 0 && strings.TrimSpace(attr[:j]) == name {
+			return strings.Trim(strings.TrimSpace(attr[j+1:]), `"`)
+		}
+	}
+	return ""
+}
+
+// hlsResponse reads the HLS playlist from res, the response to a request for
+// rawurl, returning a response whose body is the concatenation of the
+// playlist's segments, with their total size as its ContentLength if known,
+// and the total duration of the segments. The highest bandwidth variant of a
+// master playlist is streamed. Only the segments listed when the playlist is
+// requested are streamed, so a live stream ends where the playlist does.
+func hlsResponse(ctx context.Context, rawurl string, res *http.Response, cfg Config) (*http.Response, time.Duration, error) {
+	// A resumed request may only have returned the end of the playlist.
+	if res.StatusCode == http.StatusPartialContent {
+		res.Body.Close()
+		var err error
+		if res, err = request(ctx, rawurl, cfg, 0); err != nil {
+			return nil, 0, err
+		}
+	}
+	pl, err := readPlaylist(rawurl, res)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Variants and segments are fetched with plain GETs, whatever the
+	// playlist needed.
+	cfg.Method = http.MethodGet
+	cfg.Body = nil
+
+	if len(pl.variants) > 0 {
+		best := pl.variants[0]
+		for _, v := range pl.variants[1:] {
+			if v.bandwidth > best.bandwidth {
+				best = v
+			}
+		}
+		vcfg, err := listedConfig(cfg, rawurl, best.url)
+		if err != nil {
+			return nil, 0, err
+		}
+		res, err := request(ctx, best.url, vcfg, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		if pl, err = readPlaylist(best.url, res); err != nil {
+			return nil, 0, err
+		}
+		if len(pl.variants) > 0 {
+			return nil, 0, fmt.Errorf("the variant %v of the HLS playlist is itself a master playlist", best.url)
+		}
+	}
+	if len(pl.segments) == 0 {
+		return nil, 0, errors.New("the HLS playlist has no segments")
+	}
+	for _, seg := range pl.segments {
+		if _, err := listedConfig(cfg, rawurl, seg.url); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	size, err := segmentSizes(ctx, rawurl, pl.segments, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	var duration time.Duration
+	for _, seg := range pl.segments {
+		duration += seg.duration
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		ContentLength: size,
+		Body:          &hlsReader{ctx: ctx, cfg: cfg, origin: rawurl, segments: pl.segments},
+		Request:       res.Request,
+	}, duration, nil
+}
+
+// readPlaylist parses the HLS playlist in the body of res, the response to a
+// request for rawurl, and closes it. URLs in the playlist are relative to the
+// playlist's URL after any redirects.
+func readPlaylist(rawurl string, res *http.Response) (*playlist, error) {
+	defer res.Body.Close()
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if res.Request != nil && res.Request.URL != nil {
+		base = res.Request.URL
+	}
+	return parsePlaylist(res.Body, base)
+}
+
+// segmentSizes fills in the lengths of segments that aren't byte ranges with
+// the sizes reported by HEAD requests, returning their total size, or -1 if
+// the size of any segment is unknown. origin is the url the video was
+// requested from.
+func segmentSizes(ctx context.Context, origin string, segments []hlsSegment, cfg Config) (int64, error) {
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	sem := make(chan struct{}, hlsHeadConcurrency)
+	for i := range segments {
+		if segments[i].ranged {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(seg *hlsSegment) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// The segments were checked by listedConfig already.
+			cfg, _ := listedConfig(cfg, origin, seg.url)
+			head, err := requestHead(ctx, seg.url, cfg)
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			if head != nil {
+				seg.length = head.ContentLength
+			}
+		}(&segments[i])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	var size int64
+	for _, seg := range segments {
+		if seg.length < 0 {
+			return -1, nil
+		}
+		size += seg.length
+	}
+	return size, nil
+}
+
+// hlsReader reads the concatenated segments of an HLS playlist, requesting
+// each in turn.
+type hlsReader struct {
+	ctx context.Context
+	cfg Config
+	// origin is the url the video was requested from, to which the
+	// segments' hosts are compared.
+	origin   string
+	segments []hlsSegment
+	// i is the index of the current segment, and off the offset within it.
+	i   int
+	off int64
+
+	mu     sync.Mutex
+	body   io.ReadCloser
+	closed bool
+}
+
+func (hr *hlsReader) Read(p []byte) (int, error) {
+	for hr.i < len(hr.segments) {
+		body, err := hr.current()
+		if err != nil {
+			return 0, err
+		}
+		n, err := body.Read(p)
+		hr.off += int64(n)
+		if err == io.EOF {
+			if seg := hr.segments[hr.i]; seg.length >= 0 && hr.off < seg.length {
+				err = io.ErrUnexpectedEOF
+			} else {
+				hr.mu.Lock()
+				body.Close()
+				hr.body = nil
+				hr.mu.Unlock()
+				hr.i++
+				hr.off = 0
+				err = nil
+			}
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// current returns the response body of the current segment, requesting it
+// if it hasn't been already.
+func (hr *hlsReader) current() (io.ReadCloser, error) {
+	hr.mu.Lock()
+	body := hr.body
+	hr.mu.Unlock()
+	if body != nil {
+		return body, nil
+	}
+
+	body, err := hr.open()
+	if err != nil {
+		return nil, err
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if hr.closed {
+		body.Close()
+		return nil, errClosed
+	}
+	hr.body = body
+	return body, nil
+}
+
+// open requests the rest of the current segment.
+func (hr *hlsReader) open() (io.ReadCloser, error) {
+	seg := hr.segments[hr.i]
+	start, end := seg.start+hr.off, int64(0)
+	if seg.ranged {
+		end = seg.start + seg.length
+	}
+	cfg, err := listedConfig(hr.cfg, hr.origin, seg.url)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newRequest(hr.ctx, seg.url, cfg, start, end)
+	if err != nil {
+		return nil, err
+	}
+	res, err := do(req, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if (start > 0 || end > 0) && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("server did not return bytes %v-%v of HLS segment %v", start, end, seg.url)
+	}
+	return res.Body, nil
+}
+
+// seek returns an hlsReader of the concatenated segments starting at offset,
+// to resume the stream after a failure. The sizes of the segments before
+// offset must be known.
+func (hr *hlsReader) seek(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	r := &hlsReader{ctx: ctx, cfg: hr.cfg, origin: hr.origin, segments: hr.segments}
+	for ; r.i < len(r.segments) && offset > 0; r.i++ {
+		n := r.segments[r.i].length
+		if n < 0 {
+			return nil, errors.New("cannot resume an HLS stream whose segment sizes are unknown")
+		}
+		if offset < n {
+			break
+		}
+		offset -= n
+	}
+	r.off = offset
+	return r, nil
+}
+
+// Close closes the response body of the current segment. Subsequent reads
+// fail.
+func (hr *hlsReader) Close() error {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.closed = true
+	if hr.body == nil {
+		return nil
+	}
+	return hr.body.Close()
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	base, err := url.Parse("http://example.com/videos/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	master := `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=640x360
+low/index.m3u8
+#EXT-X-STREAM-INF:CODECS="avc1.640028,mp4a.40.2",BANDWIDTH=5000000
+https://cdn.example.com/high/index.m3u8
+`
+	pl, err := parsePlaylist(strings.NewReader(master), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantVariants := []hlsVariant{
+		{"http://example.com/videos/low/index.m3u8", 1280000},
+		{"https://cdn.example.com/high/index.m3u8", 5000000},
+	}
+	if !reflect.DeepEqual(pl.variants, wantVariants) || len(pl.segments) != 0 {
+		t.Fatalf("expected variants %v, got %v and segments %v", wantVariants, pl.variants, pl.segments)
+	}
+
+	media := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:9.5,
+seg0.m4s
+#EXTINF:10.0,title
+#EXT-X-BYTERANGE:1000@500
+all.m4s
+#EXTINF:2,
+#EXT-X-BYTERANGE:200
+all.m4s
+#EXT-X-ENDLIST
+`
+	pl, err = parsePlaylist(strings.NewReader(media), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSegments := []hlsSegment{
+		{url: "http://example.com/videos/init.mp4", length: -1},
+		{url: "http://example.com/videos/seg0.m4s", length: -1, duration: 9500 * time.Millisecond},
+		{url: "http://example.com/videos/all.m4s", ranged: true, start: 500, length: 1000, duration: 10 * time.Second},
+		{url: "http://example.com/videos/all.m4s", ranged: true, start: 1500, length: 200, duration: 2 * time.Second},
+	}
+	if !reflect.DeepEqual(pl.segments, wantSegments) {
+		t.Fatalf("expected segments %+v, got %+v", wantSegments, pl.segments)
+	}
+
+	encrypted := "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n#EXTINF:10,\nseg0.ts\n"
+	if _, err := parsePlaylist(strings.NewReader(encrypted), base); !errors.Is(err, errEncryptedPlaylist) {
+		t.Fatalf("expected %v, got %v", errEncryptedPlaylist, err)
+	}
+	if _, err := parsePlaylist(strings.NewReader("<html></html>"), base); err == nil {
+		t.Fatal("expected an error parsing a document that isn't a playlist")
+	}
+
+	// remote playlists may not list local files.
+	for _, local := range []string{
+		"#EXTM3U\n#EXTINF:1,\nfile:///etc/passwd\n",
+		"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100\nfile:///etc/passwd\n",
+		"#EXTM3U\n#EXT-X-MAP:URI=\"file:///etc/passwd\"\n#EXTINF:1,\nseg0.m4s\n",
+	} {
+		if _, err := parsePlaylist(strings.NewReader(local), base); !errors.Is(err, ErrUnsupportedScheme) {
+			t.Fatalf("%q: expected %v, got %v", local, ErrUnsupportedScheme, err)
+		}
+	}
+	fileBase, err := url.Parse("file:///videos/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl, err = parsePlaylist(strings.NewReader("#EXTM3U\n#EXTINF:1,\nseg0.ts\n#EXTINF:1,\nhttp://example.com/seg1.ts\n"), fileBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pl.segments) != 2 || pl.segments[0].url != "file:///videos/seg0.ts" {
+		t.Fatalf("expected a local playlist to list local and remote segments, got %+v", pl.segments)
+	}
+}
+
+func TestVideoStreamHLSLocalSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, testData[:1000], 0666); err != nil {
+		t.Fatal(err)
+	}
+	fileURL, err := localURL(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		fmt.Fprintf(w, "#EXTM3U\n#EXTINF:1,\n%v\n#EXT-X-ENDLIST\n", fileURL)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL+"/index.m3u8", 0, &buf, Config{})
+	if err == nil {
+		vs.Stream(context.Background())
+		vs.Close()
+	}
+	if !errors.Is(err, ErrUnsupportedScheme) {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedScheme, err)
+	}
+	if buf.Len() > 0 {
+		t.Fatal("expected nothing to be read from the local file")
+	}
+}
+
+func TestVideoStreamHLS(t *testing.T) {
+	os.Remove(testFilename)
+
+	const segments = 5
+	const segSz = testSz / 10
+	var media strings.Builder
+	media.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:10\n")
+	for i := 0; i < segments; i++ {
+		fmt.Fprintf(&media, "#EXTINF:10.0,\nseg%v.ts\n", i)
+	}
+	media.WriteString("#EXT-X-ENDLIST\n")
+
+	// the first request for the third segment fails halfway through.
+	var failed int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100\nlow.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=200\nhls/high.m3u8\n")
+		case "/hls/high.m3u8":
+			fmt.Fprint(w, media.String())
+		default:
+			var i int
+			if _, err := fmt.Sscanf(r.URL.Path, "/hls/seg%d.ts", &i); err != nil || i >= segments {
+				http.NotFound(w, r)
+				return
+			}
+			seg := testData[i*segSz : (i+1)*segSz]
+			if i == 2 && r.Method == http.MethodGet && atomic.AddInt32(&failed, 1) == 1 {
+				w.Header().Add("Content-Length", strconv.Itoa(segSz))
+				w.Write(seg[:segSz/2])
+				w.(http.Flusher).Flush()
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					panic(err)
+				}
+				conn.Close()
+				return
+			}
+			http.ServeContent(w, r, "seg.ts", time.Time{}, bytes.NewReader(seg))
+		}
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		SampleBytes:  1000000,
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL+"/master.m3u8", 0, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Duration != segments*10*time.Second {
+		t.Fatalf("expected the playlist's duration %v, got %v", segments*10*time.Second, res.Duration)
+	}
+	if res.Retries != 1 {
+		t.Fatalf("expected 1 retry, got %v", res.Retries)
+	}
+	if vs.total() != segments*segSz {
+		t.Fatalf("expected the size of the segments %v, got %v", segments*segSz, vs.total())
+	}
+	vs.Close()
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData[:segments*segSz]) {
+		t.Fatal("streamed file did not match the concatenated segments")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamHLSForeignSegment(t *testing.T) {
+	var leaked int32
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+			atomic.StoreInt32(&leaked, 1)
+		}
+		http.ServeContent(w, r, "seg.ts", time.Time{}, bytes.NewReader(testData[:1000]))
+	}))
+	defer cdn.Close()
+	var authorized int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" && r.Header.Get("Cookie") != "" {
+			atomic.StoreInt32(&authorized, 1)
+		}
+		switch r.URL.Path {
+		case "/index.m3u8":
+			fmt.Fprintf(w, "#EXTM3U\n#EXTINF:1,\nseg0.ts\n#EXTINF:1,\n%v/seg1.ts\n#EXT-X-ENDLIST\n", cdn.URL)
+		default:
+			http.ServeContent(w, r, "seg.ts", time.Time{}, bytes.NewReader(testData[:1000]))
+		}
+	}))
+	defer ts.Close()
+
+	cdnURL, err := url.Parse(cdn.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		allowed []string
+		err     error
+	}{
+		{nil, nil},
+		{[]string{cdnURL.Host}, nil},
+		{[]string{"example.com"}, ErrRedirectNotAllowed},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&leaked, 0)
+		cfg := Config{
+			Headers:      map[string]string{"Authorization": "Bearer token"},
+			Cookies:      []*http.Cookie{{Name: "session", Value: "secret"}},
+			AllowedHosts: test.allowed,
+		}
+		var buf bytes.Buffer
+		vs, err := NewVideoStreamWriter(context.Background(), ts.URL+"/index.m3u8", 0, &buf, cfg)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("allowed hosts %v: expected error %v, got %v", test.allowed, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		_, err = vs.Stream(context.Background())
+		vs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 2000 {
+			t.Fatalf("expected both segments to be streamed, got %v bytes", buf.Len())
+		}
+		if atomic.LoadInt32(&leaked) == 1 {
+			t.Fatalf("allowed hosts %v: credentials were sent to the host of a segment", test.allowed)
+		}
+	}
+	if atomic.LoadInt32(&authorized) == 0 {
+		t.Fatal("expected the credentials to be sent to the playlist's host")
+	}
+}
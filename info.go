@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// videoInfo describes a video, as reported by the server in response to a
+// HEAD request for it.
+type videoInfo struct {
+	// URL is the url of the video, after following any redirects.
+	URL string
+	// Size is the size of the video in bytes, or -1 if it isn't reported.
+	Size         int64
+	ContentType  string
+	Encoding     string
+	Ranges       bool
+	LastModified string
+	Validator    string
+	// Filename is the filename suggested by the server, if any.
+	Filename string
+}
+
+// requestInfo describes the video at url, requesting only its headers.
+func requestInfo(ctx context.Context, url string, cfg Config) (*videoInfo, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	url, err := localURL(url)
+	if err != nil {
+		return nil, err
+	}
+	head, err := requestHead(ctx, url, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return nil, errors.New("the server did not answer a HEAD request for the video")
+	}
+	info := &videoInfo{
+		URL:          url,
+		Size:         head.ContentLength,
+		ContentType:  head.Header.Get("Content-Type"),
+		Encoding:     contentEncoding(head),
+		Ranges:       head.Header.Get("Accept-Ranges") == "bytes",
+		LastModified: head.Header.Get("Last-Modified"),
+		Validator:    validator(head),
+		Filename:     dispositionFilename(head),
+	}
+	if head.Request != nil {
+		info.URL = head.Request.URL.String()
+	}
+	return info, nil
+}
+
+// print writes the description of the video to w, one property per line.
+func (vi *videoInfo) print(w io.Writer) {
+	fmt.Fprintf(w, "URL: %v\n", vi.URL)
+	if vi.Size == -1 {
+		fmt.Fprintln(w, "Size: unknown")
+	} else {
+		fmt.Fprintf(w, "Size: %v bytes\n", vi.Size)
+	}
+	if vi.ContentType != "" {
+		fmt.Fprintf(w, "Type: %v\n", vi.ContentType)
+	}
+	if vi.Encoding != "" {
+		fmt.Fprintf(w, "Encoding: %v\n", vi.Encoding)
+	}
+	if vi.Ranges {
+		fmt.Fprintln(w, "Range requests: supported")
+	} else {
+		fmt.Fprintln(w, "Range requests: not supported")
+	}
+	if vi.LastModified != "" {
+		fmt.Fprintf(w, "Last modified: %v\n", vi.LastModified)
+	}
+	if vi.Validator != "" {
+		fmt.Fprintf(w, "Validator: %v\n", vi.Validator)
+	}
+	if vi.Filename != "" {
+		fmt.Fprintf(w, "Filename: %v\n", vi.Filename)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// localTransport serves file:// URLs from the local filesystem, supporting
+// range requests like an HTTP server would.
+var localTransport = http.NewFileTransport(http.Dir("/"))
+
+// fileTransport is an http.RoundTripper which serves file:// URLs with
+// localTransport. It is only used to request file:// URLs, and refuses any
+// other.
+type fileTransport struct{}
+
+func (fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return nil, fmt.Errorf("%w: %v URL requested from a local file", ErrUnsupportedScheme, req.URL.Scheme)
+	}
+	res, err := localTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	// localTransport sets the Content-Length header, but not the
+	// ContentLength field the size of the video is taken from.
+	if res.ContentLength == -1 {
+		if n, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err == nil {
+			res.ContentLength = n
+		}
+	}
+	return res, nil
+}
+
+// localURL returns rawurl unchanged if it has a scheme, or otherwise treats
+// it as the path of a local file and returns its file:// URL, so that local
+// files and network mounts can be streamed like a remote video. URLs with a
+// scheme other than http, https or file fail with ErrUnsupportedScheme,
+// rather than with an obscure error from the transport once requested.
+func localURL(rawurl string) (string, error) {
+	if strings.Contains(rawurl, "://") {
+		return rawurl, checkScheme(rawurl)
+	}
+	path, err := filepath.Abs(rawurl)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(), nil
+}
+
+// checkScheme returns ErrUnsupportedScheme if rawurl can't be streamed.
+func checkScheme(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedScheme, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return fmt.Errorf("%w: %v has no host", ErrUnsupportedScheme, rawurl)
+		}
+		return nil
+	case "file":
+		return nil
+	}
+	return fmt.Errorf("%w: %q in %v; only http, https and file URLs can be streamed", ErrUnsupportedScheme, u.Scheme, rawurl)
+}
+
+// isHTTP reports whether scheme is http or https.
+func isHTTP(scheme string) bool {
+	return strings.EqualFold(scheme, "http") || strings.EqualFold(scheme, "https")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src.mkv")
+	if err := ioutil.WriteFile(src, testData, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fileURL, err := localURL(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{src, fileURL} {
+		var buf bytes.Buffer
+		vs, err := NewVideoStreamWriter(context.Background(), url, time.Hour, &buf, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vs.size != testSz {
+			t.Fatalf("%v: expected size %v, got %v", url, testSz, vs.size)
+		}
+		res, err := vs.Stream(context.Background())
+		vs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.BufferTime > 0 {
+			t.Fatalf("%v: expected no buffer time for a local file, got %v", url, res.BufferTime)
+		}
+		if !bytes.Equal(buf.Bytes(), testData) {
+			t.Fatalf("%v: streamed data did not match testData", url)
+		}
+	}
+
+	if _, err := NewVideoStreamWriter(context.Background(), filepath.Join(dir, "missing.mkv"), time.Hour, ioutil.Discard, Config{}); err == nil {
+		t.Fatal("expected an error streaming a missing file")
+	}
+}
+
+func TestLocalURL(t *testing.T) {
+	if u, err := localURL("http://example.com/a.mkv"); err != nil || u != "http://example.com/a.mkv" {
+		t.Fatalf("expected URLs with a scheme to be unchanged, got %v, %v", u, err)
+	}
+	for _, rawurl := range []string{"ftp://example.com/a.mkv", "https:///a.mkv", "http://exa mple.com/a.mkv"} {
+		if _, err := localURL(rawurl); !errors.Is(err, ErrUnsupportedScheme) {
+			t.Fatalf("expected %v for %v, got %v", ErrUnsupportedScheme, rawurl, err)
+		}
+	}
+	u, err := localURL("/videos/a b.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "file:///videos/a%20b.mkv" {
+		t.Fatalf("expected a file URL, got %v", u)
+	}
+}
@@ -1,163 +1,1479 @@
 package main
 
 import (
-	"flag"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/cheggaaa/pb"
 )
 
 const (
-	// fudgeFactor is used to overestimate buffering time in order to account for
+	// defaultFudgeFactor is used to overestimate buffering time in order to account for
 	// small variation in available bandwidth over the duration of the stream.
-	fudgeFactor = 1.2
+	defaultFudgeFactor = 1.2
 
-	// bandwidthSampleSize is the number of bytes to download in order to determine the available download bandwidth.
+	// bandwidthSampleSize is the default number of bytes to download in order to determine the available download bandwidth.
 	bandwidthSampleSize = 10000000
+
+	// version is the version of autobuffer.
+	version = "1.0.0"
+
+	// defaultUserAgent is the User-Agent sent when none is configured.
+	defaultUserAgent = "autobuffer/" + version
+
+	// defaultWarmupBytes and defaultWarmupTime bound the warmup period used
+	// by the command line tool before sampling bandwidth.
+	defaultWarmupBytes = 1000000
+	defaultWarmupTime  = time.Second
+
+	// defaultCopyBufferSize is the size of the buffer the video is copied
+	// through when none is configured, the same as io.Copy's.
+	defaultCopyBufferSize = 32 * 1024
+
+	// partSuffix is appended to the output path while streaming, unless
+	// Config.DisableAtomicWrite is set.
+	partSuffix = ".part"
 )
 
+// ErrChecksumMismatch is returned by Stream when the SHA-256 digest of the
+// downloaded video does not match Config.ExpectedSHA256.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrCanceled is returned by Stream when the VideoStream is cancelled by
+// Cancel.
+var ErrCanceled = errors.New("stream canceled")
+
+// ErrShortStream is returned by Stream when the server sends fewer bytes than
+// the size of the video it reported.
+var ErrShortStream = errors.New("stream ended early")
+
+// ErrDiskFull is matched by the DiskFullError returned when the disk fills up
+// while writing the output file.
+var ErrDiskFull = errors.New("disk full")
+
+// DiskFullError is returned when the disk holding the output file fills up.
+// The partial file is closed, and the download can be resumed once space has
+// been freed.
+type DiskFullError struct {
+	// Path is the path of the output file.
+	Path string
+	// Written is the number of bytes of the video in the output file.
+	Written uint64
+	// Err is the error returned by the write.
+	Err error
+}
+
+func (e *DiskFullError) Error() string {
+	return fmt.Sprintf("%v: could not write %v after %v bytes: %v", ErrDiskFull, e.Path, e.Written, e.Err)
+}
+
+func (e *DiskFullError) Unwrap() error { return e.Err }
+
+// Is reports whether target is ErrDiskFull.
+func (e *DiskFullError) Is(target error) bool { return target == ErrDiskFull }
+
+// ErrStalled is returned by Stream when no bytes of the video are received
+// for Config.StallTimeout.
+var ErrStalled = errors.New("stream stalled")
+
+// ErrTooLarge is returned when the video is larger than Config.MaxFileSize.
+var ErrTooLarge = errors.New("video too large")
+
+// ErrAlreadyBuffered is returned by NewVideoStreamConfig when Config.Resume
+// is set and the output file already holds the whole video, so there is
+// nothing left to stream.
+var ErrAlreadyBuffered = errors.New("video already buffered")
+
+// ErrNotModified is returned by NewVideoStreamConfig when
+// Config.IfModifiedSince is set and the server reports that the video hasn't
+// been modified since the output file was. It wraps ErrAlreadyBuffered.
+var ErrNotModified = fmt.Errorf("%w: not modified", ErrAlreadyBuffered)
+
+// ErrUnsupportedScheme is returned when the URL of the video isn't an http,
+// https or file URL, or is missing its host.
+var ErrUnsupportedScheme = errors.New("unsupported URL scheme")
+
+// ErrOutputExists is returned by NewVideoStreamConfig when Config.NoClobber is
+// set and the output file already exists.
+var ErrOutputExists = errors.New("output file already exists")
+
 // VideoStream streams a remote video to a file over HTTP and informs the user
 // when they can start playing the video safely, without interruptions.
 type VideoStream struct {
-	size     uint64
-	duration time.Duration
+	// downloaded is the number of bytes read from the response body. It is
+	// accessed atomically and kept first for 64-bit alignment.
+	downloaded uint64
+	// written is the number of bytes written to the output. It is accessed
+	// atomically.
+	written uint64
+	// started is the time Stream was called, in nanoseconds since the Unix
+	// epoch, or zero if it hasn't been. It is accessed atomically.
+	started int64
+	// readyAt is the time the video was announced as ready to play, in
+	// nanoseconds since the Unix epoch. It is accessed atomically.
+	readyAt int64
+	// size is the size of the video, grown while streaming if the server
+	// under-reported it. It is accessed atomically once streaming starts.
+	size uint64
+
+	url       string
+	knownSize bool
+	offset    uint64
+	duration  time.Duration
+	cfg       Config
+	// grew is set once the size has been grown past that reported by the
+	// server.
+	grew bool
+
+	w      io.Writer
+	hash   hash.Hash
+	header *headerBuffer
+	f      *os.File
+	name   string
+	res    *http.Response
+	rr     *retryReader
+	// head is the response to a HEAD request made before the video was
+	// requested, or nil if none was made or the server doesn't support it.
+	head *http.Response
+
+	// final is the path the file is renamed to once streamed, unless
+	// Config.DisableAtomicWrite is set.
+	final string
+
+	// state records the download alongside the output file, or is nil when
+	// streaming to a writer.
+	state *streamState
+	// fifo is set if the video is streamed to a named pipe.
+	fifo bool
+	// appendAt is the size of the output file before the video was
+	// appended to it, with Config.Append.
+	appendAt int64
+	// bw buffers writes to the output, if Config.WriteBufferSize is set.
+	bw *bufferedWriter
+	// sink is the writer the video is streamed to, if it was created by a
+	// Sink, and is closed once the video is complete.
+	sink     io.WriteCloser
+	sinkOnce sync.Once
+	sinkErr  error
+	// gz compresses the video on its way to the output file, if
+	// Config.CompressOutput is set.
+	gz *gzip.Writer
+	// preallocated is set if the output file was extended to the size of
+	// the video by Config.Preallocate.
+	preallocated bool
+
+	body    io.Reader
+	tee     io.Reader
+	rate    rateWindow
+	limiter *limiter
+	gate    gate
+
+	phase     int32
+	ready     int32
+	readyOnce sync.Once
+
+	// samplesMu guards samples, the bandwidth history, and sampledAt, the
+	// progress at the start of the ongoing measurement.
+	samplesMu sync.Mutex
+	samples   []BandwidthSample
+	sampledAt rateSample
+
+	// finished is closed once Stream returns, after setting streamErr to
+	// the error it returned.
+	finished   chan struct{}
+	finishOnce sync.Once
+	streamErr  error
+
+	// retries counts the retries made by parallel connections, and is
+	// accessed atomically.
+	retries int64
 
-	f   *os.File
-	res *http.Response
+	// stalled is set atomically when Stream is canceled for receiving no
+	// bytes within Config.StallTimeout.
+	stalled int32
+	// probed counts the bytes read by the request made with ProbeBandwidth,
+	// atomically, so that the download isn't considered stalled while it
+	// waits for the probe.
+	probed uint64
 
-	tee io.Reader
+	closeOnce sync.Once
+	closeErr  error
+
+	// cancelMu guards canceled and cancel, the function cancelling the
+	// context of a running Stream.
+	cancelMu sync.Mutex
+	canceled bool
+	cancel   context.CancelFunc
 }
 
 // NewVideoStream constructs a new video stream from an http URL, duration,
 // output path, and optionally HTTP Basic Auth parameters.
+//
+// Deprecated: Use New, which will replace NewVideoStream in the next release.
 func NewVideoStream(url string, duration time.Duration, outfile string, username string, password string) (*VideoStream, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	return New(url, WithDuration(duration), WithOutput(outfile), WithBasicAuth(username, password))
+}
+
+// NewVideoStreamContext is like NewVideoStream, but the HTTP request is bound
+// to ctx. Cancelling ctx aborts the request and any subsequent reads of the
+// response body.
+//
+// Deprecated: Use New with WithContext.
+func NewVideoStreamContext(ctx context.Context, url string, duration time.Duration, outfile string, username string, password string) (*VideoStream, error) {
+	return New(url, WithContext(ctx), WithDuration(duration), WithOutput(outfile), WithBasicAuth(username, password))
+}
+
+// NewVideoStreamConfig is like NewVideoStreamContext, but takes its optional
+// parameters from cfg.
+func NewVideoStreamConfig(ctx context.Context, url string, duration time.Duration, outfile string, cfg Config) (*VideoStream, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	url, err := localURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outfile), 0777); err != nil {
+		return nil, fmt.Errorf("could not create the directory for %v: %w", outfile, err)
+	}
+	// A named pipe can only be written from start to end, as its reader
+	// consumes it.
+	fifo := isFIFO(outfile)
+	if fifo {
+		cfg.DisableAtomicWrite, cfg.Resume, cfg.Preallocate, cfg.NoClobber = true, false, false, false
+		cfg.Connections = 1
+		cfg.SyncBytes, cfg.SyncInterval = 0, 0
+	}
+	// Appending concatenates the video to whatever is in the file, which
+	// must stay in place.
+	if cfg.Append {
+		cfg.DisableAtomicWrite, cfg.Preallocate, cfg.NoClobber = true, false, false
+		cfg.Connections = 1
+	}
+	// A compressed file can only be written from start to end, and isn't
+	// the video to resume.
+	compress := cfg.compressOutput(outfile)
+	if compress {
+		cfg.Resume, cfg.Preallocate = false, false
+		cfg.Connections = 1
+	}
+	// Only the tail of the video is downloaded from a start position, which
+	// is a single range.
+	if cfg.StartOffset > 0 || cfg.StartTime > 0 {
+		cfg.Connections = 1
+	}
+	path := outfile
+	if !cfg.DisableAtomicWrite {
+		path = outfile + partSuffix
+	}
+
+	var offset int64
+	var prev *streamState
+	if cfg.Resume {
+		if fi, err := os.Stat(path); err == nil {
+			prev = readState(path)
+			offset = resumeOffset(prev, url, fi.Size())
+		}
+	}
+	if duration == 0 && offset > 0 && prev != nil {
+		duration = prev.Duration
+	}
+
+	// Resuming and downloading over several connections depend on the
+	// server supporting range requests, so ask before committing to a GET.
+	// A finished download from an earlier run needn't be repeated, which
+	// also takes the size reported by the server to tell.
+	needHead := offset > 0 || cfg.Connections > 1
+	if _, err := os.Stat(outfile); err == nil && cfg.Resume {
+		needHead = true
+	}
+	var head *http.Response
+	if needHead {
+		if head, err = requestHead(ctx, url, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Resume {
+		complete, err := alreadyBuffered(outfile, head, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			return nil, fmt.Errorf("%w: %v", ErrAlreadyBuffered, outfile)
+		}
+	}
+	if cfg.NoClobber && !(cfg.Resume && cfg.DisableAtomicWrite) {
+		if _, err := os.Stat(outfile); err == nil {
+			return nil, fmt.Errorf("%w: %v", ErrOutputExists, outfile)
+		}
+	}
+	if offset > 0 && head != nil && !resumable(head, offset) {
+		offset = 0
+	}
+	start, err := startOffset(ctx, url, duration, head, cfg)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(username, password)
 
-	res, err := http.DefaultClient.Do(req)
+	// If-Range makes the server send the whole video instead of the rest of
+	// it if the video has changed since the download started, in which case
+	// the download starts over. The end of the file may be downloaded again
+	// to check it.
+	verify := cfg.ResumeVerifyBytes
+	if verify > offset {
+		verify = offset
+	}
+	req, err := newRequest(ctx, url, cfg, offset-verify+start, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && prev != nil && prev.Validator != "" {
+		req.Header.Set("If-Range", prev.Validator)
+	}
+	if cfg.IfModifiedSince && offset == 0 {
+		if fi, err := os.Stat(outfile); err == nil && fi.Mode().IsRegular() {
+			req.Header.Set("If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat))
+		}
+	}
+	res, err := do(req, cfg)
+	var se *statusError
+	if errors.As(err, &se) && se.code == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+		// The file on disk already reaches the end of the video, or goes
+		// past it if the video has shrunk, in which case it starts over.
+		if unsatisfiableSize(se) == offset {
+			return nil, finishResumed(path, outfile, offset, cfg)
+		}
+		offset = 0
+		res, err = request(ctx, url, cfg, 0)
+	}
+	if err != nil {
+		if errors.As(err, &se) && se.code == http.StatusNotModified {
+			return nil, fmt.Errorf("%w: %v", ErrNotModified, outfile)
+		}
+		return nil, err
+	}
+	// An HLS playlist is streamed as the concatenation of its segments,
+	// from the start.
+	if isPlaylist(url, res) {
+		if start > 0 {
+			res.Body.Close()
+			return nil, errStartPlaylist
+		}
+		var d time.Duration
+		if res, d, err = hlsResponse(ctx, url, res, cfg); err != nil {
+			return nil, err
+		}
+		if duration == 0 {
+			duration = d
+		}
+		offset, head = 0, nil
+	}
+	if err := cfg.checkExtension(strings.TrimSuffix(outfile, gzipSuffix), res.Header.Get("Content-Type")); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	// The range of a compressed response refers to the compressed video, not
+	// the decoded bytes on disk, so start over from scratch.
+	if offset > 0 && res.StatusCode == http.StatusPartialContent && contentEncoding(res) != "" {
+		res.Body.Close()
+		offset = 0
+		if res, err = request(ctx, url, cfg, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if verify > 0 && offset > 0 && res.StatusCode == http.StatusPartialContent {
+		ok, err := verifyResume(res, path, offset, verify)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		if !ok {
+			res.Body.Close()
+			offset = 0
+			if res, err = request(ctx, url, cfg, 0); err != nil {
+				return nil, err
+			}
+		} else if _, size, err := parseContentRange(res.Header.Get("Content-Range")); err == nil && size == offset {
+			res.Body.Close()
+			return nil, finishResumed(path, outfile, offset, cfg)
+		}
+	}
+
+	// From a start position, the tail of the video is streamed as if it were
+	// the whole video.
+	if start > 0 {
+		size, err := skipTo(res, start)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		duration = tailDuration(duration, size, start)
+	}
+
+	var onDisk int64
+	if res.StatusCode == http.StatusPartialContent {
+		onDisk = offset
+	}
+	if err := cfg.checkSize(res, onDisk); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	var f *os.File
+	if offset > 0 && res.StatusCode == http.StatusPartialContent {
+		if err := checkResumed(res, offset); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		// Bytes past those recorded as written may not have reached the
+		// disk intact, so they are downloaded again.
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+		if err == nil {
+			if err = f.Truncate(offset); err != nil {
+				f.Close()
+			}
+		}
+	} else {
+		// the server ignored our Range request, or the video changed, start
+		// over from scratch.
+		offset = 0
+		if fifo {
+			f, err = openFIFO(ctx, path)
+		} else if cfg.Append {
+			f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+		} else {
+			f, err = os.Create(path)
+		}
+	}
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	var appendAt int64
+	if cfg.Append && !fifo {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			res.Body.Close()
+			return nil, err
+		}
+		appendAt = fi.Size()
+	}
+	w := newSyncer(f, cfg).writer(f)
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	vs := newVideoStream(ctx, url, duration, w, res, offset, cfg)
+	vs.rr.offset += start
+	vs.f = f
+	vs.gz = gz
+	vs.appendAt = appendAt
+	vs.name = path
+	vs.head = head
+	if !cfg.DisableAtomicWrite {
+		vs.final = outfile
+	}
+	if cfg.Preallocate && offset == 0 && vs.knownSize {
+		if err := f.Truncate(int64(vs.size)); err != nil {
+			vs.Close()
+			if errors.Is(err, syscall.ENOSPC) {
+				return nil, &DiskFullError{Path: path, Written: uint64(offset), Err: err}
+			}
+			return nil, fmt.Errorf("could not preallocate %v: %w", path, err)
+		}
+		vs.preallocated = true
+	}
+
+	// The digest covers the whole video and the duration is detected from
+	// its header, so both must see the part already on disk.
+	if offset > 0 {
+		if err := readPrefix(io.MultiWriter(vs.hash, vs.header), path, offset); err != nil {
+			vs.Close()
+			return nil, err
+		}
+	}
+
+	if fifo {
+		vs.fifo = true
+		return vs, nil
+	}
+	// The tail of a video can't be resumed as the video, nor can a
+	// compressed or appended one.
+	if start > 0 || compress || cfg.Append {
+		return vs, nil
+	}
+
+	// Record the download, so that it can be resumed if interrupted. Only
+	// Resume ever reads the state back, so nothing is left behind without
+	// it.
+	if !cfg.Resume {
+		return vs, nil
+	}
+	vs.state = &streamState{
+		URL:         url,
+		Validator:   validator(res),
+		Size:        -1,
+		Duration:    duration,
+		FudgeFactor: cfg.FudgeFactor,
+	}
+	if offset > 0 && prev != nil {
+		vs.state.Validator = prev.Validator
+	}
+	if vs.knownSize {
+		vs.state.Size = int64(vs.size)
+	}
+	vs.state.Written = offset
+	if err := writeState(path, *vs.state); err != nil {
+		vs.Close()
+		return nil, err
+	}
+	return vs, nil
+}
+
+// readPrefix writes the first n bytes of the file at path to w.
+func readPrefix(w io.Writer, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, n)
+	return err
+}
+
+// NewVideoStreamWriter is like NewVideoStreamConfig, but streams the video to
+// w instead of a file. Closing the VideoStream does not close w. Resume is
+// not supported when streaming to a writer and is ignored.
+func NewVideoStreamWriter(ctx context.Context, url string, duration time.Duration, w io.Writer, cfg Config) (*VideoStream, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	url, err := localURL(url)
+	if err != nil {
+		return nil, err
+	}
+	res, duration, start, err := requestVideo(ctx, url, duration, cfg)
+	if err != nil {
+		return nil, err
+	}
+	vs := newVideoStream(ctx, url, duration, w, res, 0, cfg)
+	vs.rr.offset = start
+	return vs, nil
+}
+
+// requestVideo requests url to be streamed from the start, or from the start
+// position in cfg, to an output other than a file. It returns the response,
+// the duration of the video to be streamed and the offset it starts at.
+func requestVideo(ctx context.Context, url string, duration time.Duration, cfg Config) (*http.Response, time.Duration, int64, error) {
+	start, err := startOffset(ctx, url, duration, nil, cfg)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	res, err := request(ctx, url, cfg, start)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if isPlaylist(url, res) {
+		if start > 0 {
+			res.Body.Close()
+			return nil, 0, 0, errStartPlaylist
+		}
+		var d time.Duration
+		if res, d, err = hlsResponse(ctx, url, res, cfg); err != nil {
+			return nil, 0, 0, err
+		}
+		if duration == 0 {
+			duration = d
+		}
+	}
+	if start > 0 {
+		size, err := skipTo(res, start)
+		if err != nil {
+			res.Body.Close()
+			return nil, 0, 0, err
+		}
+		duration = tailDuration(duration, size, start)
+	}
+	if err := cfg.checkSize(res, 0); err != nil {
+		res.Body.Close()
+		return nil, 0, 0, err
+	}
+	return res, duration, start, nil
+}
+
+// newVideoStream constructs a VideoStream writing the body of res, which
+// starts at offset in the remote video, to w.
+func newVideoStream(ctx context.Context, url string, duration time.Duration, w io.Writer, res *http.Response, offset int64, cfg Config) *VideoStream {
+	// Servers using chunked transfer encoding may omit Content-Length, in
+	// which case the video is streamed without computing a buffer time. The
+	// same goes for compressed videos whose decoded size isn't reported.
+	sz := decodedLength(res)
+	knownSize := sz != -1
+	if knownSize {
+		sz += offset
+	} else {
+		sz = 0
+	}
+
+	vs := &VideoStream{
+		url:       url,
+		size:      uint64(sz),
+		knownSize: knownSize,
+		offset:    uint64(offset),
+		duration:  duration,
+		cfg:       cfg,
+		hash:      sha256.New(),
+		header:    &headerBuffer{max: headerSize},
+		res:       res,
+		rate:      rateWindow{window: bandwidthWindow},
+		finished:  make(chan struct{}),
+	}
+	w = &countingWriter{w: w, n: &vs.written}
+	if cfg.WriteBufferSize > 0 {
+		vs.bw = newBufferedWriter(w, cfg.WriteBufferSize)
+		w = vs.bw
+	}
+	vs.w = io.MultiWriter(w, vs.hash, vs.header)
+	vs.rr = &retryReader{
+		ctx:       ctx,
+		url:       url,
+		cfg:       &vs.cfg,
+		offset:    offset,
+		validator: validator(res),
+		gate:      &vs.gate,
+		body:      res.Body,
+	}
+	if hr, ok := res.Body.(*hlsReader); ok {
+		vs.rr.reopen = hr.seek
+	}
+	// Only a size resting on Content-Length alone is probed past, and only
+	// with GET, as requesting it again with another method may have side
+	// effects. Compressed videos aren't probed either, since their size is
+	// that of the decoded video rather than of the bytes received.
+	vs.rr.probeEnd = knownSize && cfg.Method == http.MethodGet && !sizeConfirmed(res) &&
+		contentEncoding(res) == "" && res.Header.Get("Accept-Ranges") != "none"
+	if cfg.MaxBytesPerSecond > 0 || cfg.ReadyBytesPerSecond > 0 {
+		vs.limiter = newLimiter(cfg.MaxBytesPerSecond)
+	}
+	// Compressed videos are decoded before being counted, so that progress
+	// and bandwidth are measured in bytes of video. The limit applies to the
+	// bytes received.
+	body := vs.throttle(vs.rr)
+	if enc := contentEncoding(res); enc != "" {
+		body = &decodingReader{r: body, encoding: enc}
+	}
+	vs.body = sizeReader{vs, &countingReader{r: body, n: &vs.downloaded}}
+	vs.tee = io.TeeReader(vs.body, vs.w)
+	return vs
+}
+
+// request requests url starting at offset, returning an error if the server
+// does not respond with the video.
+func request(ctx context.Context, url string, cfg Config, offset int64) (*http.Response, error) {
+	req, err := newRequest(ctx, url, cfg, offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	return do(req, cfg)
+}
+
+// sizeConfirmed reports whether the server stated the total size of the
+// video in the Content-Range of res, rather than only the Content-Length of
+// the body, which some servers under-report.
+func sizeConfirmed(res *http.Response) bool {
+	cr := res.Header.Get("Content-Range")
+	if cr == "" {
+		return false
+	}
+	_, total, err := parseContentRange(cr)
+	return err == nil && total != -1
+}
+
+// requestHead issues a HEAD request for url, to learn the size of the video
+// and whether the server supports range requests without downloading it. It
+// returns nil if the server doesn't support HEAD requests, in which case the
+// headers of the GET response must be relied on instead.
+func requestHead(ctx context.Context, url string, cfg Config) (*http.Response, error) {
+	// Servers that require another method to serve the video can't be
+	// expected to answer HEAD requests for it.
+	if cfg.Method != http.MethodGet {
+		return nil, nil
+	}
+	cfg.Method = http.MethodHead
+	req, err := newRequest(ctx, url, cfg, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	res, err := cfg.client(req.URL).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// resumable reports whether a download can be resumed at offset, given the
+// response to a HEAD request. It can't if the server doesn't support range
+// requests, or if the file on disk is at least as large as the video, in
+// which case it isn't the start of the same video.
+func resumable(head *http.Response, offset int64) bool {
+	if head.Header.Get("Accept-Ranges") == "none" {
+		return false
+	}
+	if head.ContentLength == -1 || contentEncoding(head) != "" {
+		return true
+	}
+	return offset < head.ContentLength
+}
+
+// do sends req, returning an error if the server does not respond with the
+// video.
+func do(req *http.Request, cfg Config) (*http.Response, error) {
+	res, err := cfg.client(req.URL).Do(req)
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return nil, newStatusError(res)
+	}
+	return res, nil
+}
+
+// checkResumed checks that the partial content in res starts at offset.
+func checkResumed(res *http.Response, offset int64) error {
+	start, _, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != offset {
+		return fmt.Errorf("server resumed at byte %v, wanted %v", start, offset)
+	}
+	return nil
+}
 
-	f, err := os.Create(outfile)
+// newRequest builds a GET request for url, requesting the resource starting
+// at offset if it is non-zero, and ending before end if it is non-zero.
+func newRequest(ctx context.Context, url string, cfg Config, offset, end int64) (*http.Request, error) {
+	var body io.Reader
+	if len(cfg.Body) > 0 {
+		body = bytes.NewReader(cfg.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, cfg.Method, url, body)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.PinnedCertSHA256 != "" && req.URL.Scheme == "http" {
+		return nil, errPinnedHTTP
+	}
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	if cfg.Username != "" || cfg.Password != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	// explicitly configured headers, such as a bearer token in
+	// Authorization, take precedence over basic auth.
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	for _, c := range cfg.Cookies {
+		req.AddCookie(c)
+	}
+	switch {
+	case end > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+	case offset > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return req, nil
+}
 
-	sz := res.ContentLength
-	if sz == -1 {
-		return nil, http.ErrMissingContentLength
+// parseContentRange parses the first byte position and the total size from a
+// Content-Range header of the form "bytes start-end/total". If the total size
+// is unknown, it is returned as -1.
+func parseContentRange(header string) (start, total int64, err error) {
+	var end int64
+	var totalStr string
+	if _, err := fmt.Sscanf(header, "bytes %d-%d/%s", &start, &end, &totalStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q: %v", header, err)
+	}
+	if totalStr == "*" {
+		return start, -1, nil
 	}
+	total, err = strconv.ParseInt(totalStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q: %v", header, err)
+	}
+	return start, total, nil
+}
 
-	tee := io.TeeReader(res.Body, f)
+// Cancel aborts a Stream running in another goroutine, which returns
+// ErrCanceled, leaving the partially downloaded file on disk. Cancelling a
+// VideoStream before calling Stream makes Stream fail immediately. Cancel and
+// Close may be called in any order, and more than once.
+func (vs *VideoStream) Cancel() {
+	vs.cancelMu.Lock()
+	defer vs.cancelMu.Unlock()
+	if vs.canceled {
+		return
+	}
+	vs.canceled = true
+	if vs.cancel != nil {
+		vs.cancel()
+	}
+	vs.rr.Close()
+}
 
-	return &VideoStream{
-		size:     uint64(sz),
-		duration: duration,
-		tee:      tee,
-		res:      res,
-		f:        f,
-	}, nil
+// isCanceled reports whether Cancel has been called.
+func (vs *VideoStream) isCanceled() bool {
+	vs.cancelMu.Lock()
+	defer vs.cancelMu.Unlock()
+	return vs.canceled
 }
 
 // Close closes the underlying file and http response opened by the
-// VideoStream.
+// VideoStream. Writers passed to NewVideoStreamWriter are not closed. It is
+// safe to call Close more than once; subsequent calls return the result of
+// the first.
 func (vs *VideoStream) Close() error {
-	var errs []error
-	if err := vs.f.Close(); err != nil {
-		errs = append(errs, err)
+	vs.closeOnce.Do(func() {
+		var errs []error
+		if vs.bw != nil {
+			if err := vs.bw.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if vs.sink != nil {
+			if err := vs.closeSink(errIncomplete); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if vs.gz != nil {
+			if err := vs.gz.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if vs.f != nil {
+			if err := vs.f.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := vs.rr.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		if len(errs) > 0 {
+			vs.closeErr = fmt.Errorf("error closing VideoStream: %w", errors.Join(errs...))
+		}
+	})
+	return vs.closeErr
+}
+
+// OutputPath returns the absolute path of the file the video is streamed to,
+// or the empty string for VideoStreams created with NewVideoStreamWriter.
+// Unless Config.DisableAtomicWrite is set, this is the path the file is
+// renamed to once the video has been streamed.
+func (vs *VideoStream) OutputPath() string {
+	name := vs.name
+	if vs.final != "" {
+		name = vs.final
 	}
-	if err := vs.res.Body.Close(); err != nil {
-		errs = append(errs, err)
+	if name == "" {
+		return ""
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf("error closing VideoStream: %v\n", errs)
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// ResponseHeaders returns a copy of the headers of the server's response to
+// the request for the video, such as its Content-Type or those added by a
+// CDN. Responses to requests made when retrying aren't reflected.
+func (vs *VideoStream) ResponseHeaders() http.Header {
+	return vs.res.Header.Clone()
+}
+
+// Size returns the number of bytes of the video written so far, including
+// any resumed offset. Once Stream has returned successfully, this is the size
+// of the whole video, which may differ from the size the server reported.
+func (vs *VideoStream) Size() uint64 {
+	return vs.offset + atomic.LoadUint64(&vs.downloaded)
+}
+
+// checkSize returns ErrTooLarge if the video in res, following start bytes
+// already on disk, is reported to be larger than MaxFileSize.
+func (cfg *Config) checkSize(res *http.Response, start int64) error {
+	if cfg.MaxFileSize <= 0 {
+		return nil
+	}
+	if sz := decodedLength(res); sz != -1 && start+sz > cfg.MaxFileSize {
+		return fmt.Errorf("%w: the video is %v bytes, over the limit of %v", ErrTooLarge, start+sz, cfg.MaxFileSize)
 	}
 	return nil
 }
 
-// bandwidth returns the average bandwidth (in bytes per second) between the
-// user and the requested resource.  this bandwidth is computed by downloading up to 10MB.
-func (vs *VideoStream) bandwidth() (float64, error) {
-	tbefore := time.Now()
-	n, err := io.CopyN(ioutil.Discard, vs.tee, bandwidthSampleSize)
-	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+// sizeReader wraps the body of a VideoStream, growing its size if the server
+// sends more bytes than it reported, and failing with ErrTooLarge once it
+// sends more than MaxFileSize. Since net/http stops reading at the reported
+// Content-Length, the retryReader requests any bytes past it.
+type sizeReader struct {
+	vs *VideoStream
+	r  io.Reader
+}
+
+func (sr sizeReader) Read(p []byte) (int, error) {
+	if max := uint64(sr.vs.cfg.MaxFileSize); max > 0 {
+		written := sr.vs.offset + atomic.LoadUint64(&sr.vs.downloaded)
+		if written >= max {
+			// Nothing but the end of the video may follow.
+			var b [1]byte
+			if n, err := sr.r.Read(b[:]); n > 0 {
+				return 0, fmt.Errorf("%w: the video is over the limit of %v bytes", ErrTooLarge, max)
+			} else if err != nil {
+				return 0, err
+			}
+			return 0, nil
+		}
+		if remaining := max - written; uint64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := sr.r.Read(p)
+	if sr.vs.knownSize {
+		sr.vs.grow(sr.vs.offset + atomic.LoadUint64(&sr.vs.downloaded))
+	}
+	return n, err
+}
+
+// grow raises the size of the video to n bytes if it was reported as
+// smaller, warning that the buffer time was underestimated.
+func (vs *VideoStream) grow(n uint64) {
+	size := vs.total()
+	if n <= size {
+		return
+	}
+	atomic.StoreUint64(&vs.size, n)
+	if !vs.grew {
+		vs.grew = true
+		vs.printf("\nWarning: the server reported a size of %v bytes, but sent more. The buffer time may be underestimated.\n", size)
+	}
+}
+
+// total returns the size of the video. It is safe to call while streaming.
+func (vs *VideoStream) total() uint64 {
+	return atomic.LoadUint64(&vs.size)
+}
+
+// shortStream returns an ErrShortStream describing how much of the video
+// was received.
+func (vs *VideoStream) shortStream() error {
+	return fmt.Errorf("%w: got %v bytes, wanted %v", ErrShortStream, vs.offset+atomic.LoadUint64(&vs.downloaded), vs.total())
+}
+
+// contextReader wraps an io.Reader and fails any Read once its context is
+// done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
 		return 0, err
 	}
-	return float64(n) / (time.Since(tbefore).Seconds()), nil
+	return cr.r.Read(p)
+}
+
+// watch closes the response body when ctx is done, unblocking any pending
+// reads. The returned function stops the watch.
+func (vs *VideoStream) watch(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			vs.rr.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// bandwidth returns the average bandwidth (in bytes per second) between the
+// user and the requested resource, and the number of bytes sampled.  this
+// bandwidth is computed by downloading up to SampleBytes of the remaining
+// resource, after a warmup period which isn't timed. With ProbeBandwidth, the
+// sample is downloaded by a separate request, leaving the download
+// undisturbed, and no bytes of it are sampled.
+func (vs *VideoStream) bandwidth(ctx context.Context) (float64, uint64, error) {
+	if vs.cfg.ProbeBandwidth {
+		s, err := vs.probe(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		vs.recordSample(s)
+		return s.Bps, 0, nil
+	}
+	limit := int64(math.MaxInt64)
+	if vs.knownSize {
+		limit = int64(vs.size - vs.offset)
+	}
+	s, n, err := vs.cfg.sample(contextReader{ctx, vs.tee}, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	vs.recordSample(s)
+	return s.Bps, n, nil
+}
+
+// probe samples the bandwidth with a separate request for the start of the
+// video, which is discarded once sampled. The duration is detected from the
+// probe, since the start of the video may not have been downloaded yet.
+func (vs *VideoStream) probe(ctx context.Context) (BandwidthSample, error) {
+	// The length of the warmup is unknown if only its time is limited, in
+	// which case as much of the video as needed is requested.
+	var end int64
+	if vs.cfg.WarmupBytes > 0 || vs.cfg.WarmupTime <= 0 {
+		end = vs.cfg.WarmupBytes + vs.cfg.SampleBytes
+	}
+	url, err := vs.cfg.refreshURL(vs.url)
+	if err != nil {
+		return BandwidthSample{}, err
+	}
+	req, err := newRequest(ctx, url, vs.cfg, 0, end)
+	if err != nil {
+		return BandwidthSample{}, err
+	}
+	res, err := do(req, vs.cfg)
+	if err != nil {
+		return BandwidthSample{}, err
+	}
+	defer res.Body.Close()
+
+	var r io.Reader = &countingReader{r: contextReader{ctx, res.Body}, n: &vs.probed}
+	if vs.offset == 0 {
+		r = io.TeeReader(r, vs.header)
+	}
+	limit := int64(math.MaxInt64)
+	if vs.knownSize {
+		limit = int64(vs.size)
+	}
+	s, _, err := vs.cfg.sample(r, limit)
+	return s, err
+}
+
+// sample measures the bandwidth of reading up to SampleBytes from r,
+// and the number of bytes read, which may include a warmup but no more than
+// limit bytes. The bytes are only counted as they are read through a small
+// buffer, so the memory used doesn't grow with SampleBytes.
+func (cfg *Config) sample(r io.Reader, limit int64) (BandwidthSample, uint64, error) {
+	clock := cfg.clock()
+	tbefore := clock.Now()
+	warmup, err := cfg.warmup(r, limit)
+	if err != nil {
+		return BandwidthSample{}, 0, err
+	}
+
+	sample := cfg.SampleBytes
+	if remaining := limit - warmup; remaining < sample {
+		sample = remaining
+	}
+	// The whole video may have been read while warming up, in which case
+	// the warmup is all there is to measure.
+	if sample <= 0 {
+		return newBandwidthSample(tbefore, clock.Now(), uint64(warmup)), uint64(warmup), nil
+	}
+
+	s, err := cfg.probeRounds(r, sample)
+	if err != nil {
+		return BandwidthSample{}, 0, err
+	}
+	return s, uint64(warmup) + s.Bytes, nil
+}
+
+// warmup reads from r until WarmupBytes have been read or WarmupTime has
+// passed, whichever comes first, reading no more than limit bytes. It returns
+// the number of bytes read. Throughput ramps up over the first moments of a
+// connection, due to TCP slow start and CDNs fetching the video from their
+// origin, so timing them would underestimate the bandwidth.
+func (cfg *Config) warmup(r io.Reader, limit int64) (int64, error) {
+	if cfg.WarmupBytes <= 0 && cfg.WarmupTime <= 0 {
+		return 0, nil
+	}
+	if cfg.WarmupBytes > 0 && cfg.WarmupBytes < limit {
+		limit = cfg.WarmupBytes
+	}
+
+	clock := cfg.clock()
+	start := clock.Now()
+	pbuf := cfg.copyBuffer()
+	defer copyBuffers.Put(pbuf)
+	buf := *pbuf
+	var n int64
+	for n < limit && (cfg.WarmupTime <= 0 || clock.Now().Sub(start) < cfg.WarmupTime) {
+		if limit-n < int64(len(buf)) {
+			buf = buf[:limit-n]
+		}
+		m, err := r.Read(buf)
+		n += int64(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// copyBuffers pools the buffers the video is copied through, so that a
+// program streaming many videos reuses them rather than allocating a buffer
+// for every warmup and download. It holds *[]byte.
+var copyBuffers sync.Pool
+
+// copyBuffer returns a buffer of CopyBufferSize bytes from copyBuffers, to be
+// put back once it's no longer used.
+func (cfg *Config) copyBuffer() *[]byte {
+	if b, ok := copyBuffers.Get().(*[]byte); ok && len(*b) == cfg.CopyBufferSize {
+		return b
+	}
+	b := make([]byte, cfg.CopyBufferSize)
+	return &b
+}
+
+// StreamResult describes a completed (or failed) call to Stream.
+type StreamResult struct {
+	// Bandwidth is the sampled bandwidth, in bytes per second.
+	Bandwidth float64
+	// BufferTime is how long the user had to wait before safely playing
+	// the video.
+	BufferTime time.Duration
+	// BytesWritten is the number of bytes written to the output file by
+	// this call to Stream. With Config.CompressOutput, that is the number
+	// of bytes of the video before compression.
+	BytesWritten uint64
+	// CompressedBytes is the size of the output file, with
+	// Config.CompressOutput, once the whole video has been compressed to
+	// it.
+	CompressedBytes uint64
+	// Elapsed is the total time spent in Stream.
+	Elapsed time.Duration
+	// Duration is the duration of the video used to compute BufferTime,
+	// either detected from the video or as configured.
+	Duration time.Duration
+	// Retries is the number of times the request was reissued after a
+	// transient error.
+	Retries int
+	// Ready is whether the video was ready to play when Stream returned.
+	Ready bool
+	// SHA256 is the hex encoded SHA-256 digest of the downloaded video. It
+	// is set once the whole video has been downloaded, even if the digest
+	// does not match Config.ExpectedSHA256.
+	SHA256 string
 }
 
 // Stream buffers the remote file into the local file, giving user
-// feedback on progress until they can safely play the file.
-func (vs *VideoStream) Stream() error {
-	fmt.Println("Sampling bandwidth, please wait...")
-	bw, err := vs.bandwidth()
+// feedback on progress until they can safely play the file. If ctx is
+// cancelled, Stream closes the VideoStream and returns ctx.Err(), leaving the
+// partially downloaded file on disk, and likewise returns ErrCanceled if
+// Cancel is called. The returned StreamResult is non-nil
+// even when Stream fails, describing the partial stream.
+func (vs *VideoStream) Stream(ctx context.Context) (res *StreamResult, err error) {
+	if vs.cfg.WebhookURL != "" {
+		defer func() { vs.notify(res, err) }()
+	}
+	defer func() { vs.finish(err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	vs.cancelMu.Lock()
+	vs.cancel = cancel
+	if vs.canceled {
+		cancel()
+	}
+	vs.cancelMu.Unlock()
+
+	stop := vs.watch(ctx)
+	defer stop()
+	if vs.cfg.StallTimeout > 0 {
+		stopStall := vs.watchStall(vs.cfg.StallTimeout, cancel)
+		defer stopStall()
+	}
+
+	atomic.StoreInt64(&vs.started, vs.cfg.clock().Now().UnixNano())
+	vs.rr.ctx = ctx
+	if hr, ok := vs.rr.body.(*hlsReader); ok {
+		hr.ctx = ctx
+	}
+	if vs.cfg.ProgressFunc != nil {
+		stopProgress := vs.reportProgress(progressInterval)
+		defer stopProgress()
+	}
+	stopState := func() {}
+	if vs.state != nil {
+		stopState = vs.persistState(stateInterval)
+	}
+
+	res = new(StreamResult)
+	err = vs.stream(ctx, res)
+	if vs.bw != nil {
+		if ferr := vs.bw.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	stopState()
+	res.BytesWritten = atomic.LoadUint64(&vs.downloaded)
+	res.Retries = vs.retryCount()
+	res.Ready = atomic.LoadInt32(&vs.ready) == 1
+	res.Elapsed = vs.elapsed()
 	if err != nil {
-		return err
+		vs.unallocate()
+		if ctx.Err() != nil {
+			vs.Close()
+			if vs.isCanceled() {
+				return res, ErrCanceled
+			}
+			if atomic.LoadInt32(&vs.stalled) == 1 {
+				return res, fmt.Errorf("%w: no bytes received for %v", ErrStalled, vs.cfg.StallTimeout)
+			}
+			return res, ctx.Err()
+		}
+		if vs.f != nil && errors.Is(err, syscall.ENOSPC) {
+			// Close the partial file right away, so that it can be resumed
+			// once space has been freed.
+			vs.Close()
+			return res, &DiskFullError{Path: vs.name, Written: vs.writtenBytes(), Err: err}
+		}
+		return res, err
 	}
-	fmt.Printf("Average bandwidth: %v bps\n", bw)
 
-	// Calculate the amount of time needed to safely play the remote video.
-	downloadTime := (float64(vs.size) / bw) * fudgeFactor
-	bufferTime := time.Duration(downloadTime-vs.duration.Seconds()) * time.Second
+	res.SHA256 = hex.EncodeToString(vs.hash.Sum(nil))
+	if vs.cfg.ExpectedSHA256 != "" && !strings.EqualFold(res.SHA256, vs.cfg.ExpectedSHA256) {
+		return res, fmt.Errorf("%w: got %v, wanted %v", ErrChecksumMismatch, res.SHA256, vs.cfg.ExpectedSHA256)
+	}
 
-	if bufferTime > 0 {
-		fmt.Printf("%v until you can safely watch this video.\n", bufferTime)
-		fmt.Println("Buffering...")
+	if vs.gz != nil {
+		if err := vs.finishCompressed(res); err != nil {
+			return res, err
+		}
+	}
+	if vs.sink != nil {
+		if err := vs.closeSink(nil); err != nil {
+			return res, err
+		}
 	}
 
-	remoteReader := vs.res.Body
-	remainingDownloadBytes := int(vs.size) - bandwidthSampleSize
-	if remainingDownloadBytes > 0 {
-		progressbar := pb.New(remainingDownloadBytes).SetUnits(pb.U_BYTES)
-		progressbar.ShowSpeed = true
-		progressbar.Start()
-		remoteReader = progressbar.NewProxyReader(vs.res.Body)
+	// The video is complete, so there's nothing left to resume and it can be
+	// moved into place.
+	if vs.f != nil {
+		removeState(vs.name)
 	}
+	if vs.final != "" {
+		if err := vs.Close(); err != nil {
+			return res, err
+		}
+		if err := os.Rename(vs.name, vs.final); err != nil {
+			return res, err
+		}
+	}
+	if vs.f != nil {
+		path := vs.name
+		if vs.final != "" {
+			path = vs.final
+		}
+		if err := vs.recordComplete(path); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// unallocate truncates a preallocated output file to the bytes downloaded
+// after a failed stream, so that it can be resumed. Chunks downloaded over
+// several connections needn't be contiguous, so those are left as they are.
+func (vs *VideoStream) unallocate() {
+	if !vs.preallocated || vs.parallel() {
+		return
+	}
+	os.Truncate(vs.name, int64(vs.offset+atomic.LoadUint64(&vs.downloaded)))
+}
+
+// retryCount returns the number of retries made so far. It is safe to call
+// while streaming.
+func (vs *VideoStream) retryCount() int {
+	return int(atomic.LoadInt64(&vs.rr.retries) + atomic.LoadInt64(&vs.retries))
+}
+
+// printf writes an informational message to the Logger, if there is one.
+func (vs *VideoStream) printf(format string, a ...interface{}) {
+	if vs.cfg.Logger != nil {
+		fmt.Fprintf(vs.cfg.Logger, format, a...)
+	}
+}
+
+func (vs *VideoStream) stream(ctx context.Context, res *StreamResult) error {
+	if vs.cfg.DownloadOnly {
+		vs.printf("Downloading...\n")
+		vs.header.release()
+		vs.setPhase(PhaseBuffering)
+		var remaining uint64
+		if vs.knownSize {
+			remaining = vs.size - vs.offset
+		}
+		if err := vs.copyRest(ctx, remaining, nil, nil); err != nil {
+			return err
+		}
+		vs.setPhase(PhaseDone)
+		return nil
+	}
+
+	vs.printf("Sampling bandwidth, please wait...\n")
+	bw, sampled, err := vs.bandwidth(ctx)
+	if err != nil {
+		return err
+	}
+	res.Bandwidth = bw
+	vs.printf("Average bandwidth: %v bps\n", bw)
+
+	if !vs.knownSize {
+		vs.setPhase(PhaseBuffering)
+		if rate := float64(vs.cfg.PlaybackBitrate) * vs.cfg.FudgeFactor; rate > 0 && vs.cfg.readyBandwidth(bw) >= rate {
+			vs.printf("The download outpaces playback, so you can start watching now.\n")
+			vs.announceReady()
+		} else {
+			vs.printf("The server did not report the size of this video, so buffer time cannot be computed.\n")
+		}
+		vs.printf("Streaming...\n")
+		buf := vs.cfg.copyBuffer()
+		defer copyBuffers.Put(buf)
+		if _, err := io.CopyBuffer(vs.w, contextReader{ctx, vs.body}, *buf); err != nil {
+			return err
+		}
+		vs.setPhase(PhaseDone)
+		return nil
+	}
+
+	// Prefer the duration recorded in the video itself, if it's in a format
+	// we understand, unless playback is modelled by its bitrate.
+	if vs.cfg.PlaybackBitrate > 0 {
+		vs.duration = vs.cfg.playbackDuration(vs.size, vs.duration)
+		vs.printf("At %v bytes per second, playback will take %v.\n", vs.cfg.PlaybackBitrate, vs.duration.Round(time.Second))
+	} else if d, ok := parseDuration(vs.header.buf); ok {
+		vs.duration = d
+		vs.printf("Detected video duration: %v\n", d)
+	} else if vs.duration == 0 && vs.cfg.MinBufferPercent == 0 {
+		vs.printf("Could not detect the duration of this video, so it will only be ready to play once fully downloaded.\n")
+	}
+	vs.header.release()
+	res.Duration = vs.duration
+	vs.setPhase(PhaseBuffering)
+
+	// Calculate the amount of time needed to safely play the remote video.
+	// Bytes already on disk from a resumed download or the bandwidth sample
+	// don't need fetching.
+	remaining := vs.size - vs.offset - sampled
+	bufferTime := vs.cfg.addStartupMargin(vs.bufferTime(vs.offset+sampled, bw))
+	vs.printf("The download will complete in %v.\n", formatETA(vs.downloadTime(vs.offset+sampled, bw)))
 
+	// If the download will outpace playback there's nothing to wait for.
+	// Otherwise the buffer time is recomputed as the download progresses,
+	// since the bandwidth may change. stream waits for the goroutine to
+	// exit, so that the video is never announced as ready after the
+	// download has failed.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	if bufferTime <= 0 {
+		vs.printf("You can start watching now, no buffering is needed.\n")
+		vs.announceReady()
+	} else {
+		res.BufferTime = bufferTime
+		vs.printf("%v until you can safely watch this video.\n", bufferTime.Round(time.Second))
+		vs.printf("Buffering...\n")
+	}
+	wg.Add(1)
 	go func() {
-		time.Sleep(bufferTime)
-		fmt.Printf("%v is now ready to play.\n", vs.f.Name())
+		defer wg.Done()
+		vs.awaitReady(progressInterval, done)
+		vs.watchUnderrun(progressInterval, done)
 	}()
 
-	if _, err := io.Copy(vs.f, remoteReader); err != nil {
+	if err := vs.copyRest(ctx, remaining, done, &wg); err != nil {
 		return err
 	}
+	vs.announceReady()
+	vs.setPhase(PhaseDone)
 	return nil
 }
 
-func main() {
-	var videourl = flag.String("url", "", "HTTP url of the video to stream")
-	var duration = flag.Duration("duration", time.Second, "Duration of the video to stream")
-	var outpath = flag.String("out", "out.mkv", "Filepath to stream output")
-	var username = flag.String("username", "", "Username to use for HTTP basic auth")
-	var password = flag.String("password", "", "Password to user for HTTP basic auth")
-
-	flag.Parse()
-
-	if *videourl == "" || *duration == time.Second {
-		fmt.Println("A video url and duration is required for autobuffer.  Usage:")
-		flag.PrintDefaults()
-		return
+// copyRest copies the remaining bytes of the video to the output, showing a
+// progress bar if there is a Logger. If done is non-nil, the progress bar
+// shows the time until the video is ready to play, reported by a goroutine
+// added to wg which exits once done is closed; otherwise it shows the time
+// until the download is complete.
+func (vs *VideoStream) copyRest(ctx context.Context, remaining uint64, done <-chan struct{}, wg *sync.WaitGroup) error {
+	wrap := func(r io.Reader) io.Reader { return r }
+	if remaining > 0 && vs.cfg.Logger != nil {
+		progressbar := pb.New(int(remaining)).SetUnits(pb.U_BYTES)
+		progressbar.Output = vs.cfg.Logger
+		progressbar.ShowSpeed = true
+		// reportETA shows the time until the video is ready as well as
+		// until it is complete.
+		progressbar.ShowTimeLeft = done == nil
+		progressbar.Start()
+		defer progressbar.Finish()
+		if done != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				vs.reportETA(progressbar, progressInterval, done)
+			}()
+		}
+		wrap = func(r io.Reader) io.Reader { return progressbar.NewProxyReader(r) }
 	}
 
-	vs, err := NewVideoStream(*videourl, *duration, *outpath, *username, *password)
+	var err error
+	if vs.parallel() {
+		vs.printf("Downloading over %v connections...\n", vs.cfg.Connections)
+		err = vs.copyParallel(ctx, int64(vs.size-remaining), wrap)
+	} else {
+		buf := vs.cfg.copyBuffer()
+		_, err = io.CopyBuffer(vs.w, contextReader{ctx, wrap(vs.body)}, *buf)
+		copyBuffers.Put(buf)
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = vs.shortStream()
+	}
 	if err != nil {
-		fmt.Printf("Error creating video stream: %v\n", err)
-		return
+		return err
 	}
-	defer vs.Close()
-
-	if err = vs.Stream(); err != nil {
-		fmt.Printf("Error streaming %v: %v\n", *videourl, err)
-		return
+	if vs.offset+atomic.LoadUint64(&vs.downloaded) < vs.total() {
+		return vs.shortStream()
 	}
+	return nil
 }
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -16,6 +28,8 @@ import (
 const (
 	testSz       = 50000000
 	testFilename = "testout.mkv"
+	// testPartname is where testFilename is streamed to until it completes.
+	testPartname = testFilename + partSuffix
 )
 
 var (
@@ -46,9 +60,22 @@ func TestVideoStreamStream(t *testing.T) {
 		}
 	}()
 
-	if err = vs.Stream(); err != nil {
+	res, err := vs.Stream(context.Background())
+	if err != nil {
 		t.Fatal(err)
 	}
+	if res.BytesWritten != testSz {
+		t.Fatalf("StreamResult reported %v bytes written, wanted %v", res.BytesWritten, testSz)
+	}
+	if res.Bandwidth <= 0 {
+		t.Fatalf("StreamResult reported non-positive bandwidth %v", res.Bandwidth)
+	}
+	if res.Elapsed <= 0 {
+		t.Fatalf("StreamResult reported non-positive elapsed time %v", res.Elapsed)
+	}
+	if !res.Ready {
+		t.Fatal("StreamResult reported the completed video was not ready to play")
+	}
 
 	testf, err := os.Open(testFilename)
 	if err != nil {
@@ -69,6 +96,15 @@ func TestVideoStreamStream(t *testing.T) {
 	}
 }
 
+func TestMain(m *testing.M) {
+	code := m.Run()
+	// Streams that aren't completed leave their state behind to be resumed.
+	removeState(testFilename)
+	removeState(testPartname)
+	os.Remove(testPartname)
+	os.Exit(code)
+}
+
 func TestNewVideoStream(t *testing.T) {
 	os.Remove(testFilename)
 
@@ -98,8 +134,8 @@ func TestNewVideoStream(t *testing.T) {
 	if vs.duration != time.Second {
 		t.Fatal("VideoStream did not set duration")
 	}
-	if _, err := os.Stat(testFilename); os.IsNotExist(err) {
-		t.Fatal("VideoStream did not create outfile")
+	if _, err := os.Stat(testPartname); os.IsNotExist(err) {
+		t.Fatal("VideoStream did not create the .part file")
 	}
 
 	data, err := ioutil.ReadAll(vs.tee)
@@ -110,7 +146,7 @@ func TestNewVideoStream(t *testing.T) {
 		t.Fatal("data in vs.tee did not match testData")
 	}
 
-	testf, err := os.Open(testFilename)
+	testf, err := os.Open(testPartname)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -122,7 +158,1471 @@ func TestNewVideoStream(t *testing.T) {
 		t.Fatal("data in the output file did not match testData")
 	}
 
+	if err := os.Remove(testPartname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamStreamCancel(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData[:testSz/10])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStream(ts.URL, time.Second, testFilename, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	res, err := vs.Stream(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if res.Ready {
+		t.Fatal("StreamResult reported the cancelled video was ready to play")
+	}
+
+	fi, err := os.Stat(testPartname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() == 0 || fi.Size() > testSz/10 {
+		t.Fatalf("expected partial file to remain on disk, got size %v", fi.Size())
+	}
+
+	if err := os.Remove(testPartname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamCancelMethod(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData[:testSz/10])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStream(ts.URL, time.Second, testFilename, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(500*time.Millisecond, vs.Cancel)
+
+	if _, err := vs.Stream(context.Background()); err != ErrCanceled {
+		t.Fatalf("expected %v, got %v", ErrCanceled, err)
+	}
+	vs.Cancel()
+	if err := vs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	vs.Cancel()
+
+	// cancelling before streaming fails immediately.
+	vs, err = NewVideoStream(ts.URL, time.Second, testFilename, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.Cancel()
+	if _, err := vs.Stream(context.Background()); err != ErrCanceled {
+		t.Fatalf("expected %v, got %v", ErrCanceled, err)
+	}
+	vs.Close()
+
+	if err := os.Remove(testPartname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamResume(t *testing.T) {
+	os.Remove(testFilename)
+
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	removeState(testFilename)
+	if err := ioutil.WriteFile(testFilename, testData[:testSz/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	if vs.size != testSz {
+		t.Fatalf("VideoStream created with wrong size, got %v wanted %v\n", vs.size, testSz)
+	}
+	if vs.offset != testSz/2 {
+		t.Fatalf("VideoStream resumed at wrong offset, got %v wanted %v\n", vs.offset, testSz/2)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in the resumed file did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamResumeUnsupported(t *testing.T) {
+	os.Remove(testFilename)
+
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	if err := ioutil.WriteFile(testFilename, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	if vs.offset != 0 {
+		t.Fatalf("expected download to restart, got offset %v", vs.offset)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in the restarted file did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamBandwidthSample(t *testing.T) {
+	os.Remove(testFilename)
+
+	const smallSz = 1000000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(smallSz))
+		w.Write(testData[:smallSz])
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		sampleBytes int64
+		want        uint64
+	}{
+		{0, smallSz},
+		{1000, 1000},
+		{smallSz * 2, smallSz},
+	}
+	for _, test := range tests {
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{SampleBytes: test.sampleBytes, DisableAtomicWrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bw, sampled, err := vs.bandwidth(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sampled != test.want {
+			t.Fatalf("sampled %v bytes with SampleBytes %v, wanted %v", sampled, test.sampleBytes, test.want)
+		}
+		if bw <= 0 {
+			t.Fatalf("expected positive bandwidth, got %v", bw)
+		}
+		if err := vs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamWarmup(t *testing.T) {
+	os.Remove(testFilename)
+
+	const smallSz = 1000000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(smallSz))
+		w.Write(testData[:smallSz])
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		warmupBytes int64
+		warmupTime  time.Duration
+		want        uint64
+	}{
+		{0, 0, 1000},
+		{5000, 0, 6000},
+		{5000, time.Hour, 6000},
+		{smallSz * 2, 0, smallSz},
+		{0, time.Hour, smallSz},
+	}
+	for _, test := range tests {
+		cfg := Config{SampleBytes: 1000, WarmupBytes: test.warmupBytes, WarmupTime: test.warmupTime, DisableAtomicWrite: true}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bw, sampled, err := vs.bandwidth(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sampled != test.want {
+			t.Fatalf("read %v bytes with warmup %v/%v, wanted %v", sampled, test.warmupBytes, test.warmupTime, test.want)
+		}
+		if bw <= 0 {
+			t.Fatalf("expected positive bandwidth, got %v", bw)
+		}
+		if err := vs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamDownloadOnly(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	cfg := Config{DownloadOnly: true, ProbeBandwidth: true, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Bandwidth != 0 || res.BufferTime != 0 || res.Ready {
+		t.Fatalf("expected the download not to be sampled or announced ready, got %+v", res)
+	}
+	if vs.Phase() != PhaseDone {
+		t.Fatalf("expected phase %v, got %v", PhaseDone, vs.Phase())
+	}
+	vs.Close()
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("downloaded file did not match the video")
+	}
 	if err := os.Remove(testFilename); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestVideoStreamMaxFileSize(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	chunked := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chunked {
+			w.Write(testData[:testSz/2])
+			w.(http.Flusher).Flush()
+			w.Write(testData[testSz/2:])
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	cfg := Config{MaxFileSize: testSz - 1, Logger: ioutil.Discard, DisableAtomicWrite: true}
+	_, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected %v for a declared size over the limit, got %v", ErrTooLarge, err)
+	}
+
+	chunked = true
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected %v for a download over the limit, got %v", ErrTooLarge, err)
+	}
+	vs.Close()
+	fi, err := os.Stat(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > cfg.MaxFileSize {
+		t.Fatalf("expected at most %v bytes on disk, got %v", cfg.MaxFileSize, fi.Size())
+	}
+
+	cfg.MaxFileSize = testSz
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamIfModifiedSince(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, modified, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	cfg := Config{IfModifiedSince: true, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+
+	_, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if !errors.Is(err, ErrNotModified) || !errors.Is(err, ErrAlreadyBuffered) {
+		t.Fatalf("expected %v for an unmodified video, got %v", ErrNotModified, err)
+	}
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("expected the output file to be left intact")
+	}
+
+	modified = time.Now().Add(time.Hour)
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatalf("expected a modified video to be downloaded again, got %v", err)
+	}
+	vs.Close()
+}
+
+func TestVideoStreamProbeBandwidth(t *testing.T) {
+	os.Remove(testFilename)
+
+	video := append(testMKV(1000000, 5400000), testData[:testSz/10]...)
+	var probes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=0-999999" {
+			atomic.AddInt32(&probes, 1)
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(video))
+	}))
+	defer ts.Close()
+
+	cfg := Config{SampleBytes: 1000000, ProbeBandwidth: true}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&probes); n != 1 {
+		t.Fatalf("expected one probe request, got %v", n)
+	}
+	if res.Bandwidth <= 0 {
+		t.Fatalf("expected positive bandwidth, got %v", res.Bandwidth)
+	}
+	if res.Duration != 90*time.Minute {
+		t.Fatalf("expected to detect a duration of %v from the probe, got %v", 90*time.Minute, res.Duration)
+	}
+	if res.BytesWritten != uint64(len(video)) {
+		t.Fatalf("StreamResult reported %v bytes written, wanted %v", res.BytesWritten, len(video))
+	}
+	vs.Close()
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, video) {
+		t.Fatal("streamed file did not match the video")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamUnknownSize(t *testing.T) {
+	os.Remove(testFilename)
+
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// flushing before writing forces chunked transfer encoding.
+		w.(http.Flusher).Flush()
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStream(ts.URL, time.Second, testFilename, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	if vs.knownSize {
+		t.Fatal("expected VideoStream to have an unknown size")
+	}
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BufferTime != 0 {
+		t.Fatalf("expected no buffer time for unknown size, got %v", res.BufferTime)
+	}
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in streamed file did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingTransport counts the requests made through it.
+type countingTransport struct {
+	requests int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.requests, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewVideoStreamClient(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	ct := new(countingTransport)
+	cfg := Config{
+		Client:             &http.Client{Transport: ct},
+		DisableAtomicWrite: true,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&ct.requests); n != 1 {
+		t.Fatalf("expected the request to use the configured client, got %v requests", n)
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamStatus(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such video", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err := NewVideoStream(ts.URL, time.Second, testFilename, "", "")
+	se, ok := err.(*statusError)
+	if !ok {
+		t.Fatalf("expected a statusError, got %v", err)
+	}
+	if se.code != http.StatusNotFound {
+		t.Fatalf("expected status code %v, got %v", http.StatusNotFound, se.code)
+	}
+	if !strings.Contains(err.Error(), "no such video") {
+		t.Fatalf("expected the error to include the response body, got %v", err)
+	}
+	if _, err := os.Stat(testFilename); !os.IsNotExist(err) {
+		t.Fatal("VideoStream created an outfile for a failed request")
+	}
+}
+
+func TestNewVideoStreamHeaders(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			http.Error(w, "bad Authorization "+auth, http.StatusUnauthorized)
+			return
+		}
+		if key := r.Header.Get("X-Api-Key"); key != "key" {
+			http.Error(w, "bad X-Api-Key "+key, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		Username: "user",
+		Password: "pass",
+		Headers: map[string]string{
+			"Authorization": "Bearer token",
+			"X-Api-Key":     "key",
+		},
+		DisableAtomicWrite: true,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamUserAgent(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{}, defaultUserAgent},
+		{Config{UserAgent: "player/2.0"}, "player/2.0"},
+		{Config{UserAgent: "player/2.0", Headers: map[string]string{"User-Agent": "header/3.0"}}, "header/3.0"},
+	}
+	for _, test := range tests {
+		vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+		if got != test.want {
+			t.Fatalf("expected User-Agent %q, got %q", test.want, got)
+		}
+	}
+}
+
+func TestNewVideoStreamCookies(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "secret" {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	session := &http.Cookie{Name: "session", Value: "secret"}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.SetCookies(u, []*http.Cookie{session})
+
+	tests := []struct {
+		cfg     Config
+		wantErr bool
+	}{
+		{Config{}, true},
+		{Config{Cookies: []*http.Cookie{session}}, false},
+		{Config{Client: &http.Client{Jar: jar}}, false},
+	}
+	for i, test := range tests {
+		vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, test.cfg)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("test %v: expected error %v, got %v", i, test.wantErr, err)
+		}
+		if err == nil {
+			vs.Close()
+		}
+	}
+}
+
+func TestNewVideoStreamWriter(t *testing.T) {
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := vs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testData) {
+		t.Fatal("data written to the writer did not match testData")
+	}
+}
+
+func TestVideoStreamResponseHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/x-matroska")
+		w.Header().Set("X-Cache", "HIT")
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	h := vs.ResponseHeaders()
+	if got := h.Get("Content-Type"); got != "video/x-matroska" {
+		t.Fatalf("expected Content-Type video/x-matroska, got %q", got)
+	}
+	if got := h.Get("X-Cache"); got != "HIT" {
+		t.Fatalf("expected X-Cache HIT, got %q", got)
+	}
+	h.Set("X-Cache", "MISS")
+	if got := vs.ResponseHeaders().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("expected the headers to be a copy, got X-Cache %q", got)
+	}
+}
+
+func TestVideoStreamChecksum(t *testing.T) {
+	os.Remove(testFilename)
+
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(testData)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		expected string
+		partial  []byte
+		err      error
+	}{
+		{"", nil, nil},
+		{digest, nil, nil},
+		{strings.ToUpper(digest), testData[:testSz/3], nil},
+		{strings.Repeat("0", len(digest)), nil, ErrChecksumMismatch},
+	}
+	for _, test := range tests {
+		os.Remove(testFilename)
+		if test.partial != nil {
+			removeState(testFilename)
+			if err := ioutil.WriteFile(testFilename, test.partial, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		cfg := Config{
+			Resume:             test.partial != nil,
+			ExpectedSHA256:     test.expected,
+			DisableAtomicWrite: true,
+		}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := vs.Stream(context.Background())
+		if !errors.Is(err, test.err) {
+			t.Fatalf("expected %v streaming with digest %q, got %v", test.err, test.expected, err)
+		}
+		if res.SHA256 != digest {
+			t.Fatalf("StreamResult reported digest %v, wanted %v", res.SHA256, digest)
+		}
+		if err := vs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamCreateDirs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", "1000")
+		w.Write(testData[:1000])
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outfile := filepath.Join(dir, "downloads", "2024", testFilename)
+	vs, err := NewVideoStream(ts.URL, time.Second, outfile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outfile + partSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file in the way of the directory can't be replaced.
+	blocked := filepath.Join(outfile+partSuffix, testFilename)
+	_, err = NewVideoStream(ts.URL, time.Second, blocked, "", "")
+	if err == nil || !strings.Contains(err.Error(), "could not create the directory") {
+		t.Fatalf("expected a directory creation error, got %v", err)
+	}
+}
+
+func TestVideoStreamAtomicWrite(t *testing.T) {
+	os.Remove(testFilename)
+	os.Remove(testFilename + partSuffix)
+
+	var cancelAt int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		if cancelAt == 0 {
+			w.Write(testData)
+			return
+		}
+		w.Write(testData[:cancelAt])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	// an interrupted download leaves only the .part file.
+	cancelAt = testSz / 10
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := vs.Stream(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	vs.Close()
+	if _, err := os.Stat(testFilename); !os.IsNotExist(err) {
+		t.Fatalf("expected %v not to exist, got %v", testFilename, err)
+	}
+	if _, err := os.Stat(testFilename + partSuffix); err != nil {
+		t.Fatal(err)
+	}
+
+	// a completed download is renamed into place.
+	cancelAt = 0
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(testFilename + partSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected %v to be renamed, got %v", testFilename+partSuffix, err)
+	}
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in streamed file did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamAtomicWriteDefault(t *testing.T) {
+	os.Remove(testFilename)
+	os.Remove(testPartname)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData[:testSz/2])
+	}))
+	defer ts.Close()
+
+	// each constructor writes atomically unless told otherwise, so a failed
+	// stream never leaves a file at the output path.
+	constructors := map[string]func() (*VideoStream, error){
+		"NewVideoStream": func() (*VideoStream, error) {
+			return NewVideoStream(ts.URL, time.Second, testFilename, "", "")
+		},
+		"NewVideoStreamConfig": func() (*VideoStream, error) {
+			return NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{})
+		},
+		"New": func() (*VideoStream, error) {
+			return New(ts.URL, WithDuration(time.Second), WithOutput(testFilename))
+		},
+	}
+	for name, newStream := range constructors {
+		vs, err := newStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vs.Stream(context.Background()); !errors.Is(err, ErrShortStream) {
+			t.Fatalf("%v: expected %v, got %v", name, ErrShortStream, err)
+		}
+		vs.Close()
+		if _, err := os.Stat(testFilename); !os.IsNotExist(err) {
+			t.Fatalf("%v: expected %v not to exist after a failed stream, got %v", name, testFilename, err)
+		}
+		if err := os.Remove(testPartname); err != nil {
+			t.Fatal(err)
+		}
+		removeState(testPartname)
+	}
+}
+
+func TestNewVideoStreamHead(t *testing.T) {
+	os.Remove(testFilename)
+
+	tests := []struct {
+		// head is the status of the response to HEAD requests.
+		head         int
+		acceptRanges string
+		offset       uint64
+	}{
+		{http.StatusOK, "bytes", testSz / 2},
+		{http.StatusMethodNotAllowed, "", testSz / 2},
+		{http.StatusOK, "none", 0},
+	}
+	for _, test := range tests {
+		var heads int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				atomic.AddInt32(&heads, 1)
+				if test.head == http.StatusOK {
+					w.Header().Set("Accept-Ranges", test.acceptRanges)
+					w.Header().Set("Content-Length", strconv.Itoa(testSz))
+				}
+				w.WriteHeader(test.head)
+				return
+			}
+			http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+		}))
+
+		removeState(testFilename)
+		if err := ioutil.WriteFile(testFilename, testData[:testSz/2], 0666); err != nil {
+			t.Fatal(err)
+		}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+		ts.Close()
+
+		if n := atomic.LoadInt32(&heads); n != 1 {
+			t.Fatalf("HEAD status %v: expected 1 HEAD request, got %v", test.head, n)
+		}
+		if vs.offset != test.offset {
+			t.Fatalf("HEAD status %v, Accept-Ranges %q: expected offset %v, got %v", test.head, test.acceptRanges, test.offset, vs.offset)
+		}
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumable(t *testing.T) {
+	tests := []struct {
+		acceptRanges  string
+		contentLength int64
+		offset        int64
+		resumable     bool
+	}{
+		{"bytes", 1000, 500, true},
+		{"", 1000, 500, true},
+		{"none", 1000, 500, false},
+		{"bytes", 1000, 1000, false},
+		{"bytes", -1, 1000, true},
+	}
+	for _, test := range tests {
+		head := &http.Response{Header: http.Header{}, ContentLength: test.contentLength}
+		head.Header.Set("Accept-Ranges", test.acceptRanges)
+		if r := resumable(head, test.offset); r != test.resumable {
+			t.Fatalf("resumable(%+v, %v) = %v, wanted %v", test, test.offset, r, test.resumable)
+		}
+	}
+}
+
+func TestVideoStreamLogger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	var log syncBuffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, Config{Logger: &log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "ready to play") {
+		t.Fatalf("expected status messages to be written to the Logger, got %q", log.String())
+	}
+}
+
+func TestVideoStreamInstantPlayback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	// a long video downloaded from a fast local server can be played as
+	// soon as the bandwidth has been sampled.
+	var log syncBuffer
+	var ready int32
+	var readyAfter uint64
+	var vs *VideoStream
+	cfg := Config{
+		Logger:      &log,
+		SampleBytes: testSz / 10,
+		OnReady: func(string) {
+			atomic.StoreUint64(&readyAfter, atomic.LoadUint64(&vs.downloaded))
+			atomic.StoreInt32(&ready, 1)
+		},
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, 10*time.Hour, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BufferTime != 0 {
+		t.Fatalf("expected no buffer time, got %v", res.BufferTime)
+	}
+	if !strings.Contains(log.String(), "You can start watching now") || strings.Contains(log.String(), "Buffering") {
+		t.Fatalf("expected to be told to start watching without buffering, got %q", log.String())
+	}
+	if atomic.LoadInt32(&ready) == 0 {
+		t.Fatal("expected the video to be announced as ready")
+	}
+	if n := atomic.LoadUint64(&readyAfter); n >= testSz {
+		t.Fatalf("expected the video to be ready before it was downloaded, got ready after %v bytes", n)
+	}
+}
+
+func TestVideoStreamShortStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData[:testSz/2])
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); !errors.Is(err, ErrShortStream) {
+		t.Fatalf("expected %v, got %v", ErrShortStream, err)
+	}
+}
+
+func TestVideoStreamPreallocate(t *testing.T) {
+	os.Remove(testFilename)
+
+	var short bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		if short {
+			w.Write(testData[:testSz/2])
+			return
+		}
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Preallocate: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != testSz {
+		t.Fatalf("expected preallocated size %v, got %v", testSz, fi.Size())
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	b, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testData) {
+		t.Fatal("streamed file did not match test data")
+	}
+
+	// A failed stream leaves only what was downloaded, so it can be resumed.
+	short = true
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Preallocate: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vs.Stream(context.Background()); !errors.Is(err, ErrShortStream) {
+		t.Fatalf("expected %v, got %v", ErrShortStream, err)
+	}
+	vs.Close()
+	if fi, err = os.Stat(testFilename); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != testSz/2 {
+		t.Fatalf("expected truncated size %v, got %v", testSz/2, fi.Size())
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamNoClobber(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	existing := []byte("a finished download")
+	if err := ioutil.WriteFile(testFilename, existing, 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testFilename)
+
+	for _, atomicWrite := range []bool{false, true} {
+		cfg := Config{NoClobber: true, DisableAtomicWrite: !atomicWrite}
+		if _, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg); !errors.Is(err, ErrOutputExists) {
+			t.Fatalf("AtomicWrite %v: expected %v, got %v", atomicWrite, ErrOutputExists, err)
+		}
+		b, err := ioutil.ReadFile(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, existing) {
+			t.Fatalf("AtomicWrite %v: the existing file was overwritten", atomicWrite)
+		}
+	}
+
+	// resuming the output file continues it rather than overwriting it.
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{NoClobber: true, Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+}
+
+// errCloser is an io.ReadCloser whose Close fails with err.
+type errCloser struct {
+	io.Reader
+	err error
+}
+
+func (ec errCloser) Close() error {
+	return ec.err
+}
+
+func TestVideoStreamCloseErrors(t *testing.T) {
+	f, err := ioutil.TempFile("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// closing the file a second time fails, like a failed flush would.
+	f.Close()
+
+	errBody := errors.New("body close failed")
+	vs := &VideoStream{
+		f:  f,
+		rr: &retryReader{body: errCloser{bytes.NewReader(nil), errBody}},
+	}
+	err = vs.Close()
+	if !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected the file's error to be reported, got %v", err)
+	}
+	if !errors.Is(err, errBody) {
+		t.Fatalf("expected the body's error to be reported, got %v", err)
+	}
+}
+
+func TestVideoStreamOutputPath(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	for _, atomicWrite := range []bool{false, true} {
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{DisableAtomicWrite: !atomicWrite})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vs.Stream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+
+		want, err := filepath.Abs(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := vs.OutputPath(); path != want {
+			t.Fatalf("AtomicWrite %v: expected output path %v, got %v", atomicWrite, want, path)
+		}
+		if size := vs.Size(); size != testSz {
+			t.Fatalf("AtomicWrite %v: expected size %v, got %v", atomicWrite, testSz, size)
+		}
+		if err := os.Remove(testFilename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if path := vs.OutputPath(); path != "" {
+		t.Fatalf("expected no output path for a writer, got %v", path)
+	}
+}
+
+func TestNewVideoStreamResumeChanged(t *testing.T) {
+	os.Remove(testFilename)
+
+	etag := `"v1"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		etag   string
+		offset uint64
+	}{
+		{`"v1"`, testSz / 2},
+		{`"v2"`, 0},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(testFilename, testData[:testSz/2], 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeState(testFilename, streamState{URL: ts.URL, Validator: `"v1"`, Written: testSz / 2}); err != nil {
+			t.Fatal(err)
+		}
+		etag = test.etag
+
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vs.offset != test.offset {
+			t.Fatalf("ETag %v: expected offset %v, got %v", test.etag, test.offset, vs.offset)
+		}
+		if st := readState(testFilename); st == nil || st.Validator != test.etag {
+			t.Fatalf("ETag %v: expected the validator %v to be recorded, got %+v", test.etag, test.etag, st)
+		}
+		if _, err := vs.Stream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+		if st := readState(testFilename); st == nil || !st.Complete || st.ETag != test.etag {
+			t.Fatalf("ETag %v: expected the completed video to be recorded, got %+v", test.etag, st)
+		}
+	}
+
+	removeState(testFilename)
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewVideoStreamMethod(t *testing.T) {
+	const asset = `{"asset":"hackers"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || string(body) != asset {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	if _, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, Config{}); err == nil {
+		t.Fatal("expected a GET request to fail")
+	}
+
+	var buf bytes.Buffer
+	cfg := Config{
+		Method: http.MethodPost,
+		Body:   []byte(asset),
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testData) {
+		t.Fatal("data written to the writer did not match testData")
+	}
+}
+
+// maxWriter records the length of the largest write to it.
+type maxWriter struct {
+	max int
+}
+
+func (mw *maxWriter) Write(p []byte) (int, error) {
+	if len(p) > mw.max {
+		mw.max = len(p)
+	}
+	return len(p), nil
+}
+
+func TestVideoStreamCopyBufferSize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	var mw maxWriter
+	cfg := Config{
+		SampleBytes:    1000,
+		CopyBufferSize: 1024,
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &mw, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if mw.max == 0 || mw.max > cfg.CopyBufferSize {
+		t.Fatalf("expected writes of at most %v bytes, got %v", cfg.CopyBufferSize, mw.max)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("disk full"), exitError},
+		{errUsage, exitUsage},
+		{fmt.Errorf("%w: ftp", ErrUnsupportedScheme), exitUsage},
+		{errInterrupted, exitInterrupted},
+		{&statusError{code: 401, status: "401 Unauthorized"}, exitAuth},
+		{fmt.Errorf("requesting video: %w", &statusError{code: 403, status: "403 Forbidden"}), exitAuth},
+		{&statusError{code: 404, status: "404 Not Found"}, exitError},
+		{&statusError{code: 503, status: "503 Service Unavailable"}, exitNetwork},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, exitNetwork},
+		{ErrShortStream, exitNetwork},
+		{context.DeadlineExceeded, exitError},
+	}
+	for _, test := range tests {
+		if code := exitCode(test.err); code != test.want {
+			t.Fatalf("expected exit code %v for %v, got %v", test.want, test.err, code)
+		}
+	}
+}
+
+func TestVideoStreamDiskFull(t *testing.T) {
+	// writes to /dev/full fail with ENOSPC.
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full is not available")
+	}
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outfile := filepath.Join(dir, testFilename)
+	if err := os.Symlink("/dev/full", outfile); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, outfile, Config{DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	_, err = vs.Stream(context.Background())
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("expected %v, got %v", ErrDiskFull, err)
+	}
+	var dfe *DiskFullError
+	if !errors.As(err, &dfe) || dfe.Path != outfile || dfe.Written != 0 {
+		t.Fatalf("expected a DiskFullError for %v after 0 bytes, got %v", outfile, err)
+	}
+	if _, err := vs.f.Write([]byte{0}); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected the output file to be closed, got %v", err)
+	}
+}
+
+func TestNewVideoStreamAppend(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData[:1000]))
+	}))
+	defer ts.Close()
+
+	cfg := Config{Append: true, Connections: 4, Logger: ioutil.Discard}
+	for i := 0; i < 3; i++ {
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := vs.Stream(context.Background())
+		vs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.BytesWritten != 1000 {
+			t.Fatalf("expected 1000 bytes appended, got %v", res.BytesWritten)
+		}
+	}
+	b, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, bytes.Repeat(testData[:1000], 3)) {
+		t.Fatalf("expected the video to be appended 3 times, got %v bytes", len(b))
+	}
+
+	cfg.Resume = true
+	if _, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg); err == nil {
+		t.Fatal("expected Append to be rejected with Resume")
+	}
+}
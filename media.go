@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// headerSize is the number of bytes at the start of a video captured to
+// detect its duration.
+const headerSize = 4000000
+
+// Matroska element IDs, see https://www.matroska.org/technical/elements.html
+const (
+	ebmlHeaderID    = 0x1A45DFA3
+	segmentID       = 0x18538067
+	infoID          = 0x1549A966
+	timecodeScaleID = 0x2AD7B1
+	durationID      = 0x4489
+	clusterID       = 0x1F43B675
+)
+
+// headerBuffer is an io.Writer capturing the first max bytes written to it.
+// Writes never fail, and bytes beyond max are discarded.
+type headerBuffer struct {
+	buf []byte
+	max int
+}
+
+func (hb *headerBuffer) Write(p []byte) (int, error) {
+	if n := hb.max - len(hb.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		hb.buf = append(hb.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// release discards the captured bytes, and stops capturing any more.
+func (hb *headerBuffer) release() {
+	hb.buf = nil
+	hb.max = 0
+}
+
+// parseDuration detects the duration of an MP4 or Matroska (MKV, WebM) video
+// from the header at the start of the file. It returns false if the format
+// is not recognised or the header does not contain the duration.
+func parseDuration(header []byte) (time.Duration, bool) {
+	if d, ok := mp4Duration(header); ok {
+		return d, true
+	}
+	return mkvDuration(header)
+}
+
+// mp4Duration reads the duration from the movie header (mvhd) box of an MP4
+// file. The movie box must be at the start of the file, as it is for videos
+// optimised for streaming.
+func mp4Duration(b []byte) (time.Duration, bool) {
+	if len(b) < 8 || string(b[4:8]) != "ftyp" {
+		return 0, false
+	}
+	moov, ok := mp4Box(b, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, ok := mp4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 1 {
+		return 0, false
+	}
+
+	var timescale, duration uint64
+	switch version := mvhd[0]; {
+	case version == 0 && len(mvhd) >= 20:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	case version == 1 && len(mvhd) >= 32:
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	default:
+		return 0, false
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return seconds(float64(duration) / float64(timescale))
+}
+
+// mp4Box returns the contents of the first box of type typ in b.
+func mp4Box(b []byte, typ string) ([]byte, bool) {
+	for len(b) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(b))
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of the file.
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return nil, false
+		}
+		if string(b[4:8]) == typ {
+			return b[hdr:size], true
+		}
+		b = b[size:]
+	}
+	return nil, false
+}
+
+// mkvDuration reads the duration from the Info element of a Matroska file.
+func mkvDuration(b []byte) (time.Duration, bool) {
+	id, _, b, ok := ebmlElement(b)
+	if !ok || id != ebmlHeaderID {
+		return 0, false
+	}
+	id, segment, _, ok := ebmlElement(b)
+	if !ok || id != segmentID {
+		return 0, false
+	}
+
+	for len(segment) > 0 {
+		var data []byte
+		id, data, segment, ok = ebmlElement(segment)
+		if !ok || id == clusterID {
+			return 0, false
+		}
+		if id != infoID {
+			continue
+		}
+
+		scale := uint64(1000000)
+		var duration float64
+		for len(data) > 0 {
+			var field []byte
+			id, field, data, ok = ebmlElement(data)
+			if !ok {
+				return 0, false
+			}
+			switch {
+			case id == timecodeScaleID && len(field) <= 8:
+				scale = 0
+				for _, c := range field {
+					scale = scale<<8 | uint64(c)
+				}
+			case id == durationID && len(field) == 4:
+				duration = float64(math.Float32frombits(binary.BigEndian.Uint32(field)))
+			case id == durationID && len(field) == 8:
+				duration = math.Float64frombits(binary.BigEndian.Uint64(field))
+			}
+		}
+		return seconds(duration * float64(scale) / float64(time.Second))
+	}
+	return 0, false
+}
+
+// ebmlElement reads the EBML element at the start of b, returning its ID, its
+// data and the remainder of b. Elements of unknown size or extending past
+// the end of b are truncated to the end of b.
+func ebmlElement(b []byte) (id uint64, data, rest []byte, ok bool) {
+	id, n, ok := ebmlVint(b, false)
+	if !ok {
+		return 0, nil, nil, false
+	}
+	b = b[n:]
+	size, n, ok := ebmlVint(b, true)
+	if !ok {
+		return 0, nil, nil, false
+	}
+	b = b[n:]
+	if size > uint64(len(b)) {
+		return id, b, nil, true
+	}
+	return id, b[:size], b[size:], true
+}
+
+// ebmlVint reads a variable length integer from the start of b, returning
+// its value and length. If mask is set the length marker is removed from the
+// value, as for element sizes; element IDs keep it. A size with all bits set
+// means the size is unknown, and is returned as math.MaxUint64.
+func ebmlVint(b []byte, mask bool) (uint64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	n := bits.LeadingZeros8(b[0]) + 1
+	if len(b) < n {
+		return 0, 0, false
+	}
+	var v uint64
+	for _, c := range b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	if !mask {
+		return v, n, true
+	}
+	v &^= 1 << uint(7*n)
+	if v == 1<<uint(7*n)-1 {
+		return math.MaxUint64, n, true
+	}
+	return v, n, true
+}
+
+// seconds converts a positive number of seconds to a time.Duration.
+func seconds(s float64) (time.Duration, bool) {
+	if !(s > 0) || s > math.MaxInt64/float64(time.Second) {
+		return 0, false
+	}
+	return time.Duration(s * float64(time.Second)), true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// mp4Atom encodes an MP4 box of type typ containing data.
+func mp4Atom(typ string, data ...[]byte) []byte {
+	var payload []byte
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], typ)
+	return append(b, payload...)
+}
+
+// testMP4 encodes the header of an MP4 file with a version 0 mvhd box.
+func testMP4(timescale, duration uint32) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+	ftyp := mp4Atom("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	moov := mp4Atom("moov", mp4Atom("mvhd", mvhd), mp4Atom("trak"))
+	return append(ftyp, moov...)
+}
+
+// ebml encodes an EBML element with the given ID and data.
+func ebml(id uint64, data ...[]byte) []byte {
+	var payload []byte
+	for _, d := range data {
+		payload = append(payload, d...)
+	}
+	var b []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if c := byte(id >> uint(shift)); c != 0 || len(b) > 0 {
+			b = append(b, c)
+		}
+	}
+	// an 8 byte size, which is always large enough.
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(payload)))
+	size[0] = 0x01
+	b = append(b, size...)
+	return append(b, payload...)
+}
+
+// testMKV encodes the header of a Matroska file with the given timecode
+// scale (in nanoseconds) and duration (in timecode scale units).
+func testMKV(scale uint32, duration float64) []byte {
+	scaleBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(scaleBytes, scale)
+	durationBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(durationBytes, math.Float64bits(duration))
+
+	header := ebml(ebmlHeaderID, ebml(0x4282, []byte("matroska")))
+	info := ebml(infoID, ebml(timecodeScaleID, scaleBytes), ebml(durationID, durationBytes))
+	// a segment of unknown size, as written by live encoders.
+	segment := append([]byte{0x18, 0x53, 0x80, 0x67, 0xFF}, ebml(0x114D9B74)...)
+	segment = append(segment, info...)
+	segment = append(segment, ebml(clusterID, make([]byte, 100))...)
+	return append(header, segment...)
+}
+
+func TestParseDuration(t *testing.T) {
+	moovAtEnd := append(mp4Atom("ftyp"), mp4Atom("mdat", make([]byte, 100))...)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   time.Duration
+		ok     bool
+	}{
+		{"mp4", testMP4(1000, 5400000), 90 * time.Minute, true},
+		{"truncated mp4", testMP4(1000, 5400000)[:50], 0, false},
+		{"mp4 without moov", moovAtEnd, 0, false},
+		{"mkv", testMKV(1000000, 5400000), 90 * time.Minute, true},
+		{"mkv with microsecond timecodes", testMKV(1000, 5400000000), 90 * time.Minute, true},
+		{"truncated mkv", testMKV(1000000, 5400000)[:40], 0, false},
+		{"random", testData[:1000], 0, false},
+		{"empty", nil, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseDuration(test.header)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%v: got (%v, %v), wanted (%v, %v)", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestHeaderBuffer(t *testing.T) {
+	hb := &headerBuffer{max: 5}
+	for _, s := range []string{"abc", "def", "ghi"} {
+		if n, err := hb.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = (%v, %v)", s, n, err)
+		}
+	}
+	if string(hb.buf) != "abcde" {
+		t.Fatalf("expected headerBuffer to capture %q, got %q", "abcde", hb.buf)
+	}
+}
+
+func TestVideoStreamDetectDuration(t *testing.T) {
+	os.Remove(testFilename)
+
+	video := append(testMKV(1000000, 5400000), testData[:testSz/10]...)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(video))
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Duration != 90*time.Minute {
+		t.Fatalf("expected to detect a duration of %v, got %v", 90*time.Minute, res.Duration)
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
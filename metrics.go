@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// metricsShutdownTimeout is how long the metrics server waits for in-flight
+// scrapes when shut down.
+const metricsShutdownTimeout = 5 * time.Second
+
+// metric is a single sample in the Prometheus text exposition format.
+type metric struct {
+	name  string
+	typ   string
+	help  string
+	value float64
+}
+
+// writeMetrics writes the progress of the VideoStream to w in the Prometheus
+// text exposition format. It is safe to call while streaming.
+func (vs *VideoStream) writeMetrics(w io.Writer) error {
+	n, bw := vs.progress()
+	// the buffer time is infinite while nothing is arriving.
+	d := vs.bufferTime(n, bw)
+	bt := d.Seconds()
+	if d == math.MaxInt64 {
+		bt = math.Inf(1)
+	}
+	var complete, failed float64
+	select {
+	case <-vs.finished:
+		if vs.streamErr == nil {
+			complete = 1
+		} else {
+			failed = 1
+		}
+	default:
+	}
+
+	metrics := []metric{
+		{"autobuffer_downloaded_bytes_total", "counter", "Bytes of the video on disk, including any resumed offset.", float64(n)},
+		{"autobuffer_size_bytes", "gauge", "Size of the video in bytes, or 0 if unknown.", float64(vs.total())},
+		{"autobuffer_bandwidth_bytes_per_second", "gauge", "Current download bandwidth.", bw},
+		{"autobuffer_buffer_time_seconds", "gauge", "Time until the video can be safely played, zero or negative once it can be.", bt},
+		{"autobuffer_retries_total", "counter", "Retries after transient network errors.", float64(vs.retryCount())},
+		{"autobuffer_ready", "gauge", "Whether the video is ready to play.", float64(atomic.LoadInt32(&vs.ready))},
+		{"autobuffer_complete", "gauge", "Whether the video has been streamed successfully.", complete},
+		{"autobuffer_failed", "gauge", "Whether streaming the video failed.", failed},
+	}
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", m.name, m.help, m.name, m.typ, m.name, strconv.FormatFloat(m.value, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveMetrics serves the metrics of vs at /metrics over HTTP on addr, until
+// the returned function is called to shut the server down.
+func serveMetrics(addr string, vs *VideoStream) (func() error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		vs.writeMetrics(w)
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}, nil
+}
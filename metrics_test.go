@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, Config{SampleBytes: 1000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	var buf bytes.Buffer
+	if err := vs.writeMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE autobuffer_downloaded_bytes_total counter\nautobuffer_downloaded_bytes_total 0\n",
+		"autobuffer_size_bytes " + strconv.Itoa(testSz) + "\n",
+		"autobuffer_buffer_time_seconds +Inf\n",
+		"autobuffer_complete 0\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected metrics before streaming to contain %q, got %q", want, buf.String())
+		}
+	}
+
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := vs.writeMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"autobuffer_downloaded_bytes_total " + strconv.Itoa(testSz) + "\n",
+		"autobuffer_retries_total 0\n",
+		"autobuffer_ready 1\n",
+		"autobuffer_complete 1\n",
+		"autobuffer_failed 0\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected metrics after streaming to contain %q, got %q", want, buf.String())
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	vs := &VideoStream{finished: make(chan struct{}), rr: &retryReader{}}
+	stop, err := serveMetrics("127.0.0.1:0", vs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Option configures a VideoStream constructed by New.
+type Option func(*options)
+
+// options collects the Options passed to New.
+type options struct {
+	ctx      context.Context
+	duration time.Duration
+	outfile  string
+	w        io.Writer
+	sink     Sink
+	cfg      Config
+}
+
+// WithContext binds the HTTP requests of the VideoStream to ctx, as with
+// NewVideoStreamContext.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) { o.ctx = ctx }
+}
+
+// WithDuration sets the duration of the video, for videos whose duration
+// can't be detected from their header.
+func WithDuration(d time.Duration) Option {
+	return func(o *options) { o.duration = d }
+}
+
+// WithOutput streams the video to the file at path.
+func WithOutput(path string) Option {
+	return func(o *options) { o.outfile, o.w, o.sink = path, nil, nil }
+}
+
+// WithWriter streams the video to w instead of a file, as with
+// NewVideoStreamWriter.
+func WithWriter(w io.Writer) Option {
+	return func(o *options) { o.outfile, o.w, o.sink = "", w, nil }
+}
+
+// WithSink streams the video to a writer named name created by sink instead
+// of a file, as with NewVideoStreamSink.
+func WithSink(sink Sink, name string) Option {
+	return func(o *options) { o.outfile, o.w, o.sink = name, nil, sink }
+}
+
+// WithBasicAuth authenticates with the server using HTTP Basic Auth.
+func WithBasicAuth(username, password string) Option {
+	return func(o *options) { o.cfg.Username, o.cfg.Password = username, password }
+}
+
+// WithClient sets the Config.Client used to make requests.
+func WithClient(c *http.Client) Option {
+	return func(o *options) { o.cfg.Client = c }
+}
+
+// WithFudgeFactor sets the Config.FudgeFactor.
+func WithFudgeFactor(f float64) Option {
+	return func(o *options) { o.cfg.FudgeFactor = f }
+}
+
+// WithConfig replaces the Config of the VideoStream with cfg, for settings
+// without an Option of their own. Options following it modify cfg.
+func WithConfig(cfg Config) Option {
+	return func(o *options) { o.cfg = cfg }
+}
+
+// New constructs a new video stream from an http URL, configured by opts.
+// One of WithOutput, WithWriter or WithSink must be given.
+func New(url string, opts ...Option) (*VideoStream, error) {
+	o := options{ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.w != nil {
+		return NewVideoStreamWriter(o.ctx, url, o.duration, o.w, o.cfg)
+	}
+	if o.sink != nil {
+		return NewVideoStreamSink(o.ctx, url, o.duration, o.outfile, o.sink, o.cfg)
+	}
+	if o.outfile == "" {
+		return nil, errors.New("no output given to stream the video to")
+	}
+	return NewVideoStreamConfig(o.ctx, url, o.duration, o.outfile, o.cfg)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	vs, err := New(ts.URL,
+		WithConfig(Config{SampleBytes: 1000}),
+		WithContext(context.Background()),
+		WithDuration(time.Minute),
+		WithOutput(testFilename),
+		WithBasicAuth("user", "pass"),
+		WithClient(ts.Client()),
+		WithFudgeFactor(1.5),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if vs.duration != time.Minute || vs.name != testPartname {
+		t.Fatalf("expected duration %v and output %v, got %v and %v", time.Minute, testPartname, vs.duration, vs.name)
+	}
+	if vs.cfg.FudgeFactor != 1.5 || vs.cfg.SampleBytes != 1000 {
+		t.Fatalf("expected the configured FudgeFactor and SampleBytes, got %+v", vs.cfg)
+	}
+	vs.Close()
+	os.Remove(testPartname)
+
+	var buf bytes.Buffer
+	vs, err = New(ts.URL, WithBasicAuth("user", "pass"), WithWriter(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testData) {
+		t.Fatal("streamed data did not match the video")
+	}
+
+	if _, err := New(ts.URL); err == nil {
+		t.Fatal("expected an error without an output")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelChunkSize is the number of bytes requested at a time by each
+// connection of a parallel download. Chunks are requested in order, so the
+// video is downloaded from the start even when using several connections.
+const parallelChunkSize = 8000000
+
+// chunk is a range of bytes [start, end) of the video.
+type chunk struct {
+	start, end int64
+}
+
+// parallel reports whether the VideoStream should download over several
+// connections.
+func (vs *VideoStream) parallel() bool {
+	if vs.cfg.Connections <= 1 || vs.f == nil || !vs.knownSize {
+		return false
+	}
+	// Ranges of a compressed video can't be decoded independently.
+	if contentEncoding(vs.res) != "" {
+		return false
+	}
+	if vs.head != nil && vs.head.Header.Get("Accept-Ranges") == "bytes" {
+		return true
+	}
+	return vs.res.StatusCode == http.StatusPartialContent || vs.res.Header.Get("Accept-Ranges") == "bytes"
+}
+
+// copyParallel downloads the video from start to the end, writing it to the
+// output file. The video is split into chunks which are downloaded by
+// Config.Connections workers, each reading through wrap.
+func (vs *VideoStream) copyParallel(ctx context.Context, start int64, wrap func(io.Reader) io.Reader) error {
+	// The sampled connection isn't used to download the remainder.
+	vs.rr.Close()
+
+	// The output file may be opened with O_APPEND when resuming, which
+	// precludes WriteAt, so write through a separate handle.
+	f, err := os.OpenFile(vs.name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := newSyncer(f, vs.cfg)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan chunk)
+	go func() {
+		defer close(chunks)
+		for c := (chunk{start, start}); c.start < int64(vs.size); c.start = c.end {
+			c.end = c.start + parallelChunkSize
+			if c.end > int64(vs.size) {
+				c.end = int64(vs.size)
+			}
+			select {
+			case chunks <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for i := 0; i < vs.cfg.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := vs.cfg.copyBuffer()
+			defer copyBuffers.Put(buf)
+			for c := range chunks {
+				if err := vs.downloadChunk(ctx, f, s, c, wrap, *buf); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// The chunks were written out of order, so the digest is recomputed
+	// from the finished file.
+	vs.hash.Reset()
+	return readPrefix(vs.hash, vs.name, int64(vs.size))
+}
+
+// downloadChunk downloads c, writing it at the corresponding offset of f
+// through buf, synced by s.
+func (vs *VideoStream) downloadChunk(ctx context.Context, f *os.File, s *syncer, c chunk, wrap func(io.Reader) io.Reader, buf []byte) error {
+	rr := &retryReader{
+		ctx:       ctx,
+		url:       vs.url,
+		cfg:       &vs.cfg,
+		offset:    c.start,
+		end:       c.end,
+		validator: vs.rr.validator,
+		gate:      &vs.gate,
+	}
+	body, err := rr.resume()
+	if err != nil {
+		return err
+	}
+	rr.body = body
+	defer func() {
+		rr.Close()
+		atomic.AddInt64(&vs.retries, atomic.LoadInt64(&rr.retries))
+	}()
+
+	r := wrap(&countingReader{r: vs.throttle(rr), n: &vs.downloaded})
+	n, err := io.CopyBuffer(s.writer(io.NewOffsetWriter(f, c.start)), r, buf)
+	if err != nil {
+		return err
+	}
+	if n != c.end-c.start {
+		return fmt.Errorf("downloaded %v bytes of the chunk at byte %v, wanted %v", n, c.start, c.end-c.start)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamParallel(t *testing.T) {
+	os.Remove(testFilename)
+
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranges, 1)
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	// resume a partial download to check that the parallel writes land at
+	// the right offsets of a file opened for appending.
+	removeState(testFilename)
+	if err := ioutil.WriteFile(testFilename, testData[:testSz/10], 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Resume:             true,
+		SampleBytes:        1000000,
+		Connections:        4,
+		DisableAtomicWrite: true,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&ranges); n < int32(cfg.Connections) {
+		t.Fatalf("expected the download to be split into chunks, got %v range requests", n)
+	}
+	if res.BytesWritten != testSz-testSz/10 {
+		t.Fatalf("StreamResult reported %v bytes written, wanted %v", res.BytesWritten, testSz-testSz/10)
+	}
+	sum := sha256.Sum256(testData)
+	if res.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatal("StreamResult reported the wrong digest")
+	}
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in the parallel downloaded file did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// gate blocks reads from a VideoStream's connections while it is paused.
+type gate struct {
+	mu sync.Mutex
+	// resumed is closed when the VideoStream is resumed, and is nil while
+	// it isn't paused.
+	resumed chan struct{}
+}
+
+// pause closes the gate, returning false if it was already closed.
+func (g *gate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		return false
+	}
+	g.resumed = make(chan struct{})
+	return true
+}
+
+// resume opens the gate, returning false if it was already open.
+func (g *gate) resume() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		return false
+	}
+	close(g.resumed)
+	g.resumed = nil
+	return true
+}
+
+// paused reports whether the gate is closed.
+func (g *gate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
+}
+
+// wait blocks until the gate is open or ctx is done.
+func (g *gate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause stops reading the video until Resume is called, without closing the
+// connection, which is kept alive for as long as the server allows. The
+// buffer time isn't recomputed while paused. It is safe to call from any
+// goroutine while Stream is running.
+func (vs *VideoStream) Pause() {
+	vs.gate.pause()
+}
+
+// Resume continues reading a paused video. The current bandwidth is measured
+// afresh, since no bytes were read while paused.
+func (vs *VideoStream) Resume() {
+	if vs.gate.resume() {
+		vs.rate.reset()
+	}
+}
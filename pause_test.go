@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamPause(t *testing.T) {
+	const chunkSz = 1000000
+	const chunks = 10
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(chunkSz*chunks))
+		for i := 0; i < chunks; i++ {
+			w.Write(testData[i*chunkSz : (i+1)*chunkSz])
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &buf, Config{SampleBytes: chunkSz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := vs.Stream(context.Background())
+		errs <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	vs.Pause()
+	vs.Pause()
+	// a read in progress when paused may complete.
+	time.Sleep(100 * time.Millisecond)
+	paused := atomic.LoadUint64(&vs.downloaded)
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadUint64(&vs.downloaded); n != paused {
+		t.Fatalf("read %v bytes while paused", n-paused)
+	}
+	vs.Resume()
+	vs.Resume()
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testData[:chunkSz*chunks]) {
+		t.Fatal("data written to the writer did not match testData")
+	}
+}
+
+func TestVideoStreamPauseCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, &bytes.Buffer{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	// a paused stream can still be cancelled.
+	vs.Pause()
+	time.AfterFunc(100*time.Millisecond, vs.Cancel)
+	if _, err := vs.Stream(context.Background()); err != ErrCanceled {
+		t.Fatalf("expected %v, got %v", ErrCanceled, err)
+	}
+}
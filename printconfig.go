@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// effectiveConfig is the configuration printed by -print-config, once
+// defaults have been applied. Credentials are reduced to whether they are
+// set, and headers and cookies to their names, so that the output can be
+// shared without leaking secrets.
+type effectiveConfig struct {
+	URL      string `json:"url"`
+	Output   string `json:"output,omitempty"`
+	Duration string `json:"duration"`
+
+	Method         string            `json:"method"`
+	UserAgent      string            `json:"user_agent"`
+	BasicAuth      bool              `json:"basic_auth"`
+	Headers        []string          `json:"headers,omitempty"`
+	Cookies        []string          `json:"cookies,omitempty"`
+	ConnectTimeout string            `json:"connect_timeout"`
+	Timeout        string            `json:"timeout"`
+	DisableHTTP2   bool              `json:"disable_http2"`
+	PreferIPv4     bool              `json:"prefer_ipv4"`
+	PreferIPv6     bool              `json:"prefer_ipv6"`
+	HostOverrides  map[string]string `json:"host_overrides,omitempty"`
+	PinnedCert     string            `json:"pinned_cert_sha256,omitempty"`
+	AllowedHosts   []string          `json:"allowed_hosts,omitempty"`
+
+	SampleBytes         int64   `json:"sample_bytes"`
+	ProbeRounds         int     `json:"probe_rounds"`
+	WarmupBytes         int64   `json:"warmup_bytes"`
+	WarmupTime          string  `json:"warmup_time"`
+	ProbeBandwidth      bool    `json:"probe_bandwidth"`
+	FudgeFactor         float64 `json:"fudge_factor"`
+	StartupMargin       string  `json:"startup_margin"`
+	PlaybackBitrate     int64   `json:"playback_bitrate"`
+	MinBufferPercent    float64 `json:"min_buffer_percent"`
+	MaxBytesPerSecond   int64   `json:"max_bytes_per_second"`
+	ReadyBytesPerSecond int64   `json:"ready_bytes_per_second"`
+	DownloadOnly        bool    `json:"download_only"`
+
+	Connections   int    `json:"connections"`
+	MaxRetries    int    `json:"max_retries"`
+	RetryDeadline string `json:"retry_deadline"`
+	RetryBackoff  string `json:"retry_backoff"`
+	StallTimeout  string `json:"stall_timeout"`
+
+	Resume            bool   `json:"resume"`
+	ResumeVerifyBytes int64  `json:"resume_verify_bytes"`
+	Append            bool   `json:"append"`
+	IfModifiedSince   bool   `json:"if_modified_since"`
+	AtomicWrite       bool   `json:"atomic_write"`
+	Preallocate       bool   `json:"preallocate"`
+	NoClobber         bool   `json:"no_clobber"`
+	CompressOutput    bool   `json:"compress_output"`
+	StartOffset       int64  `json:"start_offset,omitempty"`
+	StartTime         string `json:"start_time,omitempty"`
+	MaxFileSize       int64  `json:"max_file_size"`
+	SyncBytes         int64  `json:"sync_bytes"`
+	SyncInterval      string `json:"sync_interval"`
+	WriteBufferSize   int    `json:"write_buffer_size"`
+	ExpectedSHA256    string `json:"sha256,omitempty"`
+	WebhookURL        string `json:"webhook_url,omitempty"`
+}
+
+// printConfig writes the configuration streaming the video at videourl to
+// output would use as indented JSON to w. output is empty if the video is
+// only being estimated. connectTimeout and timeout are those of the command
+// line, which aren't part of cfg.
+func printConfig(w io.Writer, videourl, output string, duration time.Duration, cfg Config, connectTimeout, timeout time.Duration) error {
+	// Invalid settings are reported once streaming begins, so the
+	// configuration is printed as far as it could be resolved.
+	cfg.setDefaults()
+	username, password := credentials(videourl, cfg.Username, cfg.Password)
+	ec := effectiveConfig{
+		URL:      redactURL(videourl),
+		Output:   output,
+		Duration: duration.String(),
+
+		Method:         cfg.Method,
+		UserAgent:      cfg.UserAgent,
+		BasicAuth:      username != "" || password != "",
+		ConnectTimeout: connectTimeout.String(),
+		Timeout:        timeout.String(),
+		DisableHTTP2:   cfg.DisableHTTP2,
+		PreferIPv4:     cfg.PreferIPv4,
+		PreferIPv6:     cfg.PreferIPv6,
+		HostOverrides:  cfg.HostOverrides,
+		PinnedCert:     cfg.PinnedCertSHA256,
+		AllowedHosts:   cfg.AllowedHosts,
+
+		SampleBytes:         cfg.SampleBytes,
+		ProbeRounds:         cfg.ProbeRounds,
+		WarmupBytes:         cfg.WarmupBytes,
+		WarmupTime:          cfg.WarmupTime.String(),
+		ProbeBandwidth:      cfg.ProbeBandwidth,
+		FudgeFactor:         cfg.FudgeFactor,
+		StartupMargin:       cfg.StartupMargin.String(),
+		PlaybackBitrate:     cfg.PlaybackBitrate,
+		MinBufferPercent:    cfg.MinBufferPercent,
+		MaxBytesPerSecond:   cfg.MaxBytesPerSecond,
+		ReadyBytesPerSecond: cfg.ReadyBytesPerSecond,
+		DownloadOnly:        cfg.DownloadOnly,
+
+		Connections:   cfg.Connections,
+		MaxRetries:    cfg.MaxRetries,
+		RetryDeadline: cfg.RetryDeadline.String(),
+		RetryBackoff:  cfg.RetryBackoff.String(),
+		StallTimeout:  cfg.StallTimeout.String(),
+
+		Resume:            cfg.Resume,
+		ResumeVerifyBytes: cfg.ResumeVerifyBytes,
+		Append:            cfg.Append,
+		IfModifiedSince:   cfg.IfModifiedSince,
+		AtomicWrite:       !cfg.DisableAtomicWrite,
+		Preallocate:       cfg.Preallocate,
+		NoClobber:         cfg.NoClobber,
+		CompressOutput:    cfg.compressOutput(output),
+		StartOffset:       cfg.StartOffset,
+		MaxFileSize:       cfg.MaxFileSize,
+		SyncBytes:         cfg.SyncBytes,
+		SyncInterval:      cfg.SyncInterval.String(),
+		WriteBufferSize:   cfg.WriteBufferSize,
+		ExpectedSHA256:    cfg.ExpectedSHA256,
+		WebhookURL:        redactURL(cfg.WebhookURL),
+	}
+	if cfg.StartTime > 0 {
+		ec.StartTime = cfg.StartTime.String()
+	}
+	for name := range cfg.Headers {
+		ec.Headers = append(ec.Headers, name)
+	}
+	sort.Strings(ec.Headers)
+	for _, c := range cfg.Cookies {
+		ec.Cookies = append(ec.Cookies, c.Name)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ec)
+}
+
+// redactURL returns rawurl with any password it holds replaced by "xxxxx".
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	return u.Redacted()
+}
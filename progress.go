@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cheggaaa/pb"
+)
+
+const (
+	// progressInterval is how often a VideoStream's ProgressFunc is called
+	// and its buffer time recomputed while streaming.
+	progressInterval = 250 * time.Millisecond
+
+	// bandwidthWindow is the length of the sliding window over which the
+	// current bandwidth is measured while streaming.
+	bandwidthWindow = 5 * time.Second
+)
+
+// Phase is the stage of streaming a VideoStream is in.
+type Phase int32
+
+const (
+	// PhaseSampling is the initial phase, in which the bandwidth is
+	// sampled.
+	PhaseSampling Phase = iota
+	// PhaseBuffering is the phase in which the video is downloading but not
+	// yet ready to play.
+	PhaseBuffering
+	// PhaseReady is the phase in which the video is ready to play, while
+	// the remainder downloads.
+	PhaseReady
+	// PhaseDone is the phase after the whole video has been downloaded.
+	PhaseDone
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseSampling:
+		return "sampling"
+	case PhaseBuffering:
+		return "buffering"
+	case PhaseReady:
+		return "ready"
+	case PhaseDone:
+		return "done"
+	}
+	return fmt.Sprintf("Phase(%d)", int32(p))
+}
+
+// Phase returns the current phase of the VideoStream. It is safe to call
+// while streaming.
+func (vs *VideoStream) Phase() Phase {
+	return Phase(atomic.LoadInt32(&vs.phase))
+}
+
+// setPhase moves the VideoStream to phase p.
+func (vs *VideoStream) setPhase(p Phase) {
+	atomic.StoreInt32(&vs.phase, int32(p))
+}
+
+// countingReader wraps an io.Reader, atomically adding the number of bytes
+// read to n.
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(cr.n, uint64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to w in n, which is updated
+// atomically.
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.n, uint64(n))
+	return n, err
+}
+
+// rateSample is the number of bytes downloaded at a point in time.
+type rateSample struct {
+	t time.Time
+	n uint64
+}
+
+// rateWindow measures bandwidth over a sliding window of time.
+type rateWindow struct {
+	mu      sync.Mutex
+	window  time.Duration
+	samples []rateSample
+}
+
+// observe samples the byte counter n at time now, returning its value and the bandwidth
+// over the window.
+func (rw *rateWindow) observe(now time.Time, n *uint64) (uint64, float64, bool) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	count := atomic.LoadUint64(n)
+	rw.add(now, count)
+	bw, ok := rw.rate()
+	return count, bw, ok
+}
+
+// reset discards the samples recorded so far.
+func (rw *rateWindow) reset() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.samples = nil
+}
+
+// add records that n bytes had been downloaded at time t, discarding samples
+// that have fallen out of the window. The caller must hold mu.
+func (rw *rateWindow) add(t time.Time, n uint64) {
+	rw.samples = append(rw.samples, rateSample{t, n})
+	i := 0
+	for i < len(rw.samples)-2 && t.Sub(rw.samples[i].t) > rw.window {
+		i++
+	}
+	rw.samples = rw.samples[i:]
+}
+
+// rate returns the bandwidth (in bytes per second) over the window, and
+// false if too few samples have been recorded to measure it. The caller must
+// hold mu.
+func (rw *rateWindow) rate() (float64, bool) {
+	if len(rw.samples) < 2 {
+		return 0, false
+	}
+	first, last := rw.samples[0], rw.samples[len(rw.samples)-1]
+	elapsed := last.t.Sub(first.t).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return float64(last.n-first.n) / elapsed, true
+}
+
+// progress returns the number of bytes on disk, including any resumed
+// offset, and the current bandwidth (in bytes per second). The bandwidth is
+// measured over the last few seconds, or since Stream was called if it has
+// only just started.
+func (vs *VideoStream) progress() (uint64, float64) {
+	n, bw, ok := vs.rate.observe(vs.cfg.clock().Now(), &vs.downloaded)
+	if !ok {
+		if elapsed := vs.elapsed().Seconds(); elapsed > 0 {
+			bw = float64(n) / elapsed
+		}
+	}
+	return vs.offset + n, bw
+}
+
+// elapsed returns the time since Stream was called, or zero if it hasn't
+// been.
+func (vs *VideoStream) elapsed() time.Duration {
+	started := atomic.LoadInt64(&vs.started)
+	if started == 0 {
+		return 0
+	}
+	return vs.cfg.clock().Now().Sub(time.Unix(0, started))
+}
+
+// Stats returns the number of bytes written so far by Stream, excluding any
+// resumed offset, and the current bandwidth in bytes per second. It is safe
+// to call from any goroutine, including while Stream is running.
+func (vs *VideoStream) Stats() (bytesWritten uint64, currentBps float64) {
+	downloaded, bw := vs.progress()
+	return downloaded - vs.offset, bw
+}
+
+// bufferTime returns how long the user should wait before playing the
+// video, given that downloaded bytes are on disk and the bandwidth is bw.
+func (vs *VideoStream) bufferTime(downloaded uint64, bw float64) time.Duration {
+	return vs.cfg.bufferTime(vs.total(), downloaded, vs.bandwidthSamples(bw), vs.duration)
+}
+
+// bufferTime returns how long the user should wait before playing a video of
+// the given size and duration, given that downloaded bytes are on disk and
+// the bandwidth samples, the last being the current bandwidth. With
+// MinBufferPercent set, that is how long until the percentage of the video is
+// on disk, regardless of its duration.
+func (cfg *Config) bufferTime(size, downloaded uint64, samples []float64, duration time.Duration) time.Duration {
+	if cfg.MinBufferPercent > 0 {
+		size = uint64(float64(size) * cfg.MinBufferPercent / 100)
+		if downloaded >= size {
+			return 0
+		}
+		return bufferTime(size-downloaded, cfg.limitBandwidth(samples[len(samples)-1]), 0, 1)
+	}
+	var remaining uint64
+	if downloaded < size {
+		remaining = size - downloaded
+	}
+	return cfg.safeBufferTime(remaining, duration, samples)
+}
+
+// addStartupMargin returns the buffer time bt extended by StartupMargin,
+// which runs from when the video would otherwise be ready. It stays
+// math.MaxInt64 if nothing is arriving.
+func (cfg *Config) addStartupMargin(bt time.Duration) time.Duration {
+	if cfg.StartupMargin <= 0 {
+		return bt
+	}
+	if bt < 0 {
+		bt = 0
+	}
+	if bt > math.MaxInt64-cfg.StartupMargin {
+		return math.MaxInt64
+	}
+	return bt + cfg.StartupMargin
+}
+
+// playbackDuration returns how long a video of size bytes and the given
+// duration plays for. With PlaybackBitrate set, that is how long playback
+// takes to consume size bytes at the bitrate.
+func (cfg *Config) playbackDuration(size uint64, duration time.Duration) time.Duration {
+	if cfg.PlaybackBitrate <= 0 {
+		return duration
+	}
+	return time.Duration(float64(size) / float64(cfg.PlaybackBitrate) * float64(time.Second))
+}
+
+// downloadTime returns how long the rest of the video will take to download,
+// given that downloaded bytes are on disk and the bandwidth is bw.
+func (vs *VideoStream) downloadTime(downloaded uint64, bw float64) time.Duration {
+	var remaining uint64
+	if size := vs.total(); downloaded < size {
+		remaining = size - downloaded
+	}
+	return bufferTime(remaining, vs.cfg.limitBandwidth(bw), 0, 1)
+}
+
+// eta describes how long until the video is ready to play, if it isn't
+// already, and how long until it has completely downloaded, given that
+// downloaded bytes are on disk and the bandwidth is bw.
+func (vs *VideoStream) eta(downloaded uint64, bw float64) string {
+	complete := "complete in " + formatETA(vs.downloadTime(downloaded, bw))
+	if atomic.LoadInt32(&vs.ready) == 1 {
+		return complete
+	}
+	return "ready in " + formatETA(vs.bufferTime(downloaded, bw)) + ", " + complete
+}
+
+// formatETA formats d rounded to the second, such as "3m12s", or "unknown"
+// if nothing is arriving.
+func formatETA(d time.Duration) string {
+	if d == math.MaxInt64 {
+		return "unknown"
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d.Round(time.Second).String()
+}
+
+// reportETA shows the eta after the progress bar every interval, since the
+// bandwidth may change, until done is closed.
+func (vs *VideoStream) reportETA(bar *pb.ProgressBar, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		n, bw := vs.progress()
+		bar.Postfix(" " + vs.eta(n, bw))
+	}
+}
+
+// bufferTime returns how long the user should wait before playing a video of
+// the given duration, with remaining bytes left to download at bandwidth bw.
+// The download time is overestimated by fudge.
+func bufferTime(remaining uint64, bw float64, duration time.Duration, fudge float64) time.Duration {
+	if remaining == 0 {
+		return -duration
+	}
+	if bw <= 0 || math.IsNaN(bw) {
+		// nothing is arriving, so there's no telling when the video
+		// will be ready.
+		return math.MaxInt64
+	}
+	downloadTime := (float64(remaining) / bw) * fudge
+	wait := (downloadTime - duration.Seconds()) * float64(time.Second)
+	if wait >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(wait)
+}
+
+// reportProgress calls the ProgressFunc every interval until the returned
+// function is called. Stopping the report calls the ProgressFunc one final
+// time, so that callers observe the completed download.
+func (vs *VideoStream) reportProgress(interval time.Duration) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, bw := vs.progress()
+				vs.cfg.ProgressFunc(n, vs.total(), bw)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		n, bw := vs.progress()
+		vs.cfg.ProgressFunc(n, vs.total(), bw)
+	}
+}
+
+// awaitReady recomputes the buffer time every interval using the current
+// bandwidth, announcing that the video is ready to play once the remaining
+// download will finish before playback does, and StartupMargin has passed
+// since. It returns when the video is ready or done is closed.
+func (vs *VideoStream) awaitReady(interval time.Duration, done <-chan struct{}) {
+	if atomic.LoadInt32(&vs.ready) == 1 {
+		return
+	}
+	clock := vs.cfg.clock()
+	// settled is when the download was first found to outpace playback,
+	// from which the StartupMargin runs.
+	var settled time.Time
+	for {
+		select {
+		case <-clock.After(interval):
+		case <-done:
+			return
+		}
+		if vs.gate.paused() {
+			vs.pauseSampling()
+			continue
+		}
+
+		n, bw := vs.progress()
+		bt := vs.bufferTime(n, bw)
+		vs.recordProgress(n)
+		if vs.cfg.StartupMargin > 0 {
+			if bt > 0 {
+				settled = time.Time{}
+			} else {
+				if settled.IsZero() {
+					settled = clock.Now()
+				}
+				bt = vs.cfg.StartupMargin - clock.Now().Sub(settled)
+			}
+		}
+		if vs.cfg.BufferTimeFunc != nil {
+			vs.cfg.BufferTimeFunc(bt)
+		}
+		if bt <= 0 {
+			// Streaming may have ended, perhaps in failure, while the
+			// buffer time was computed.
+			select {
+			case <-done:
+			default:
+				vs.announceReady()
+			}
+			return
+		}
+	}
+}
+
+// underrunWait returns how long playback started when the video was
+// announced as ready must pause for the download to stay ahead of it, given
+// that n bytes have been downloaded at bw bytes per second, or zero if it
+// needn't. It is math.MaxInt64 if nothing is arriving.
+func (vs *VideoStream) underrunWait(n uint64, bw float64) time.Duration {
+	var remaining uint64
+	if size := vs.total(); n < size {
+		remaining = size - n
+	}
+	bt := vs.cfg.safeBufferTime(remaining, vs.duration, vs.bandwidthSamples(bw))
+	if bt == math.MaxInt64 {
+		return bt
+	}
+	// Playback started earlier than the buffer time recomputed now allows
+	// by the time since it started, plus the buffer time.
+	wait := bt + vs.cfg.clock().Now().Sub(time.Unix(0, atomic.LoadInt64(&vs.readyAt)))
+	if wait <= 0 {
+		return 0
+	}
+	return wait
+}
+
+// watchUnderrun samples the bandwidth every interval once the video is ready
+// to play, warning the user if the download has slowed such that playback
+// would catch up with it, if its duration is known. It returns when done is
+// closed.
+func (vs *VideoStream) watchUnderrun(interval time.Duration, done <-chan struct{}) {
+	clock := vs.cfg.clock()
+	warned := false
+	for {
+		select {
+		case <-clock.After(interval):
+		case <-done:
+			return
+		}
+		if vs.gate.paused() {
+			vs.pauseSampling()
+			continue
+		}
+
+		n, bw := vs.progress()
+		vs.recordProgress(n)
+		if vs.duration == 0 {
+			continue
+		}
+		wait := vs.underrunWait(n, bw)
+		if wait > 0 && !warned {
+			vs.printf("\nThe bandwidth has dropped to %v bps, so the buffer may underrun. Pause playback for %v to avoid stalling.\n", int64(bw), formatETA(wait))
+			if vs.cfg.OnUnderrun != nil {
+				vs.cfg.OnUnderrun(wait)
+			}
+		}
+		warned = wait > 0
+	}
+}
+
+// announceReady tells the user that the video is ready to play. Only the
+// first call has any effect.
+func (vs *VideoStream) announceReady() {
+	vs.readyOnce.Do(func() {
+		atomic.StoreInt64(&vs.readyAt, vs.cfg.clock().Now().UnixNano())
+		atomic.StoreInt32(&vs.ready, 1)
+		vs.setPhase(PhaseReady)
+		if rate := vs.cfg.ReadyBytesPerSecond; rate > 0 && vs.limiter != nil {
+			if max := vs.cfg.MaxBytesPerSecond; max > 0 && max < rate {
+				rate = max
+			}
+			vs.limiter.setRate(rate)
+		}
+		if vs.name == "" {
+			vs.printf("The video is now ready to play.\n")
+		} else {
+			vs.printf("%v is now ready to play.\n", vs.name)
+		}
+		if vs.cfg.OnReady != nil {
+			vs.cfg.OnReady(vs.name)
+		}
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamProgressFunc(t *testing.T) {
+	os.Remove(testFilename)
+
+	const chunkSz = 1000000
+	const chunks = 10
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(chunkSz*chunks))
+		for i := 0; i < chunks; i++ {
+			w.Write(testData[i*chunkSz : (i+1)*chunkSz])
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var calls int
+	var last uint64
+	cfg := Config{
+		SampleBytes: chunkSz,
+		ProgressFunc: func(downloaded, total uint64, bandwidth float64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if total != chunkSz*chunks {
+				t.Errorf("ProgressFunc called with wrong total, got %v wanted %v", total, chunkSz*chunks)
+			}
+			if downloaded < last {
+				t.Errorf("downloaded went backwards from %v to %v", last, downloaded)
+			}
+			calls++
+			last = downloaded
+		},
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls < 2 {
+		t.Fatalf("expected ProgressFunc to be called periodically, got %v calls", calls)
+	}
+	if last != chunkSz*chunks {
+		t.Fatalf("final ProgressFunc call reported %v bytes, wanted %v", last, chunkSz*chunks)
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamStats(t *testing.T) {
+	os.Remove(testFilename)
+
+	const chunkSz = 1000000
+	const chunks = 10
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(chunkSz*chunks))
+		for i := 0; i < chunks; i++ {
+			w.Write(testData[i*chunkSz : (i+1)*chunkSz])
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{SampleBytes: chunkSz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	if n, _ := vs.Stats(); n != 0 {
+		t.Fatalf("expected no bytes written before streaming, got %v", n)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := vs.Stream(context.Background())
+		errs <- err
+	}()
+
+	var last uint64
+	for done := false; !done; {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		case <-time.After(10 * time.Millisecond):
+		}
+		n, bw := vs.Stats()
+		if n < last {
+			t.Fatalf("bytes written went backwards from %v to %v", last, n)
+		}
+		if bw < 0 {
+			t.Fatalf("negative bandwidth %v", bw)
+		}
+		last = n
+	}
+	if last != chunkSz*chunks {
+		t.Fatalf("expected Stats to report %v bytes written, got %v", chunkSz*chunks, last)
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	rw := rateWindow{window: 5 * time.Second}
+	start := time.Now()
+
+	rw.add(start, 0)
+	if _, ok := rw.rate(); ok {
+		t.Fatal("expected a single sample to be insufficient to measure bandwidth")
+	}
+
+	// 1000 bytes per second for ten seconds, then 100 bytes per second.
+	for i := 1; i <= 10; i++ {
+		rw.add(start.Add(time.Duration(i)*time.Second), uint64(i*1000))
+	}
+	if bw, _ := rw.rate(); bw != 1000 {
+		t.Fatalf("expected bandwidth of 1000, got %v", bw)
+	}
+	for i := 1; i <= 10; i++ {
+		rw.add(start.Add(time.Duration(10+i)*time.Second), uint64(10000+i*100))
+	}
+	if bw, _ := rw.rate(); bw != 100 {
+		t.Fatalf("expected bandwidth to track the slowdown to 100, got %v", bw)
+	}
+}
+
+func TestBufferTime(t *testing.T) {
+	tests := []struct {
+		remaining uint64
+		bw        float64
+		duration  time.Duration
+		fudge     float64
+		want      time.Duration
+	}{
+		{1000, 10, time.Minute, 1, 40 * time.Second},
+		{1000, 10, time.Minute, 1.5, 90 * time.Second},
+		{1000, 10, 2 * time.Minute, 1.2, 0},
+		{1000, 100, time.Minute, 1.2, -48 * time.Second},
+		{0, 0, time.Minute, 1.2, -time.Minute},
+	}
+	for _, test := range tests {
+		got := bufferTime(test.remaining, test.bw, test.duration, test.fudge)
+		if got.Round(time.Millisecond) != test.want {
+			t.Errorf("bufferTime(%v, %v, %v, %v) = %v, wanted %v", test.remaining, test.bw, test.duration, test.fudge, got, test.want)
+		}
+	}
+}
+
+func TestMinBufferPercent(t *testing.T) {
+	tests := []struct {
+		percent    float64
+		downloaded uint64
+		bw         float64
+		want       time.Duration
+	}{
+		// Without a percentage, the duration and fudge factor apply.
+		{0, 0, 10, 90 * time.Second},
+		{25, 0, 10, 25 * time.Second},
+		{25, 200, 10, 5 * time.Second},
+		{25, 250, 10, 0},
+		{25, 500, 0, 0},
+		{100, 900, 10, 10 * time.Second},
+	}
+	for _, test := range tests {
+		cfg := Config{FudgeFactor: 1.5, MinBufferPercent: test.percent}
+		got := cfg.bufferTime(1000, test.downloaded, []float64{test.bw}, time.Minute)
+		if got.Round(time.Millisecond) != test.want {
+			t.Errorf("%v%%: bufferTime(1000, %v, %v, %v) = %v, wanted %v", test.percent, test.downloaded, test.bw, time.Minute, got, test.want)
+		}
+	}
+
+	for _, percent := range []float64{-1, 101} {
+		cfg := Config{MinBufferPercent: percent}
+		if err := cfg.setDefaults(); err == nil {
+			t.Errorf("expected an error for MinBufferPercent %v", percent)
+		}
+	}
+}
+
+func TestETA(t *testing.T) {
+	vs := &VideoStream{size: 1000, duration: time.Minute, cfg: Config{FudgeFactor: 1}}
+	tests := []struct {
+		downloaded uint64
+		bw         float64
+		ready      bool
+		want       string
+	}{
+		{0, 10, false, "ready in 40s, complete in 1m40s"},
+		{500, 10, false, "ready in 0s, complete in 50s"},
+		{500, 10, true, "complete in 50s"},
+		{500, 0, true, "complete in unknown"},
+		{1000, 0, true, "complete in 0s"},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&vs.ready, 0)
+		if test.ready {
+			atomic.StoreInt32(&vs.ready, 1)
+		}
+		if got := vs.eta(test.downloaded, test.bw); got != test.want {
+			t.Errorf("eta(%v, %v) = %q, wanted %q", test.downloaded, test.bw, got, test.want)
+		}
+	}
+}
+
+func TestUnderrunWait(t *testing.T) {
+	vs := &VideoStream{size: 1000, duration: time.Minute, cfg: Config{FudgeFactor: 1}}
+	tests := []struct {
+		played     time.Duration
+		downloaded uint64
+		bw         float64
+		want       time.Duration
+	}{
+		// 50s of downloading left, with 60s of playback left.
+		{0, 500, 10, 0},
+		// 50s of downloading left, with 30s of playback left.
+		{30 * time.Second, 500, 10, 20 * time.Second},
+		{30 * time.Second, 500, 0, math.MaxInt64},
+		{30 * time.Second, 1000, 0, 0},
+	}
+	for _, test := range tests {
+		atomic.StoreInt64(&vs.readyAt, time.Now().Add(-test.played).UnixNano())
+		got := vs.underrunWait(test.downloaded, test.bw)
+		if d := got - test.want; d < -time.Second || d > time.Second {
+			t.Errorf("underrunWait(%v, %v) after %v = %v, wanted %v", test.downloaded, test.bw, test.played, got, test.want)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer which is safe for concurrent use, since the
+// progress bar is written from its own goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestVideoStreamReadyAfterFailure(t *testing.T) {
+	const chunkSz = 1000000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(chunkSz*10))
+		for i := 0; i < 5; i++ {
+			w.Write(testData[i*chunkSz : (i+1)*chunkSz])
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	var log syncBuffer
+	var readied int32
+	cfg := Config{
+		SampleBytes: chunkSz,
+		Logger:      &log,
+		OnReady:     func(string) { atomic.AddInt32(&readied, 1) },
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Millisecond, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err == nil {
+		t.Fatal("expected the truncated stream to fail")
+	}
+	if res.Ready {
+		t.Fatal("StreamResult reported the failed video was ready to play")
+	}
+	time.Sleep(2 * progressInterval)
+	if strings.Contains(log.String(), "ready to play") {
+		t.Fatalf("the failed video was announced as ready to play: %q", log.String())
+	}
+	if atomic.LoadInt32(&readied) != 0 {
+		t.Fatal("OnReady was called for the failed video")
+	}
+}
+
+func TestVideoStreamOnReady(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData)
+	}))
+	defer ts.Close()
+
+	var readied int32
+	var path string
+	cfg := Config{
+		SampleBytes: 1000000,
+		OnReady: func(p string) {
+			atomic.AddInt32(&readied, 1)
+			path = p
+		},
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Hour, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&readied); n != 1 {
+		t.Fatalf("expected OnReady to be called once, got %v", n)
+	}
+	if path != testPartname {
+		t.Fatalf("expected OnReady with %v, got %v", testPartname, path)
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlaybackBitrate(t *testing.T) {
+	cfg := Config{PlaybackBitrate: 1000}
+	if d := cfg.playbackDuration(60000, time.Hour); d != time.Minute {
+		t.Fatalf("expected 60000 bytes at 1000 bytes per second to play for %v, got %v", time.Minute, d)
+	}
+	if d := (&Config{}).playbackDuration(60000, time.Hour); d != time.Hour {
+		t.Fatalf("expected the duration without a bitrate, got %v", d)
+	}
+
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+	chunked := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chunked {
+			w.Write(testData)
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	cfg = Config{PlaybackBitrate: testSz / 100, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Hour, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Duration != 100*time.Second {
+		t.Fatalf("expected playback to take %v at the bitrate, got %v", 100*time.Second, res.Duration)
+	}
+	vs.Close()
+
+	// Without a reported size, the video is ready as soon as the bandwidth
+	// outpaces playback.
+	chunked = true
+	var ready int32
+	cfg.OnReady = func(string) { atomic.StoreInt32(&ready, 1) }
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if vs.knownSize {
+		t.Fatal("expected the size of a chunked response to be unknown")
+	}
+	if res, err = vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Ready || atomic.LoadInt32(&ready) != 1 {
+		t.Fatal("expected a video of unknown size to be ready once the bandwidth outpaces playback")
+	}
+}
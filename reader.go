@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// readerPollInterval is how often a Reader that has caught up with the
+// download checks for more of the video.
+const readerPollInterval = 50 * time.Millisecond
+
+// errReaderUnsupported is returned by Reader for VideoStreams that can't be
+// read while streaming.
+var errReaderUnsupported = errors.New("Reader requires streaming to a file over a single connection without preallocation")
+
+// finish records that Stream returned err, waking any Readers.
+func (vs *VideoStream) finish(err error) {
+	vs.finishOnce.Do(func() {
+		vs.streamErr = err
+		close(vs.finished)
+	})
+}
+
+// Reader returns an io.ReadCloser of the video, for feeding a player while
+// the video buffers. Reads block until the video is ready to play, then
+// yield the video as it is downloaded, blocking whenever they catch up with
+// the download. Once the whole video has been read, Read returns io.EOF, or
+// the error returned by Stream if it failed.
+//
+// Stream must be called concurrently. The video is read back from the output
+// file, so Reader is only supported for VideoStreams created with
+// NewVideoStreamConfig that download over a single connection to a regular
+// file, without Config.Preallocate.
+func (vs *VideoStream) Reader() (io.ReadCloser, error) {
+	if vs.f == nil || vs.cfg.Connections > 1 || vs.preallocated || vs.fifo || vs.gz != nil {
+		return nil, errReaderUnsupported
+	}
+	f, err := os.Open(vs.name)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{vs: vs, f: f, pos: vs.appendAt}, nil
+}
+
+// streamReader reads a video from the output file of a VideoStream while it
+// is streaming.
+type streamReader struct {
+	vs  *VideoStream
+	f   *os.File
+	pos int64
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for {
+		var done bool
+		select {
+		case <-sr.vs.finished:
+			done = true
+		default:
+		}
+
+		// Once Stream has returned, everything it downloaded is in the
+		// file.
+		if done || atomic.LoadInt32(&sr.vs.ready) == 1 {
+			n, err := sr.f.ReadAt(p, sr.pos)
+			sr.pos += int64(n)
+			if n > 0 {
+				return n, nil
+			}
+			if err != io.EOF {
+				return 0, err
+			}
+			if done {
+				if sr.vs.streamErr != nil {
+					return 0, sr.vs.streamErr
+				}
+				return 0, io.EOF
+			}
+		}
+
+		select {
+		case <-sr.vs.finished:
+		case <-time.After(readerPollInterval):
+		}
+	}
+}
+
+// Close closes the output file opened by the streamReader. It does not stop
+// the VideoStream.
+func (sr *streamReader) Close() error {
+	return sr.f.Close()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamReader(t *testing.T) {
+	os.Remove(testFilename)
+
+	const chunkSz = 1000000
+	const chunks = 10
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(chunkSz*chunks))
+		for i := 0; i < chunks; i++ {
+			w.Write(testData[i*chunkSz : (i+1)*chunkSz])
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	// a short video can't be played until most of it has downloaded.
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Millisecond, testFilename, Config{SampleBytes: chunkSz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	r, err := vs.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := vs.Stream(context.Background())
+		errs <- err
+	}()
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&vs.ready) != 1 {
+		t.Fatal("Reader returned data before the video was ready to play")
+	}
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(first, rest...), testData[:chunkSz*chunks]) {
+		t.Fatal("data read from the Reader did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamReaderUnsupported(t *testing.T) {
+	vs := &VideoStream{}
+	if _, err := vs.Reader(); err != errReaderUnsupported {
+		t.Fatalf("expected %v for a VideoStream without a file, got %v", errReaderUnsupported, err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRetryBackoff is the wait before the first retry when none is
+// configured.
+const defaultRetryBackoff = time.Second
+
+// errClosed is returned by a retryReader that has been closed.
+var errClosed = errors.New("read on closed VideoStream")
+
+// statusErrorBodySize is the number of bytes of an unexpected response's
+// body included in its statusError.
+const statusErrorBodySize = 512
+
+// statusError is returned when the server responds with an unexpected HTTP
+// status.
+type statusError struct {
+	code   int
+	status string
+	body   string
+	header http.Header
+}
+
+// newStatusError constructs a statusError from res, consuming and closing its
+// body.
+func newStatusError(res *http.Response) *statusError {
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, statusErrorBodySize))
+	return &statusError{
+		code:   res.StatusCode,
+		status: res.Status,
+		body:   strings.TrimSpace(string(body)),
+		header: res.Header,
+	}
+}
+
+func (se *statusError) Error() string {
+	if se.body == "" {
+		return fmt.Sprintf("unexpected HTTP status: %v", se.status)
+	}
+	return fmt.Sprintf("unexpected HTTP status: %v: %q", se.status, se.body)
+}
+
+// temporary reports whether err is a transient error after which the
+// download may be retried. Network errors and 5xx responses are temporary,
+// while 4xx responses and local errors are not.
+func temporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrCertificateMismatch) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// retryReader reads the body of an HTTP response. When a read fails with a
+// temporary error, retryReader reissues the request for the remainder of
+// the resource and continues reading from the new response.
+type retryReader struct {
+	// retries is the total number of retries. It is accessed atomically,
+	// so that it can be reported while streaming, and kept first for 64-bit
+	// alignment.
+	retries int64
+
+	ctx    context.Context
+	url    string
+	cfg    *Config
+	offset int64
+	// end is the offset at which the requested range of the resource ends,
+	// or zero if the whole remainder of the resource is requested.
+	end int64
+	// validator, if set, is sent as If-Range so that the download isn't
+	// resumed if the resource has changed.
+	validator string
+	// gate, if set, blocks reads while the VideoStream is paused.
+	gate *gate
+	// reopen, if set, requests the resource from offset instead of
+	// requesting url, for resources assembled from several requests such as
+	// the segments of an HLS playlist.
+	reopen func(ctx context.Context, offset int64) (io.ReadCloser, error)
+	// probeEnd, if set, requests the resource past the end of the body once
+	// it ends, since net/http stops reading at the Content-Length the server
+	// reported, which may be too small. It is cleared once a response states
+	// the total size. probed is the offset last probed.
+	probeEnd bool
+	probed   int64
+
+	// failures is the number of consecutive retries since the last
+	// successful read.
+	failures int
+	// retrying is the total time spent reconnecting, counted against
+	// Config.RetryDeadline.
+	retrying time.Duration
+
+	mu     sync.Mutex
+	body   io.ReadCloser
+	closed bool
+}
+
+func (rr *retryReader) Read(p []byte) (int, error) {
+	if rr.gate != nil {
+		if err := rr.gate.wait(rr.ctx); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		n, err := rr.body.Read(p)
+		rr.offset += int64(n)
+		if n > 0 {
+			rr.failures = 0
+		}
+		if err == io.EOF && rr.extend() {
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err == nil || err == io.EOF || !temporary(err) {
+			return n, err
+		}
+		if err := rr.reconnect(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// reconnect waits out the backoff and reissues the request starting at the
+// current offset, retrying while the failures are temporary. cause is the
+// error that triggered the reconnect, returned if no retries remain.
+func (rr *retryReader) reconnect(cause error) error {
+	start := time.Now()
+	defer func() { rr.retrying += time.Since(start) }()
+	for {
+		backoff, ok := rr.backoff(time.Since(start))
+		if !ok {
+			return cause
+		}
+		atomic.AddInt64(&rr.retries, 1)
+		rr.failures++
+
+		select {
+		case <-time.After(backoff):
+		case <-rr.ctx.Done():
+			return rr.ctx.Err()
+		}
+
+		body, err := rr.resume()
+		if err == nil {
+			rr.mu.Lock()
+			defer rr.mu.Unlock()
+			if rr.closed {
+				body.Close()
+				return errClosed
+			}
+			rr.body.Close()
+			rr.body = body
+			return nil
+		}
+		if !temporary(err) {
+			return err
+		}
+		cause = err
+	}
+}
+
+// extend requests the remainder of the resource from the current offset once
+// the body has ended, continuing with the new response if the server sends
+// one, and reports whether it did. Servers answer a request past the end of
+// the resource with 416 Range Not Satisfiable, or ignore the range, in which
+// case the body really has ended. Like a retry, the request is made from a
+// refreshed url, as the original one may have expired by then.
+func (rr *retryReader) extend() bool {
+	if !rr.probeEnd || rr.reopen != nil || rr.end != 0 || rr.offset <= rr.probed {
+		return false
+	}
+	rr.probed = rr.offset
+	body, err := rr.resume()
+	if err != nil {
+		return false
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.closed {
+		body.Close()
+		return false
+	}
+	rr.body.Close()
+	rr.body = body
+	return true
+}
+
+// backoff returns how long to wait before the next retry, or false if no
+// retries remain, because MaxRetries have been made or the time spent
+// reconnecting, including elapsed in the ongoing reconnect, has reached
+// RetryDeadline. The wait is cut short at the deadline.
+func (rr *retryReader) backoff(elapsed time.Duration) (time.Duration, bool) {
+	cfg := rr.cfg
+	if cfg.MaxRetries <= 0 && cfg.RetryDeadline <= 0 {
+		return 0, false
+	}
+	if cfg.MaxRetries > 0 && atomic.LoadInt64(&rr.retries) >= int64(cfg.MaxRetries) {
+		return 0, false
+	}
+	backoff := cfg.RetryBackoff << uint(rr.failures)
+	if cfg.RetryDeadline > 0 {
+		remaining := cfg.RetryDeadline - rr.retrying - elapsed
+		if remaining <= 0 {
+			return 0, false
+		}
+		// the shifted backoff overflows after enough failures.
+		if backoff <= 0 || backoff > remaining {
+			backoff = remaining
+		}
+	}
+	return backoff, true
+}
+
+// resume requests the resource from the current offset up to end, returning
+// the response body.
+func (rr *retryReader) resume() (io.ReadCloser, error) {
+	if rr.reopen != nil {
+		return rr.reopen(rr.ctx, rr.offset)
+	}
+	url, err := rr.cfg.refreshURL(rr.url)
+	if err != nil {
+		return nil, err
+	}
+	return rr.request(url)
+}
+
+// request requests url from the current offset up to end, returning the
+// response body.
+func (rr *retryReader) request(url string) (io.ReadCloser, error) {
+	req, err := newRequest(rr.ctx, url, *rr.cfg, rr.offset, rr.end)
+	if err != nil {
+		return nil, err
+	}
+	if rr.validator != "" {
+		req.Header.Set("If-Range", rr.validator)
+	}
+	res, err := rr.cfg.client(req.URL).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 500 {
+		return nil, newStatusError(res)
+	}
+	if rr.offset == 0 && rr.end == 0 && res.StatusCode == http.StatusOK {
+		return res.Body, nil
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("could not resume download at byte %v: %w", rr.offset, newStatusError(res))
+	}
+	if err := checkResumed(res, rr.offset); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	// The server has stated the size of the resource, so there's no need
+	// to probe past it.
+	if sizeConfirmed(res) {
+		rr.probeEnd = false
+	}
+	return res.Body, nil
+}
+
+// refreshURL returns the url to request the video at url from, after the
+// first request.
+func (cfg *Config) refreshURL(url string) (string, error) {
+	if cfg.RefreshURL == nil {
+		return url, nil
+	}
+	fresh, err := cfg.RefreshURL()
+	if err != nil {
+		return "", fmt.Errorf("could not refresh the url: %w", err)
+	}
+	return fresh, nil
+}
+
+// Close closes the current response body. Subsequent reads fail.
+func (rr *retryReader) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.closed {
+		return nil
+	}
+	rr.closed = true
+	return rr.body.Close()
+}
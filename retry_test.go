@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyHandler returns a handler that drops the connection halfway through
+// the first response, and responds to subsequent requests using next.
+func flakyHandler(next http.Handler) http.Handler {
+	var requests int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData[:testSz/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(err)
+		}
+		conn.Close()
+	})
+}
+
+func TestVideoStreamRetry(t *testing.T) {
+	os.Remove(testFilename)
+
+	_, err := io.ReadFull(rand.Reader, testData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(flakyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	})))
+	defer ts.Close()
+
+	cfg := Config{
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Retries != 1 {
+		t.Fatalf("expected 1 retry, got %v", res.Retries)
+	}
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in the retried file did not match testData")
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamRetryClientError(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(flakyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})))
+	defer ts.Close()
+
+	cfg := Config{
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusForbidden {
+		t.Fatalf("expected a 403 status error, got %v", err)
+	}
+	if res.Retries != 1 {
+		t.Fatalf("expected 4xx responses not to be retried, got %v retries", res.Retries)
+	}
+
+	if err := os.Remove(testPartname); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamRetryDeadline(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	ts := httptest.NewServer(flakyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})))
+	defer ts.Close()
+
+	cfg := Config{
+		RetryDeadline: 300 * time.Millisecond,
+		RetryBackoff:  10 * time.Millisecond,
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	start := time.Now()
+	res, err := vs.Stream(context.Background())
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a 503 status error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.RetryDeadline || elapsed > 10*cfg.RetryDeadline {
+		t.Fatalf("expected retries to stop at the %v deadline, took %v", cfg.RetryDeadline, elapsed)
+	}
+	if res.Retries < 3 {
+		t.Fatalf("expected retries to continue until the deadline, got %v retries", res.Retries)
+	}
+}
+
+func TestRetryReaderBackoff(t *testing.T) {
+	cfg := Config{RetryDeadline: time.Minute, RetryBackoff: time.Second}
+	rr := &retryReader{cfg: &cfg, failures: 3}
+	if backoff, ok := rr.backoff(0); !ok || backoff != 8*time.Second {
+		t.Fatalf("expected a backoff of %v, got %v (%v)", 8*time.Second, backoff, ok)
+	}
+	rr.retrying = 55 * time.Second
+	if backoff, ok := rr.backoff(time.Second); !ok || backoff != 4*time.Second {
+		t.Fatalf("expected the backoff to be cut short at the deadline, got %v (%v)", backoff, ok)
+	}
+	rr.failures = 100
+	if backoff, ok := rr.backoff(time.Second); !ok || backoff != 4*time.Second {
+		t.Fatalf("expected an overflowing backoff to be cut short at the deadline, got %v (%v)", backoff, ok)
+	}
+	if _, ok := rr.backoff(5 * time.Second); ok {
+		t.Fatal("expected no retries past the deadline")
+	}
+
+	cfg = Config{RetryDeadline: time.Minute, MaxRetries: 2, RetryBackoff: time.Second}
+	rr = &retryReader{cfg: &cfg, retries: 2}
+	if _, ok := rr.backoff(0); ok {
+		t.Fatal("expected no retries past MaxRetries")
+	}
+}
+
+func TestVideoStreamRefreshURL(t *testing.T) {
+	os.Remove(testFilename)
+
+	// only the latest token is accepted, after the first request.
+	var token int32
+	ts := httptest.NewServer(flakyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != strconv.Itoa(int(atomic.LoadInt32(&token))) {
+			http.Error(w, "token expired", http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	})))
+	defer ts.Close()
+
+	cfg := Config{
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+		RefreshURL: func() (string, error) {
+			return ts.URL + "?token=" + strconv.Itoa(int(atomic.AddInt32(&token, 1))), nil
+		},
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL+"?token=0", time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Retries != 1 || atomic.LoadInt32(&token) != 1 {
+		t.Fatalf("expected 1 retry with a refreshed url, got %v retries and %v refreshes", res.Retries, token)
+	}
+	vs.Close()
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("data in the retried file did not match testData")
+	}
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, true},
+		{&statusError{code: 503, status: "503 Service Unavailable"}, true},
+		{&statusError{code: 404, status: "404 Not Found"}, false},
+		{context.Canceled, false},
+		{&os.PathError{Op: "write", Err: errors.New("no space left on device")}, false},
+	}
+	for _, test := range tests {
+		if got := temporary(test.err); got != test.want {
+			t.Errorf("temporary(%v) = %v, wanted %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestVideoStreamRefreshURLProbe(t *testing.T) {
+	// the server under-reports the size of the video, and only the latest
+	// token is accepted after the first request.
+	data := testData[:5000000]
+	var token int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != strconv.Itoa(int(atomic.LoadInt32(&token))) {
+			http.Error(w, "token expired", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(data))
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)/2))
+		w.Write(data[:len(data)/2])
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		RefreshURL: func() (string, error) {
+			return ts.URL + "?token=" + strconv.Itoa(int(atomic.AddInt32(&token, 1))), nil
+		},
+	}
+	var buf bytes.Buffer
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL+"?token=0", time.Second, &buf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("expected %v bytes to be written, got %v", len(data), buf.Len())
+	}
+	if n := atomic.LoadInt32(&token); n != 1 {
+		t.Fatalf("expected the url to be refreshed once, got %v", n)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxBandwidthSamples bounds the bandwidth history: ten minutes of samples
+// taken every progressInterval.
+const maxBandwidthSamples = int(10 * time.Minute / progressInterval)
+
+const (
+	// minSampleDuration is the shortest measurement the bandwidth is
+	// computed from. Quicker transfers, such as of a tiny or locally cached
+	// video, are too fast to time meaningfully.
+	minSampleDuration = time.Millisecond
+
+	// unlimitedBandwidth, a petabyte per second, stands in for the
+	// bandwidth of transfers too fast to time, so that the video is ready
+	// to play immediately. Unlike dividing by a near-zero duration, it
+	// stays finite through the buffer time arithmetic and JSON encoding.
+	unlimitedBandwidth = 1 << 50
+)
+
+// BandwidthSample is a measurement of the bandwidth while streaming.
+type BandwidthSample struct {
+	// Time is when the measurement started.
+	Time time.Time
+	// Bytes is the number of bytes downloaded during the measurement.
+	Bytes uint64
+	// Duration is how long the measurement took.
+	Duration time.Duration
+	// Bps is the measured bandwidth, in bytes per second.
+	Bps float64
+}
+
+// newBandwidthSample returns the sample of n bytes downloaded between start
+// and end. A sample taking less than minSampleDuration measures
+// unlimitedBandwidth.
+func newBandwidthSample(start, end time.Time, n uint64) BandwidthSample {
+	d := end.Sub(start)
+	bps := float64(unlimitedBandwidth)
+	if d >= minSampleDuration {
+		bps = float64(n) / d.Seconds()
+	}
+	return BandwidthSample{Time: start, Bytes: n, Duration: d, Bps: bps}
+}
+
+// probeRounds measures the bandwidth of reading n bytes from r, split into
+// ProbeRounds probes whose bandwidths are combined by trimmedMean. The sample
+// returned spans all the probes, which end early if r does.
+func (cfg *Config) probeRounds(r io.Reader, n int64) (BandwidthSample, error) {
+	rounds := int64(cfg.ProbeRounds)
+	if rounds < 1 {
+		rounds = 1
+	}
+	if rounds > n {
+		rounds = n
+	}
+	clock := cfg.clock()
+	start := clock.Now()
+	var read int64
+	var bps []float64
+	for i := int64(0); i < rounds; i++ {
+		size := n / rounds
+		if i == rounds-1 {
+			size = n - read
+		}
+		tbefore := clock.Now()
+		m, err := io.CopyN(ioutil.Discard, r, size)
+		read += m
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return BandwidthSample{}, err
+		}
+		if m > 0 {
+			bps = append(bps, newBandwidthSample(tbefore, clock.Now(), uint64(m)).Bps)
+		}
+		if err != nil {
+			break
+		}
+	}
+	s := newBandwidthSample(start, clock.Now(), uint64(read))
+	if len(bps) > 1 {
+		s.Bps = trimmedMean(bps)
+	}
+	return s, nil
+}
+
+// trimmedMean returns the mean of samples, excluding the smallest and
+// largest if there are at least three, so that a single burst or stall
+// doesn't skew it. samples is sorted in place.
+func trimmedMean(samples []float64) float64 {
+	sort.Float64s(samples)
+	if len(samples) >= 3 {
+		samples = samples[1 : len(samples)-1]
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += s
+	}
+	return sum / float64(len(samples))
+}
+
+// Samples returns the bandwidth measured while streaming, oldest first: the
+// initial sample, followed by a sample every fraction of a second for the
+// last ten minutes, excluding time spent paused. It is safe to call from any
+// goroutine, including while Stream is running.
+func (vs *VideoStream) Samples() []BandwidthSample {
+	vs.samplesMu.Lock()
+	defer vs.samplesMu.Unlock()
+	return append([]BandwidthSample(nil), vs.samples...)
+}
+
+// bandwidthSamples returns the bandwidth history recorded while streaming,
+// followed by the current bandwidth bw.
+func (vs *VideoStream) bandwidthSamples(bw float64) []float64 {
+	vs.samplesMu.Lock()
+	defer vs.samplesMu.Unlock()
+	samples := make([]float64, len(vs.samples), len(vs.samples)+1)
+	for i, s := range vs.samples {
+		samples[i] = s.Bps
+	}
+	return append(samples, bw)
+}
+
+// recordSample adds s to the bandwidth history, discarding the oldest
+// samples beyond maxBandwidthSamples.
+func (vs *VideoStream) recordSample(s BandwidthSample) {
+	if math.IsNaN(s.Bps) {
+		return
+	}
+	vs.samplesMu.Lock()
+	defer vs.samplesMu.Unlock()
+	vs.samples = append(vs.samples, s)
+	if len(vs.samples) > maxBandwidthSamples {
+		vs.samples = vs.samples[len(vs.samples)-maxBandwidthSamples:]
+	}
+}
+
+// recordProgress records the bandwidth since the last call, given that n
+// bytes are on disk. The first call only starts the measurement.
+func (vs *VideoStream) recordProgress(n uint64) {
+	now := vs.cfg.clock().Now()
+	vs.samplesMu.Lock()
+	last := vs.sampledAt
+	vs.sampledAt = rateSample{now, n}
+	vs.samplesMu.Unlock()
+	if !last.t.IsZero() && n >= last.n {
+		vs.recordSample(newBandwidthSample(last.t, now, n-last.n))
+	}
+}
+
+// pauseSampling discards the ongoing measurement, so that time spent paused
+// isn't measured.
+func (vs *VideoStream) pauseSampling() {
+	vs.samplesMu.Lock()
+	defer vs.samplesMu.Unlock()
+	vs.sampledAt = rateSample{}
+}
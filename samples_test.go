@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRecordProgress(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	vs := &VideoStream{cfg: Config{Clock: clock}}
+
+	vs.recordProgress(100)
+	clock.Advance(time.Second)
+	vs.recordProgress(150)
+	clock.Advance(time.Second)
+	vs.pauseSampling()
+	clock.Advance(time.Minute)
+	vs.recordProgress(150)
+	clock.Advance(2 * time.Second)
+	vs.recordProgress(190)
+
+	want := []BandwidthSample{
+		{Time: start, Bytes: 50, Duration: time.Second, Bps: 50},
+		{Time: start.Add(62 * time.Second), Bytes: 40, Duration: 2 * time.Second, Bps: 20},
+	}
+	samples := vs.Samples()
+	if len(samples) != len(want) {
+		t.Fatalf("expected samples %v, got %v", want, samples)
+	}
+	for i := range want {
+		if !samples[i].Time.Equal(want[i].Time) || samples[i].Bytes != want[i].Bytes || samples[i].Duration != want[i].Duration || samples[i].Bps != want[i].Bps {
+			t.Fatalf("expected samples %v, got %v", want, samples)
+		}
+	}
+}
+
+// pacedReader reads up to 100 bytes at a time, advancing clock by the next
+// of delays on each read.
+type pacedReader struct {
+	clock  *fakeClock
+	delays []time.Duration
+}
+
+func (pr *pacedReader) Read(p []byte) (int, error) {
+	if len(pr.delays) == 0 {
+		return 0, io.EOF
+	}
+	pr.clock.Advance(pr.delays[0])
+	pr.delays = pr.delays[1:]
+	if len(p) > 100 {
+		p = p[:100]
+	}
+	return len(p), nil
+}
+
+func TestProbeRounds(t *testing.T) {
+	delays := []time.Duration{time.Second, time.Second, time.Second, 10 * time.Second, 100 * time.Millisecond}
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	cfg := Config{Clock: clock}
+	s, err := cfg.probeRounds(&pacedReader{clock, delays}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Bytes != 500 || s.Bps != 500/13.1 {
+		t.Fatalf("expected a single sample of 500 bytes at %v bytes per second, got %+v", 500/13.1, s)
+	}
+
+	cfg.ProbeRounds = len(delays)
+	s, err = cfg.probeRounds(&pacedReader{clock, delays}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Bytes != 500 || s.Duration != 13100*time.Millisecond || s.Bps != 100 {
+		t.Fatalf("expected the stall and burst to be discarded for 100 bytes per second, got %+v", s)
+	}
+
+	// The probes end with the video.
+	s, err = cfg.probeRounds(&pacedReader{clock, delays[:2]}, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Bytes != 200 || s.Bps != 100 {
+		t.Fatalf("expected 200 bytes at 100 bytes per second, got %+v", s)
+	}
+}
+
+func TestSampleMemory(t *testing.T) {
+	const sample = 64 << 20
+	cfg := Config{SampleBytes: sample, WarmupBytes: 1 << 20}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	// Hide the reader's WriterTo, as the response body has none.
+	r := struct{ io.Reader }{io.LimitReader(zeroReader{}, 2*sample)}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, _, err := cfg.sample(r, 2*sample); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Fatalf("expected sampling %v bytes to allocate less than 1MB, got %v bytes", sample, alloc)
+	}
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestTrimmedMean(t *testing.T) {
+	for _, test := range []struct {
+		samples []float64
+		want    float64
+	}{
+		{[]float64{5}, 5},
+		{[]float64{2, 4}, 3},
+		{[]float64{1000, 10, 20, 30}, 25},
+	} {
+		if got := trimmedMean(test.samples); got != test.want {
+			t.Fatalf("expected the trimmed mean of %v to be %v, got %v", test.samples, test.want, got)
+		}
+	}
+}
+
+func TestRecordSample(t *testing.T) {
+	vs := &VideoStream{}
+	for i := 0; i < maxBandwidthSamples+10; i++ {
+		vs.recordSample(BandwidthSample{Bps: float64(i)})
+	}
+	samples := vs.bandwidthSamples(-1)
+	if len(samples) != maxBandwidthSamples+1 {
+		t.Fatalf("expected %v samples, got %v", maxBandwidthSamples+1, len(samples))
+	}
+	if samples[0] != 10 || samples[len(samples)-1] != -1 {
+		t.Fatalf("expected the oldest samples to be discarded and the current bandwidth last, got %v", samples)
+	}
+}
+
+func TestVideoStreamSamples(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	cfg := Config{SampleBytes: 1000000, MaxBytesPerSecond: testSz}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := vs.Samples()
+	if len(samples) < 2 {
+		t.Fatalf("expected the initial sample and periodic samples, got %v", samples)
+	}
+	if s := samples[0]; s.Bytes != uint64(cfg.SampleBytes) || s.Bps != res.Bandwidth {
+		t.Fatalf("expected the initial sample of %v bytes at %v bps, got %+v", cfg.SampleBytes, res.Bandwidth, s)
+	}
+	for _, s := range samples[1:] {
+		if s.Duration <= 0 || s.Time.Before(samples[0].Time) {
+			t.Fatalf("expected periodic samples after the initial one, got %+v", s)
+		}
+	}
+
+	vs.Close()
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewBandwidthSampleInstant(t *testing.T) {
+	now := time.Now()
+	for _, n := range []uint64{0, 1000} {
+		s := newBandwidthSample(now, now, n)
+		if s.Bps != unlimitedBandwidth {
+			t.Fatalf("expected an instant sample of %v bytes to measure %v bps, got %v", n, float64(unlimitedBandwidth), s.Bps)
+		}
+		if bt := bufferTime(testSz, s.Bps, time.Minute, defaultFudgeFactor); bt > 0 {
+			t.Fatalf("expected no buffer time at unlimited bandwidth, got %v", bt)
+		}
+	}
+	if bt := bufferTime(testSz, math.NaN(), time.Minute, defaultFudgeFactor); bt != math.MaxInt64 {
+		t.Fatalf("expected an unknown bandwidth to give an unbounded buffer time, got %v", bt)
+	}
+}
+
+func TestVideoStreamTinyVideo(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	video := testData[:100]
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(video))
+	}))
+	defer ts.Close()
+
+	// The sample is timed by a clock which doesn't advance, as if the video
+	// arrived instantly.
+	cfg := Config{Clock: &fakeClock{now: time.Now()}, Logger: ioutil.Discard}
+	est, err := EstimateBufferTime(context.Background(), ts.URL, time.Minute, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.IsInf(est.Bandwidth, 0) || math.IsNaN(est.Bandwidth) || est.BufferTime > 0 {
+		t.Fatalf("expected a finite bandwidth and no buffer time, got %+v", est)
+	}
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Minute, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.IsInf(res.Bandwidth, 0) || math.IsNaN(res.Bandwidth) || res.BufferTime != 0 || !res.Ready {
+		t.Fatalf("expected a finite bandwidth and a video ready immediately, got %+v", res)
+	}
+}
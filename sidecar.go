@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
+)
+
+// readDurationFile returns the duration recorded in the JSON metadata file at
+// path, such as a sidecar file precomputed for the video, and whether it
+// records one. The duration is read from a top level "duration" field, or
+// else from "format.duration" as written by ffprobe -show_format, and may be
+// a number of seconds or a string holding either seconds or a Go duration
+// such as "1h2m".
+func readDurationFile(path string) (time.Duration, bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	var meta struct {
+		Duration json.RawMessage `json:"duration"`
+		Format   struct {
+			Duration json.RawMessage `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return 0, false, fmt.Errorf("%v: %w", path, err)
+	}
+	raw := meta.Duration
+	if len(raw) == 0 || string(raw) == "null" {
+		raw = meta.Format.Duration
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, false, nil
+	}
+	d, err := parseSidecarDuration(raw)
+	if err != nil {
+		return 0, false, fmt.Errorf("%v: %w", path, err)
+	}
+	return d, true, nil
+}
+
+// parseSidecarDuration parses a duration field of a metadata file.
+func parseSidecarDuration(raw json.RawMessage) (time.Duration, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw)
+	}
+	var d time.Duration
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(secs) || math.IsInf(secs, 0) || secs > math.MaxInt64/float64(time.Second) {
+			return 0, fmt.Errorf("invalid duration %v", string(raw))
+		}
+		d = time.Duration(secs * float64(time.Second))
+	} else if d, err = time.ParseDuration(s); err != nil {
+		return 0, fmt.Errorf("invalid duration %v", string(raw))
+	}
+	if d < 0 {
+		return 0, errors.New("negative duration")
+	}
+	return d, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadDurationFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		json  string
+		want  time.Duration
+		ok    bool
+		valid bool
+	}{
+		{`{"duration": 90.5}`, 90500 * time.Millisecond, true, true},
+		{`{"duration": "1h2m"}`, time.Hour + 2*time.Minute, true, true},
+		{`{"format": {"filename": "a.mkv", "duration": "596.461000"}}`, 596461 * time.Millisecond, true, true},
+		{`{"title": "a"}`, 0, false, true},
+		{`{"duration": null}`, 0, false, true},
+		{`{"duration": "soon"}`, 0, false, false},
+		{`{"duration": -5}`, 0, false, false},
+		{`{"duration": "NaN"}`, 0, false, false},
+		{`not json`, 0, false, false},
+	} {
+		path := filepath.Join(dir, "video.json")
+		if err := ioutil.WriteFile(path, []byte(test.json), 0666); err != nil {
+			t.Fatal(err)
+		}
+		d, ok, err := readDurationFile(path)
+		if (err == nil) != test.valid {
+			t.Fatalf("%v: expected valid %v, got error %v", test.json, test.valid, err)
+		}
+		if d != test.want || ok != test.ok {
+			t.Fatalf("%v: expected %v, %v, got %v, %v", test.json, test.want, test.ok, d, ok)
+		}
+	}
+
+	if _, _, err := readDurationFile(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file to fail, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// errIncomplete is the error a Sink's writer is closed with if the VideoStream
+// is closed before the whole video has been streamed to it.
+var errIncomplete = errors.New("the video stream was closed before the video was complete")
+
+// Sink creates the writers videos are streamed to, such as uploads to object
+// storage, in place of files.
+type Sink interface {
+	// Create returns a writer for the video named name. The writer is
+	// closed once the whole video has been written to it. If the video is
+	// abandoned instead and the writer has a CloseWithError method, like
+	// io.PipeWriter, that is called with the reason, so that a partial
+	// upload can be discarded.
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+}
+
+// NewVideoStreamSink is like NewVideoStreamWriter, but streams the video to a
+// writer named name created by sink once the server has responded. Closing
+// the VideoStream closes the writer. Stream fails if closing the writer does,
+// such as when an upload can't be completed.
+func NewVideoStreamSink(ctx context.Context, url string, duration time.Duration, name string, sink Sink, cfg Config) (*VideoStream, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	url, err := localURL(url)
+	if err != nil {
+		return nil, err
+	}
+	res, duration, start, err := requestVideo(ctx, url, duration, cfg)
+	if err != nil {
+		return nil, err
+	}
+	w, err := sink.Create(ctx, name)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	vs := newVideoStream(ctx, url, duration, w, res, 0, cfg)
+	vs.rr.offset = start
+	vs.sink = w
+	return vs, nil
+}
+
+// closeSink closes the writer created by the Sink, with err if it is non-nil
+// and the writer supports it. Only the first call closes the writer; later
+// ones return its result.
+func (vs *VideoStream) closeSink(err error) error {
+	vs.sinkOnce.Do(func() {
+		if cw, ok := vs.sink.(interface{ CloseWithError(error) error }); ok && err != nil {
+			vs.sinkErr = cw.CloseWithError(err)
+			return
+		}
+		vs.sinkErr = vs.sink.Close()
+	})
+	return vs.sinkErr
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// memSink creates uploads held in memory.
+type memSink struct {
+	uploads map[string]*memUpload
+	failing bool
+}
+
+type memUpload struct {
+	bytes.Buffer
+	closed  bool
+	aborted error
+	failing bool
+}
+
+func (ms *memSink) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	mu := &memUpload{failing: ms.failing}
+	ms.uploads[name] = mu
+	return mu, nil
+}
+
+var errUploadFailed = errors.New("upload failed")
+
+func (mu *memUpload) Close() error {
+	mu.closed = true
+	if mu.failing {
+		return errUploadFailed
+	}
+	return nil
+}
+
+func (mu *memUpload) CloseWithError(err error) error {
+	mu.aborted = err
+	return nil
+}
+
+func TestNewVideoStreamSink(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	sink := &memSink{uploads: make(map[string]*memUpload)}
+	cfg := Config{Logger: ioutil.Discard}
+	vs, err := New(ts.URL, WithSink(sink, "videos/"+testFilename), WithConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu := sink.uploads["videos/"+testFilename]
+	if mu == nil {
+		t.Fatal("expected an upload to be created")
+	}
+	if !mu.closed || mu.aborted != nil {
+		t.Fatalf("expected the upload to be completed, got closed %v and aborted with %v", mu.closed, mu.aborted)
+	}
+	if !bytes.Equal(mu.Bytes(), testData) {
+		t.Fatal("uploaded data did not match testData")
+	}
+
+	// A video abandoned before it is complete is aborted.
+	vs, err = NewVideoStreamSink(context.Background(), ts.URL, time.Second, "abandoned", sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	if mu := sink.uploads["abandoned"]; mu.closed || !errors.Is(mu.aborted, errIncomplete) {
+		t.Fatalf("expected the upload to be aborted with %v, got closed %v and aborted with %v", errIncomplete, mu.closed, mu.aborted)
+	}
+
+	// An upload that can't be completed fails the stream.
+	sink.failing = true
+	vs, err = NewVideoStreamSink(context.Background(), ts.URL, time.Second, "failing", sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); !errors.Is(err, errUploadFailed) {
+		t.Fatalf("expected %v, got %v", errUploadFailed, err)
+	}
+}
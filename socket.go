@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// socketWriteTimeout bounds how long a write to a client of a progressSocket
+// may take, so that a client which stops reading can't stall the download.
+const socketWriteTimeout = time.Second
+
+// progressSocket is a Unix domain socket that every write is broadcast to,
+// for other processes to follow the progress of a download by connecting to
+// it. Clients that can't keep up are disconnected. Writes never fail.
+type progressSocket struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
+	exited chan struct{}
+}
+
+// listenProgress listens for clients on a Unix domain socket at path. A
+// socket left at path by an earlier run is replaced.
+func listenProgress(path string) (*progressSocket, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	ps := &progressSocket{
+		ln:     ln,
+		conns:  make(map[net.Conn]struct{}),
+		exited: make(chan struct{}),
+	}
+	go ps.accept()
+	return ps, nil
+}
+
+// accept adds clients until the listener is closed.
+func (ps *progressSocket) accept() {
+	defer close(ps.exited)
+	for {
+		conn, err := ps.ln.Accept()
+		if err != nil {
+			return
+		}
+		ps.mu.Lock()
+		ps.conns[conn] = struct{}{}
+		ps.mu.Unlock()
+	}
+}
+
+func (ps *progressSocket) Write(p []byte) (int, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for conn := range ps.conns {
+		conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		if _, err := conn.Write(p); err != nil {
+			conn.Close()
+			delete(ps.conns, conn)
+		}
+	}
+	return len(p), nil
+}
+
+// Close stops listening, removing the socket, and disconnects the clients.
+func (ps *progressSocket) Close() error {
+	err := ps.ln.Close()
+	<-ps.exited
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for conn := range ps.conns {
+		conn.Close()
+		delete(ps.conns, conn)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProgressSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.sock")
+
+	ps, err := listenProgress(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	events := newEventWriter(ps)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Wait for the client to be accepted before publishing.
+	for {
+		ps.mu.Lock()
+		n := len(ps.conns)
+		ps.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	events.progress(PhaseBuffering, 250, 1000, 50)
+	events.progress(PhaseBuffering, 500, 1000, 50)
+	sc := bufio.NewScanner(conn)
+	for _, want := range []uint64{250, 500} {
+		if !sc.Scan() {
+			t.Fatalf("expected an event, got %v", sc.Err())
+		}
+		var ev event
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Phase != PhaseBuffering.String() || ev.Downloaded != want || ev.Total != 1000 {
+			t.Fatalf("expected a buffering event with %v of 1000 bytes downloaded, got %+v", want, ev)
+		}
+	}
+
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.Scan() {
+		t.Fatalf("expected the client to be disconnected, got %s", sc.Bytes())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the socket to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// watchStall cancels the stream, marking it as stalled, if the number of
+// bytes downloaded doesn't advance for timeout, until the returned function
+// is called. The download isn't considered stalled while paused, nor while
+// the bytes of a bandwidth probe are arriving instead.
+func (vs *VideoStream) watchStall(timeout time.Duration, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		clock := vs.cfg.clock()
+		received := func() uint64 {
+			return atomic.LoadUint64(&vs.downloaded) + atomic.LoadUint64(&vs.probed)
+		}
+		last := received()
+		since := clock.Now()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			now := clock.Now()
+			if n := received(); n != last || vs.gate.paused() {
+				last, since = n, now
+				continue
+			}
+			if now.Sub(since) >= timeout {
+				atomic.StoreInt32(&vs.stalled, 1)
+				cancel()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
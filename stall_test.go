@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamStallTimeout(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	// The server sends half of the video, then holds the connection open
+	// without sending any more.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(testSz))
+		w.Write(testData[:testSz/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	cfg := Config{StallTimeout: 200 * time.Millisecond, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := vs.Stream(context.Background())
+		errs <- err
+	}()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrStalled) {
+			t.Fatalf("expected %v, got %v", ErrStalled, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stalled stream did not fail")
+	}
+}
+
+func TestVideoStreamStallTimeoutProbe(t *testing.T) {
+	// The probe trickles in for longer than the stall timeout, while the
+	// download waits for it.
+	const sample, chunk = 100000, 10000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData[:1000000]))
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", sample-1, 1000000))
+		w.Header().Set("Content-Length", strconv.Itoa(sample))
+		w.WriteHeader(http.StatusPartialContent)
+		for i := 0; i < sample; i += chunk {
+			time.Sleep(50 * time.Millisecond)
+			w.Write(testData[i : i+chunk])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	cfg := Config{StallTimeout: 200 * time.Millisecond, ProbeBandwidth: true, SampleBytes: sample, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatalf("expected the stream not to stall while probing, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errStartPlaylist is returned when a start position is set for an HLS
+// playlist, whose segments are always streamed from the first.
+var errStartPlaylist = errors.New("a start position is not supported for HLS playlists")
+
+// parseStart parses a start position given on the command line, either as a
+// byte offset or as a time in the video such as "45m".
+func parseStart(s string) (offset int64, t time.Duration, err error) {
+	if offset, err = strconv.ParseInt(s, 10, 64); err == nil && offset >= 0 {
+		return offset, 0, nil
+	}
+	if t, err = time.ParseDuration(s); err == nil && t >= 0 {
+		return 0, t, nil
+	}
+	return 0, 0, fmt.Errorf("%q is neither a byte offset nor a time", s)
+}
+
+// startOffset returns the byte of the video at url to start streaming from,
+// as set by cfg.StartOffset or cfg.StartTime. StartTime is converted to a
+// byte assuming a constant bitrate, which takes the duration and the size of
+// the video from the response to a HEAD request. head is used for that if
+// not nil.
+func startOffset(ctx context.Context, url string, duration time.Duration, head *http.Response, cfg Config) (int64, error) {
+	if cfg.StartTime <= 0 {
+		return cfg.StartOffset, nil
+	}
+	if duration <= 0 {
+		return 0, errors.New("the duration of the video is required to start streaming at a time")
+	}
+	if head == nil {
+		var err error
+		if head, err = requestHead(ctx, url, cfg); err != nil {
+			return 0, err
+		}
+	}
+	if head == nil || head.ContentLength == -1 {
+		return 0, errors.New("the size of the video is required to start streaming at a time")
+	}
+	if cfg.StartTime >= duration {
+		return 0, fmt.Errorf("start time %v is past the end of the %v video", cfg.StartTime, duration)
+	}
+	return int64(float64(head.ContentLength) * float64(cfg.StartTime) / float64(duration)), nil
+}
+
+// skipTo positions the body of res, the response to a request for a video
+// from byte start, at that byte, returning the size of the whole video, or -1
+// if it isn't known. The bytes before start are discarded if the server
+// ignored the range.
+func skipTo(res *http.Response, start int64) (int64, error) {
+	if res.Uncompressed || contentEncoding(res) != "" {
+		return 0, errors.New("cannot start part way through a compressed video")
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		if err := checkResumed(res, start); err != nil {
+			return 0, err
+		}
+		_, total, err := parseContentRange(res.Header.Get("Content-Range"))
+		return total, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, res.Body, start); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, fmt.Errorf("start offset %v is past the end of the video", start)
+		}
+		return 0, err
+	}
+	total := res.ContentLength
+	if total != -1 {
+		res.ContentLength -= start
+	}
+	return total, nil
+}
+
+// tailDuration returns the duration of the part of a video of size bytes
+// lasting duration which follows byte start, assuming a constant bitrate.
+// It is zero if the size or duration isn't known.
+func tailDuration(duration time.Duration, size, start int64) time.Duration {
+	if duration <= 0 || size <= 0 {
+		return 0
+	}
+	return time.Duration(float64(duration) * float64(size-start) / float64(size))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseStart(t *testing.T) {
+	tests := []struct {
+		s      string
+		offset int64
+		t      time.Duration
+		ok     bool
+	}{
+		{"1000", 1000, 0, true},
+		{"45m", 0, 45 * time.Minute, true},
+		{"1h2m3s", 0, time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"-5", 0, 0, false},
+		{"middle", 0, 0, false},
+	}
+	for _, test := range tests {
+		offset, d, err := parseStart(test.s)
+		if (err == nil) != test.ok || offset != test.offset || d != test.t {
+			t.Errorf("parseStart(%q) = %v, %v, %v", test.s, offset, d, err)
+		}
+	}
+}
+
+func TestVideoStreamStartOffset(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	ignoreRange := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ignoreRange {
+			w.Header().Set("Content-Length", strconv.Itoa(testSz))
+			w.Write(testData)
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	for _, ignore := range []bool{false, true} {
+		ignoreRange = ignore
+		cfg := Config{StartTime: time.Minute, Logger: ioutil.Discard}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, 4*time.Minute, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vs.Close()
+		if vs.duration != 3*time.Minute {
+			t.Fatalf("expected the remaining %v of the video to be buffered, got %v", 3*time.Minute, vs.duration)
+		}
+		if _, err := vs.Stream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+
+		data, err := ioutil.ReadFile(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testData[testSz/4:]) {
+			t.Fatalf("expected the output to hold the video from byte %v, got %v bytes (ignoring range: %v)", testSz/4, len(data), ignore)
+		}
+		if _, err := os.Stat(testFilename + stateSuffix); !os.IsNotExist(err) {
+			t.Fatal("expected no state to be saved for the tail of a video")
+		}
+	}
+
+	cfg := Config{StartOffset: testSz / 2, Resume: true}
+	if _, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Minute, testFilename, cfg); err == nil {
+		t.Fatal("expected a start position to be refused when resuming")
+	}
+}
+
+func TestVideoStreamWriterStartOffset(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	cfg := Config{StartOffset: testSz - 1000, Logger: ioutil.Discard}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Minute, &buf, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testData[testSz-1000:]) {
+		t.Fatalf("expected the last 1000 bytes of the video, got %v bytes", buf.Len())
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// stateSuffix is appended to the path of a partially downloaded file to
+	// name the sidecar file holding its streamState.
+	stateSuffix = ".state"
+
+	// stateInterval is how often the state of a download is saved while
+	// streaming.
+	stateInterval = 5 * time.Second
+)
+
+// streamState records a partially downloaded file, so that a later run can
+// resume it where it left off, even after the process was killed. Once
+// complete, it records the version of the video the file holds.
+type streamState struct {
+	// URL is the url of the video.
+	URL string `json:"url"`
+	// Validator identifies the version of the video, as returned by
+	// validator.
+	Validator string `json:"validator,omitempty"`
+	// Size is the size of the video, or -1 if unknown.
+	Size int64 `json:"size"`
+	// Written is the number of bytes at the start of the file known to have
+	// been downloaded and synced to disk.
+	Written int64 `json:"written"`
+	// Duration and FudgeFactor are those the download was started with.
+	Duration    time.Duration `json:"duration,omitempty"`
+	FudgeFactor float64       `json:"fudge_factor,omitempty"`
+	// Complete is set once the whole video has been downloaded with
+	// Config.Resume, and ETag is the ETag the server sent for it, so that a
+	// rerun can tell whether the video has changed since.
+	Complete bool   `json:"complete,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+}
+
+// readState returns the state recorded alongside the partially downloaded
+// file at path, or nil if none was recorded.
+func readState(path string) *streamState {
+	b, err := ioutil.ReadFile(path + stateSuffix)
+	if err != nil {
+		return nil
+	}
+	st := new(streamState)
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil
+	}
+	return st
+}
+
+// writeState records st alongside the partially downloaded file at path. The
+// file is replaced atomically, so that a crash leaves either the old state or
+// the new one.
+func writeState(path string, st streamState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + stateSuffix + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path+stateSuffix)
+}
+
+// removeState removes the state recorded alongside the file at path, if any.
+func removeState(path string) error {
+	if err := os.Remove(path + stateSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// resumeOffset returns the offset to resume a partially downloaded file of
+// the given size from, given its recorded state st, if any. Only the bytes
+// known to have been written are kept, and none are if the state was
+// recorded for another url, or records a completed video, which must have
+// changed if it is downloaded again.
+func resumeOffset(st *streamState, url string, size int64) int64 {
+	if st == nil {
+		return size
+	}
+	if st.URL != url || st.Complete {
+		return 0
+	}
+	if st.Written < size {
+		return st.Written
+	}
+	return size
+}
+
+// alreadyBuffered reports whether the file at outfile holds the whole video,
+// given the server's response to a HEAD request for it, so that a rerun
+// needn't download it again. The file must be the size the server reports,
+// must not be an interrupted download with a recorded state, must not be
+// older than the video, must have the ETag recorded when it completed if
+// both that and the server's are known, and must have the
+// Config.ExpectedSHA256 digest if there is one.
+func alreadyBuffered(outfile string, head *http.Response, cfg Config) (bool, error) {
+	if head == nil {
+		return false, nil
+	}
+	fi, err := os.Stat(outfile)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false, nil
+	}
+	st := readState(outfile)
+	if (st != nil && !st.Complete) || (!cfg.DisableAtomicWrite && readState(outfile+partSuffix) != nil) {
+		return false, nil
+	}
+	if etag := head.Header.Get("ETag"); st != nil && st.ETag != "" && etag != "" && etag != st.ETag {
+		return false, nil
+	}
+	if head.ContentLength != fi.Size() || contentEncoding(head) != "" {
+		return false, nil
+	}
+	if modified, err := http.ParseTime(head.Header.Get("Last-Modified")); err == nil && modified.After(fi.ModTime()) {
+		return false, nil
+	}
+	if cfg.ExpectedSHA256 != "" {
+		h := sha256.New()
+		if err := readPrefix(h, outfile, fi.Size()); err != nil {
+			return false, err
+		}
+		if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), cfg.ExpectedSHA256) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// unsatisfiableSize returns the size of the video reported by a 416 Range
+// Not Satisfiable response, in a Content-Range header of the form
+// "bytes */size", or -1 if it isn't reported.
+func unsatisfiableSize(se *statusError) int64 {
+	var size int64
+	if _, err := fmt.Sscanf(se.header.Get("Content-Range"), "bytes */%d", &size); err != nil {
+		return -1
+	}
+	return size
+}
+
+// verifyResume checks the partially downloaded file at path, ending at offset,
+// against res, the response to a request for the video from n bytes before
+// offset. If the first n bytes of res match the last n bytes of the file, the
+// body of res is positioned at offset, as if it had been requested from
+// there, and verifyResume returns true. Otherwise the end of the file was
+// torn, such as by a crash part way through a write, and it can't be trusted.
+func verifyResume(res *http.Response, path string, offset, n int64) (bool, error) {
+	if err := checkResumed(res, offset-n); err != nil {
+		return false, err
+	}
+	got := make([]byte, n)
+	if _, err := io.ReadFull(res.Body, got); err != nil {
+		return false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	want := make([]byte, n)
+	if _, err := f.ReadAt(want, offset-n); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(got, want) {
+		return false, nil
+	}
+
+	cr := res.Header.Get("Content-Range")
+	res.Header.Set("Content-Range", fmt.Sprintf("bytes %d%s", offset, cr[strings.Index(cr, "-"):]))
+	if res.ContentLength != -1 {
+		res.ContentLength -= n
+	}
+	return true, nil
+}
+
+// finishResumed completes a resumed download whose file at path holds the
+// whole video of size bytes, as reported by the server refusing a request
+// for the bytes following it. The file is moved to outfile and
+// ErrAlreadyBuffered returned, unless it doesn't have the
+// Config.ExpectedSHA256 digest.
+func finishResumed(path, outfile string, size int64, cfg Config) error {
+	if err := os.Truncate(path, size); err != nil {
+		return err
+	}
+	if cfg.ExpectedSHA256 != "" {
+		h := sha256.New()
+		if err := readPrefix(h, path, size); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, cfg.ExpectedSHA256) {
+			return fmt.Errorf("%w: got %v, wanted %v", ErrChecksumMismatch, sum, cfg.ExpectedSHA256)
+		}
+	}
+	if path != outfile {
+		if err := os.Rename(path, outfile); err != nil {
+			return err
+		}
+	}
+	removeState(path)
+	return fmt.Errorf("%w: %v", ErrAlreadyBuffered, outfile)
+}
+
+// recordComplete records the state of the completed video alongside the file
+// at path, with Config.Resume, so that a rerun can tell whether the video has
+// changed since. Nothing is recorded if the server didn't send an ETag, as
+// the file's size and modification time are compared regardless.
+func (vs *VideoStream) recordComplete(path string) error {
+	etag := vs.res.Header.Get("ETag")
+	if vs.state == nil || !vs.cfg.Resume || etag == "" {
+		return nil
+	}
+	st := *vs.state
+	st.Written = int64(vs.writtenBytes())
+	st.Complete, st.ETag = true, etag
+	return writeState(path, st)
+}
+
+// saveState syncs the output file and records how much of it has been
+// written. Chunks downloaded over several connections needn't be
+// contiguous, so for those only the url and version of the video are
+// recorded.
+func (vs *VideoStream) saveState() error {
+	if vs.state == nil {
+		return nil
+	}
+	st := *vs.state
+	if !vs.parallel() {
+		written := vs.writtenBytes()
+		if err := vs.f.Sync(); err != nil {
+			return err
+		}
+		st.Written = int64(written)
+	}
+	return writeState(vs.name, st)
+}
+
+// writtenBytes returns the number of bytes of the video written to the
+// output.
+func (vs *VideoStream) writtenBytes() uint64 {
+	if vs.parallel() {
+		return vs.Size()
+	}
+	return vs.offset + atomic.LoadUint64(&vs.written)
+}
+
+// persistState saves the state of the download every interval until the
+// returned function is called, which saves it a final time.
+func (vs *VideoStream) persistState(interval time.Duration) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				vs.saveState()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		vs.saveState()
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResumeOffset(t *testing.T) {
+	tests := []struct {
+		st   *streamState
+		want int64
+	}{
+		{nil, 100},
+		{&streamState{URL: "http://example.com/a.mkv", Written: 60}, 60},
+		{&streamState{URL: "http://example.com/a.mkv", Written: 200}, 100},
+		{&streamState{URL: "http://example.com/b.mkv", Written: 60}, 0},
+	}
+	for _, test := range tests {
+		if got := resumeOffset(test.st, "http://example.com/a.mkv", 100); got != test.want {
+			t.Errorf("resumeOffset(%+v) = %v, wanted %v", test.st, got, test.want)
+		}
+	}
+}
+
+func TestVideoStreamState(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename + stateSuffix)
+
+	// the first range request sends half of the rest of the video, then
+	// stalls until the client gives up.
+	var stalled int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") != "" && atomic.CompareAndSwapInt32(&stalled, 0, 1) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", testSz/4, testSz-1, testSz))
+			w.Header().Set("Content-Length", strconv.Itoa(testSz-testSz/4))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(testData[testSz/4 : testSz/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	// the process was killed after the state was last saved, leaving bytes
+	// on disk that it doesn't vouch for.
+	if err := ioutil.WriteFile(testFilename, testData[:testSz/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	st := streamState{URL: ts.URL, Validator: `"v1"`, Size: testSz, Written: testSz / 4, Duration: time.Minute}
+	if err := writeState(testFilename, st); err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if vs.offset != testSz/4 {
+		t.Fatalf("expected to resume from the recorded %v bytes, got %v", testSz/4, vs.offset)
+	}
+	if vs.duration != time.Minute {
+		t.Fatalf("expected the recorded duration %v, got %v", time.Minute, vs.duration)
+	}
+
+	// interrupt the stream, which records how far it got.
+	ctx, cancel := context.WithCancel(context.Background())
+	vs.cfg.ProgressFunc = func(downloaded, total uint64, bw float64) {
+		if downloaded >= testSz/2 {
+			cancel()
+		}
+	}
+	if _, err := vs.Stream(ctx); err == nil {
+		t.Fatal("expected the stream to be interrupted")
+	}
+	fi, err := os.Stat(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := readState(testFilename)
+	if saved == nil || saved.Written != fi.Size() || saved.Size != testSz || saved.URL != ts.URL {
+		t.Fatalf("expected the state to record the %v bytes written, got %+v", fi.Size(), saved)
+	}
+
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("resumed file did not match the video")
+	}
+	if st := readState(testFilename); st == nil || !st.Complete || st.ETag != `"v1"` || st.Written != testSz {
+		t.Fatalf("expected the state to record the completed video, got %+v", st)
+	}
+	removeState(testFilename)
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVideoStreamNoStateWithoutResume(t *testing.T) {
+	// the first request sends half of the video, then stalls until the
+	// client gives up.
+	var stalled int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == http.MethodGet && atomic.CompareAndSwapInt32(&stalled, 0, 1) {
+			w.Header().Set("Content-Length", strconv.Itoa(testSz))
+			w.Write(testData[:testSz/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	// neither an interrupted nor a completed download leaves a state file.
+	ctx, cancel := context.WithCancel(context.Background())
+	vs, err := NewVideoStreamConfig(ctx, ts.URL, 0, testFilename, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	vs.cfg.ProgressFunc = func(downloaded, total uint64, bw float64) {
+		if _, err := os.Stat(testPartname + stateSuffix); err == nil {
+			t.Error("expected no state file to be written while streaming")
+		}
+		if downloaded >= testSz/2 {
+			cancel()
+		}
+	}
+	if _, err := vs.Stream(ctx); err == nil {
+		t.Fatal("expected the stream to be interrupted")
+	}
+	vs.Close()
+	if _, err := os.Stat(testPartname + stateSuffix); !os.IsNotExist(err) {
+		t.Fatalf("expected no state file after an interrupted download, got %v", err)
+	}
+
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	defer os.Remove(testFilename)
+	for _, path := range []string{testPartname, testFilename} {
+		if _, err := os.Stat(path + stateSuffix); !os.IsNotExist(err) {
+			t.Fatalf("expected no state file for %v after the download, got %v", path, err)
+		}
+	}
+}
+
+func TestNewVideoStreamAlreadyBuffered(t *testing.T) {
+	os.Remove(testFilename)
+	removeState(testFilename)
+
+	var gets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	if err := ioutil.WriteFile(testFilename, testData, 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testFilename)
+
+	_, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if !errors.Is(err, ErrAlreadyBuffered) {
+		t.Fatalf("expected %v, got %v", ErrAlreadyBuffered, err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Fatalf("expected the finished video not to be requested, got %v requests", n)
+	}
+
+	// a digest that doesn't match means the file must be downloaded again.
+	cfg := Config{Resume: true, ExpectedSHA256: strings.Repeat("0", 64), DisableAtomicWrite: true}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+
+	// as does an interrupted download with a recorded state.
+	if err := ioutil.WriteFile(testFilename, testData, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeState(testFilename, streamState{URL: ts.URL, Written: testSz / 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer removeState(testFilename)
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, Config{Resume: true, DisableAtomicWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	if vs.offset != testSz/2 {
+		t.Fatalf("expected to resume from offset %v, got %v", testSz/2, vs.offset)
+	}
+}
+
+func TestNewVideoStreamAlreadyBufferedETag(t *testing.T) {
+	os.Remove(testFilename)
+	removeState(testFilename)
+	defer os.Remove(testFilename)
+	defer removeState(testFilename)
+
+	// The video changes without its size changing, and the server doesn't
+	// report when it was last modified.
+	etag, data := `"v1"`, testData
+	changed := make([]byte, testSz)
+	copy(changed, testData)
+	changed[0]++
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+	cfg := Config{Resume: true, Logger: ioutil.Discard}
+
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	if _, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg); !errors.Is(err, ErrAlreadyBuffered) {
+		t.Fatalf("expected %v, got %v", ErrAlreadyBuffered, err)
+	}
+
+	etag, data = `"v2"`, changed
+	vs, err = NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatalf("expected the changed video to be downloaded again, got %v", err)
+	}
+	if vs.offset != 0 {
+		t.Fatalf("expected the changed video to be downloaded from the start, got offset %v", vs.offset)
+	}
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	got, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, changed) {
+		t.Fatal("expected the file to hold the changed video")
+	}
+	if st := readState(testFilename); st == nil || st.ETag != etag {
+		t.Fatalf("expected the new ETag %v to be recorded, got %+v", etag, st)
+	}
+}
+
+func TestNewVideoStreamRangeNotSatisfiable(t *testing.T) {
+	part := testFilename + partSuffix
+	removeState(part)
+	defer os.Remove(testFilename)
+	defer os.Remove(part)
+
+	// HEAD requests aren't supported, so the size of the video is only
+	// learnt from the 416 response to resuming past its end.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+	cfg := Config{Resume: true, Logger: ioutil.Discard}
+
+	// The partial file already holds the whole video.
+	if err := ioutil.WriteFile(part, testData, 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if !errors.Is(err, ErrAlreadyBuffered) {
+		t.Fatalf("expected %v, got %v", ErrAlreadyBuffered, err)
+	}
+	data, err := ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("expected the complete partial file to be moved into place")
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Fatal("expected the partial file to be moved")
+	}
+	os.Remove(testFilename)
+
+	// The partial file is longer than the video, which must have shrunk.
+	if err := ioutil.WriteFile(part, append(append([]byte(nil), testData...), 1, 2, 3), 0666); err != nil {
+		t.Fatal(err)
+	}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+	if _, err := vs.Stream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(testFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testData) {
+		t.Fatal("expected the download to start over")
+	}
+}
+
+func TestNewVideoStreamResumeVerify(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+	removeState(testFilename)
+
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	const verify = 4096
+	for _, torn := range []bool{false, true} {
+		ranges = nil
+		partial := append([]byte(nil), testData[:testSz/2]...)
+		if torn {
+			for i := len(partial) - 100; i < len(partial); i++ {
+				partial[i] = ^partial[i]
+			}
+		}
+		if err := ioutil.WriteFile(testFilename, partial, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := Config{Resume: true, ResumeVerifyBytes: verify, Logger: ioutil.Discard, DisableAtomicWrite: true}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantOffset := uint64(testSz / 2)
+		if torn {
+			wantOffset = 0
+		}
+		if vs.offset != wantOffset {
+			t.Fatalf("torn %v: expected to resume at %v, got %v", torn, wantOffset, vs.offset)
+		}
+		if want := fmt.Sprintf("bytes=%d-", testSz/2-verify); len(ranges) == 0 || ranges[0] != want {
+			t.Fatalf("torn %v: expected the end of the file to be requested with %v, got %v", torn, want, ranges)
+		}
+		_, err = vs.Stream(context.Background())
+		vs.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(testFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, testData) {
+			t.Fatalf("torn %v: data in the resumed file did not match testData", torn)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// BufferStrategy decides how long to buffer a video before playing it, so
+// that playback doesn't catch up with the download.
+type BufferStrategy interface {
+	// SafeBufferTime returns how long to wait before playing a video of
+	// the given duration, with remaining bytes left to download. samples
+	// holds the bandwidth measured while streaming, in bytes per second,
+	// oldest first; the last is the current bandwidth. It is never empty.
+	// A zero or negative time means the video can be played immediately.
+	SafeBufferTime(remaining uint64, duration time.Duration, samples []float64) time.Duration
+}
+
+// FudgeStrategy is the default BufferStrategy, which overestimates the time
+// needed to download the rest of the video at the current bandwidth by a
+// factor, as described by Config.FudgeFactor.
+type FudgeStrategy float64
+
+// SafeBufferTime implements BufferStrategy.
+func (f FudgeStrategy) SafeBufferTime(remaining uint64, duration time.Duration, samples []float64) time.Duration {
+	return bufferTime(remaining, samples[len(samples)-1], duration, float64(f))
+}
+
+// strategy returns the BufferStrategy to use.
+func (cfg *Config) strategy() BufferStrategy {
+	if cfg.BufferStrategy != nil {
+		return cfg.BufferStrategy
+	}
+	return FudgeStrategy(cfg.FudgeFactor)
+}
+
+// safeBufferTime returns the buffer time decided by the BufferStrategy, with
+// the samples limited to the rate the rest of the video can download at once
+// it is ready.
+func (cfg *Config) safeBufferTime(remaining uint64, duration time.Duration, samples []float64) time.Duration {
+	if remaining == 0 {
+		return -duration
+	}
+	limited := make([]float64, len(samples))
+	for i, bw := range samples {
+		limited[i] = cfg.readyBandwidth(bw)
+	}
+	return cfg.strategy().SafeBufferTime(remaining, duration, limited)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// marginStrategy buffers for a fixed time, recording the samples it is
+// passed.
+type marginStrategy struct {
+	margin time.Duration
+
+	mu      sync.Mutex
+	samples [][]float64
+}
+
+func (ms *marginStrategy) SafeBufferTime(remaining uint64, duration time.Duration, samples []float64) time.Duration {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.samples = append(ms.samples, samples)
+	return ms.margin
+}
+
+func TestFudgeStrategy(t *testing.T) {
+	// 100s to download a 60s video, overestimated by half.
+	if bt := FudgeStrategy(1.5).SafeBufferTime(1000, time.Minute, []float64{100, 10}); bt != 90*time.Second {
+		t.Fatalf("expected a buffer time of %v, got %v", 90*time.Second, bt)
+	}
+}
+
+func TestVideoStreamBufferStrategy(t *testing.T) {
+	os.Remove(testFilename)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	ms := &marginStrategy{margin: 42 * time.Second}
+	cfg := Config{SampleBytes: 1000000, BufferStrategy: ms}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Hour, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.BufferTime != ms.margin {
+		t.Fatalf("expected the strategy's buffer time %v, got %v", ms.margin, res.BufferTime)
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(ms.samples) == 0 || ms.samples[0][0] != res.Bandwidth {
+		t.Fatalf("expected the strategy to be passed the sampled bandwidth %v, got %v", res.Bandwidth, ms.samples)
+	}
+
+	vs.Close()
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Streamer buffers any number of videos with a shared Config, such as in a
+// long-running service. The HTTP client derived from the Config, and so its
+// pool of connections, is reused between downloads. A Streamer is safe for
+// concurrent use.
+type Streamer struct {
+	cfg Config
+}
+
+// NewStreamer returns a Streamer buffering videos with cfg, or an error if
+// cfg is invalid.
+func NewStreamer(cfg Config) (*Streamer, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	return &Streamer{cfg: cfg}, nil
+}
+
+// Buffer streams the video at url, of the given duration if it can't be
+// detected, to the file at outfile, as NewVideoStreamConfig and Stream do. It
+// returns once the video has completely downloaded, or the download fails.
+func (s *Streamer) Buffer(ctx context.Context, url string, duration time.Duration, outfile string) (*StreamResult, error) {
+	vs, err := NewVideoStreamConfig(ctx, url, duration, outfile, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer vs.Close()
+	return vs.Stream(ctx)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamer(t *testing.T) {
+	videos := map[string][]byte{
+		"/a.mkv": testData[:testSz/2],
+		"/b.mkv": testData[testSz/2:],
+	}
+	var mu sync.Mutex
+	var auths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		mu.Lock()
+		auths = append(auths, user)
+		mu.Unlock()
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(videos[r.URL.Path]))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "autobuffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewStreamer(Config{Username: "user", Password: "pass", Connections: 2, Logger: ioutil.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s.cfg.Client
+	for path, video := range videos {
+		out := filepath.Join(dir, path)
+		if _, err := s.Buffer(context.Background(), ts.URL+path, time.Minute, out); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, video) {
+			t.Fatalf("%v did not match the video", path)
+		}
+	}
+	if s.cfg.Client != client {
+		t.Fatal("expected the client to be reused between downloads")
+	}
+	for _, user := range auths {
+		if user != "user" {
+			t.Fatalf("expected every request to be authenticated, got user %q", user)
+		}
+	}
+
+	if _, err := NewStreamer(Config{FudgeFactor: 0.5}); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+}
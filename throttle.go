@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket limiting the rate at which bytes are read. It is
+// shared by all of a VideoStream's connections, so that the limit applies to
+// the download as a whole.
+type limiter struct {
+	mu sync.Mutex
+	// rate is the number of bytes per second allowed, and the size of the
+	// bucket. Reads are unlimited while it is 0.
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int64) *limiter {
+	return &limiter{rate: float64(rate), last: time.Now()}
+}
+
+// wait records that n bytes have been read, blocking until the rate at which
+// they were read is within the limit. Reads that exceed the limit leave the
+// bucket in debt, which subsequent reads must wait out.
+func (l *limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.rate <= 0 {
+		l.last = now
+		l.mu.Unlock()
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// setRate changes the number of bytes per second allowed, taking effect
+// from the next read.
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	l.last = time.Now()
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// chunk returns the most bytes to read at a time, a tenth of a second's
+// worth, or 0 if reads are unlimited.
+func (l *limiter) chunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate / 10)
+}
+
+// throttledReader limits the rate at which an io.Reader is read.
+type throttledReader struct {
+	r io.Reader
+	l *limiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// Reading at most a tenth of a second's worth of bytes at a time keeps
+	// the download smooth.
+	if max := tr.l.chunk(); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := tr.r.Read(p)
+	tr.l.wait(n)
+	return n, err
+}
+
+// throttle limits the rate at which r is read to Config.MaxBytesPerSecond, and
+// to ReadyBytesPerSecond once the video is ready, if either is set.
+func (vs *VideoStream) throttle(r io.Reader) io.Reader {
+	if vs.limiter == nil {
+		return r
+	}
+	return &throttledReader{r: r, l: vs.limiter}
+}
+
+// limitBandwidth returns the bandwidth bw, in bytes per second, capped at
+// MaxBytesPerSecond. The video can't download faster than the limit
+// regardless of the available bandwidth.
+func (cfg *Config) limitBandwidth(bw float64) float64 {
+	if cfg.MaxBytesPerSecond > 0 && bw > float64(cfg.MaxBytesPerSecond) {
+		return float64(cfg.MaxBytesPerSecond)
+	}
+	return bw
+}
+
+// readyBandwidth returns the bandwidth bw, in bytes per second, capped at the
+// rate the rest of the video is limited to once it is ready to play.
+func (cfg *Config) readyBandwidth(bw float64) float64 {
+	bw = cfg.limitBandwidth(bw)
+	if cfg.ReadyBytesPerSecond > 0 && bw > float64(cfg.ReadyBytesPerSecond) {
+		return float64(cfg.ReadyBytesPerSecond)
+	}
+	return bw
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamThrottle(t *testing.T) {
+	const size = 2000000
+	const limit = 1000000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(size))
+		w.Write(testData[:size])
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		SampleBytes:       limit / 2,
+		MaxBytesPerSecond: limit,
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bw := float64(size) / res.Elapsed.Seconds(); bw > limit*1.1 {
+		t.Fatalf("expected throughput to stay under %v bytes per second, got %v", limit, bw)
+	}
+	if res.Bandwidth > limit*1.1 {
+		t.Fatalf("expected sampled bandwidth to stay under %v bytes per second, got %v", limit, res.Bandwidth)
+	}
+}
+
+func TestConfigLimitBandwidth(t *testing.T) {
+	cfg := Config{MaxBytesPerSecond: 1000}
+	if bw := cfg.limitBandwidth(5000); bw != 1000 {
+		t.Fatalf("expected bandwidth to be capped at 1000, got %v", bw)
+	}
+	if bw := cfg.limitBandwidth(500); bw != 500 {
+		t.Fatalf("expected bandwidth under the limit to be unchanged, got %v", bw)
+	}
+	if bw := (&Config{}).limitBandwidth(5000); bw != 5000 {
+		t.Fatalf("expected bandwidth to be unlimited, got %v", bw)
+	}
+}
+
+func TestVideoStreamReadyThrottle(t *testing.T) {
+	const size = 4000000
+	const limit = 1000000
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Length", strconv.Itoa(size))
+		// Pausing a quarter of the way in gives the video time to be found
+		// ready before the rest arrives.
+		w.Write(testData[:size/4])
+		w.(http.Flusher).Flush()
+		time.Sleep(2 * progressInterval)
+		w.Write(testData[size/4 : size])
+	}))
+	defer ts.Close()
+
+	cfg := Config{
+		SampleBytes:         limit / 2,
+		MinBufferPercent:    25,
+		ReadyBytesPerSecond: limit,
+	}
+	vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, ioutil.Discard, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vs.Close()
+
+	res, err := vs.Stream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&vs.ready) == 0 {
+		t.Fatal("expected the video to be ready")
+	}
+	// The first quarter of the video is unlimited, and the limiter allows a
+	// second's worth of bytes through at once, so the rest takes at least
+	// two seconds.
+	if min := 2*progressInterval + 1800*time.Millisecond; res.Elapsed < min {
+		t.Fatalf("expected the video to take at least %v to stream, took %v", min, res.Elapsed)
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	l := newLimiter(0)
+	start := time.Now()
+	l.wait(10000000)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("expected an unlimited read not to wait, waited %v", d)
+	}
+	if n := l.chunk(); n != 0 {
+		t.Fatalf("expected unlimited reads not to be split, got chunks of %v", n)
+	}
+
+	l.setRate(100000)
+	if n := l.chunk(); n != 10000 {
+		t.Fatalf("expected chunks of 10000 bytes, got %v", n)
+	}
+	start = time.Now()
+	l.wait(20000)
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("expected a read over the new rate to wait, waited %v", d)
+	}
+}
+
+func TestConfigReadyBandwidth(t *testing.T) {
+	cfg := Config{MaxBytesPerSecond: 1000, ReadyBytesPerSecond: 500}
+	if bw := cfg.readyBandwidth(5000); bw != 500 {
+		t.Fatalf("expected bandwidth to be capped at 500, got %v", bw)
+	}
+	cfg = Config{MaxBytesPerSecond: 1000, ReadyBytesPerSecond: 2000}
+	if bw := cfg.readyBandwidth(5000); bw != 1000 {
+		t.Fatalf("expected bandwidth to be capped at 1000, got %v", bw)
+	}
+	if bw := (&Config{}).readyBandwidth(5000); bw != 5000 {
+		t.Fatalf("expected bandwidth to be unlimited, got %v", bw)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrCertificateMismatch is returned when the server's TLS certificate
+// doesn't match Config.PinnedCertSHA256.
+var ErrCertificateMismatch = errors.New("server certificate does not match the pinned certificate")
+
+// errPinnedHTTP is returned when a pinned certificate is configured but a url
+// would be requested over plain HTTP, which has no certificate to check.
+var errPinnedHTTP = errors.New("a pinned certificate requires https urls")
+
+// cloneTransport returns a copy of c with a copy of its http.Transport,
+// modified by f. Clients not using an http.Transport are returned unchanged.
+func cloneTransport(c *http.Client, f func(*http.Transport)) *http.Client {
+	t := http.DefaultTransport.(*http.Transport)
+	if c.Transport != nil {
+		var ok bool
+		if t, ok = c.Transport.(*http.Transport); !ok {
+			return c
+		}
+	}
+	t = t.Clone()
+	f(t)
+	client := *c
+	client.Transport = t
+	return &client
+}
+
+// poolClient returns a copy of c whose connections are pooled for the given
+// number of concurrent connections to the server. HTTP/2 is attempted unless
+// disableHTTP2 is set, so that the connections are multiplexed over a single
+// TCP connection where the server supports it. Otherwise, enough connections
+// are kept idle between requests for each to be reused rather than paying for
+// a new handshake. Clients not using an http.Transport are returned
+// unchanged.
+func poolClient(c *http.Client, connections int, disableHTTP2 bool) *http.Client {
+	return cloneTransport(c, func(t *http.Transport) {
+		if t.MaxIdleConnsPerHost < connections {
+			t.MaxIdleConnsPerHost = connections
+		}
+		if t.MaxIdleConns != 0 && t.MaxIdleConns < connections {
+			t.MaxIdleConns = connections
+		}
+		t.ForceAttemptHTTP2 = !disableHTTP2
+		if disableHTTP2 {
+			// a non-nil, empty TLSNextProto disables HTTP/2.
+			t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+	})
+}
+
+// parsePin decodes a hex encoded SHA-256 fingerprint, which may separate its
+// bytes with colons.
+func parsePin(fingerprint string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", fingerprint)
+	}
+	return pin, nil
+}
+
+// pinClient returns a copy of c which fails to connect to servers whose leaf
+// certificate doesn't have the SHA-256 fingerprint pin, with
+// ErrCertificateMismatch. The certificate is still verified as usual. Since
+// pinning can't be enforced otherwise, c must use an http.Transport.
+func pinClient(c *http.Client, pin []byte) (*http.Client, error) {
+	if _, ok := c.Transport.(*http.Transport); c.Transport != nil && !ok {
+		return nil, errors.New("a pinned certificate requires a client using an http.Transport")
+	}
+	return cloneTransport(c, func(t *http.Transport) {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		} else {
+			t.TLSClientConfig = t.TLSClientConfig.Clone()
+		}
+		// VerifyConnection, unlike VerifyPeerCertificate, is also called
+		// for resumed sessions.
+		next := t.TLSClientConfig.VerifyConnection
+		t.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrCertificateMismatch
+			}
+			if sum := sha256.Sum256(cs.PeerCertificates[0].Raw); !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("%w: got %v", ErrCertificateMismatch, hex.EncodeToString(sum[:]))
+			}
+			if next != nil {
+				return next(cs)
+			}
+			return nil
+		}
+	}), nil
+}
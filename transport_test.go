@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolClient(t *testing.T) {
+	transport := &http.Transport{MaxIdleConns: 2}
+	c := poolClient(&http.Client{Transport: transport}, 8, false)
+	pooled := c.Transport.(*http.Transport)
+	if pooled == transport {
+		t.Fatal("poolClient modified the client's transport")
+	}
+	if pooled.MaxIdleConnsPerHost != 8 || pooled.MaxIdleConns != 8 {
+		t.Fatalf("expected 8 idle connections, got %v per host and %v in total", pooled.MaxIdleConnsPerHost, pooled.MaxIdleConns)
+	}
+	if !pooled.ForceAttemptHTTP2 {
+		t.Fatal("expected HTTP/2 to be attempted")
+	}
+
+	c = poolClient(&http.Client{Transport: transport}, 8, true)
+	if pooled := c.Transport.(*http.Transport); pooled.ForceAttemptHTTP2 || pooled.TLSNextProto == nil {
+		t.Fatal("expected HTTP/2 to be disabled")
+	}
+}
+
+func TestVideoStreamParallelHTTP2(t *testing.T) {
+	os.Remove(testFilename)
+
+	var mu sync.Mutex
+	protos := make(map[int]int)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			protos[r.ProtoMajor]++
+			mu.Unlock()
+		}
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		disableHTTP2 bool
+		proto        int
+	}{
+		{false, 2},
+		{true, 1},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		protos = make(map[int]int)
+		mu.Unlock()
+
+		// a transport with its own TLS config doesn't attempt HTTP/2 unless
+		// asked to.
+		transport := &http.Transport{TLSClientConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig}
+		cfg := Config{
+			Client:       &http.Client{Transport: transport},
+			SampleBytes:  1000000,
+			Connections:  4,
+			DisableHTTP2: test.disableHTTP2,
+		}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Second, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vs.Stream(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vs.Close()
+
+		mu.Lock()
+		if len(protos) != 1 || protos[test.proto] == 0 {
+			t.Fatalf("DisableHTTP2 %v: expected range requests over HTTP/%v, got %v", test.disableHTTP2, test.proto, protos)
+		}
+		mu.Unlock()
+	}
+
+	if err := os.Remove(testFilename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinnedCertificate(t *testing.T) {
+	os.Remove(testFilename)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	sum := sha256.Sum256(ts.Certificate().Raw)
+	cfg := Config{Client: ts.Client(), PinnedCertSHA256: hex.EncodeToString(sum[:])}
+	vs, err := NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs.Close()
+	os.Remove(testFilename)
+
+	sum[0]++
+	cfg.PinnedCertSHA256 = hex.EncodeToString(sum[:])
+	_, err = NewVideoStreamConfig(context.Background(), ts.URL, 0, testFilename, cfg)
+	if !errors.Is(err, ErrCertificateMismatch) {
+		t.Fatalf("expected %v, got %v", ErrCertificateMismatch, err)
+	}
+	if temporary(err) {
+		t.Fatal("expected a certificate mismatch not to be retried")
+	}
+	os.Remove(testFilename)
+
+	cfg.PinnedCertSHA256 = "not a fingerprint"
+	if err := cfg.setDefaults(); err == nil {
+		t.Fatal("expected an invalid fingerprint to be rejected")
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// validator returns the value for an If-Range header identifying the version
+// of the video in res: its ETag if it is strong, otherwise its
+// Last-Modified date, or "" if it has neither.
+func validator(res *http.Response) string {
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
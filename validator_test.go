@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidator(t *testing.T) {
+	tests := []struct {
+		etag, lastModified string
+		want               string
+	}{
+		{`"abc"`, "", `"abc"`},
+		{`W/"abc"`, "Mon, 02 Jan 2006 15:04:05 GMT", "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{"", "Mon, 02 Jan 2006 15:04:05 GMT", "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		res := &http.Response{Header: http.Header{}}
+		if test.etag != "" {
+			res.Header.Set("ETag", test.etag)
+		}
+		if test.lastModified != "" {
+			res.Header.Set("Last-Modified", test.lastModified)
+		}
+		if v := validator(res); v != test.want {
+			t.Fatalf("expected validator %q, got %q", test.want, v)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds the request notifying Config.WebhookURL, so that an
+// unresponsive webhook doesn't hold up the end of the stream.
+const webhookTimeout = 5 * time.Second
+
+// webhookPayload is the JSON body posted to Config.WebhookURL once Stream
+// returns.
+type webhookPayload struct {
+	URL  string `json:"url"`
+	Path string `json:"path,omitempty"`
+	// Size is the number of bytes of the video on disk.
+	Size uint64 `json:"size"`
+	// Duration is the duration of the video in seconds, if known.
+	Duration float64 `json:"duration"`
+	// Elapsed is the time spent streaming in seconds.
+	Elapsed float64 `json:"elapsed"`
+	Success bool    `json:"success"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// notify posts the outcome of Stream, which returned res and err, to
+// Config.WebhookURL. A failure to notify is logged, not returned.
+func (vs *VideoStream) notify(res *StreamResult, err error) {
+	payload := webhookPayload{
+		URL:     vs.url,
+		Path:    vs.name,
+		Size:    vs.offset + res.BytesWritten,
+		Elapsed: res.Elapsed.Seconds(),
+		Success: err == nil,
+	}
+	if err == nil && vs.final != "" {
+		payload.Path = vs.final
+	}
+	if vs.duration > 0 {
+		payload.Duration = vs.duration.Seconds()
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	if err := postWebhook(vs.cfg.WebhookURL, payload); err != nil {
+		vs.printf("Could not notify the webhook: %v\n", err)
+	}
+}
+
+// postWebhook posts payload as JSON to url.
+func postWebhook(url string, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status: %v", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVideoStreamWebhook(t *testing.T) {
+	os.Remove(testFilename)
+	defer os.Remove(testFilename)
+
+	payloads := make(chan webhookPayload, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		payloads <- p
+	}))
+	defer hook.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData))
+	}))
+	defer ts.Close()
+
+	// A mismatched checksum fails the second stream.
+	for _, checksum := range []string{"", "00"} {
+		success := checksum == ""
+		cfg := Config{WebhookURL: hook.URL, ExpectedSHA256: checksum, Logger: ioutil.Discard}
+		vs, err := NewVideoStreamConfig(context.Background(), ts.URL, time.Minute, testFilename, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vs.Stream(context.Background())
+		vs.Close()
+		if (err == nil) != success {
+			t.Fatalf("unexpected stream error %v", err)
+		}
+
+		p := <-payloads
+		if p.Success != success || (p.Error == "") != success {
+			t.Fatalf("expected success %v, got %+v", success, p)
+		}
+		// A failed stream leaves only the .part file.
+		path := testFilename
+		if !success {
+			path = testPartname
+		}
+		if p.URL != ts.URL || p.Path != path || p.Size != testSz || p.Duration != 60 {
+			t.Fatalf("unexpected payload %+v", p)
+		}
+	}
+}
+
+func TestPostWebhookTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the webhook to time out")
+	}
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hook.Close()
+	defer close(release)
+
+	start := time.Now()
+	if err := postWebhook(hook.URL, webhookPayload{}); err == nil {
+		t.Fatal("expected an unresponsive webhook to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*webhookTimeout {
+		t.Fatalf("expected the webhook to time out after %v, took %v", webhookTimeout, elapsed)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// bufferedWriter writes to w from its own goroutine, through an in-memory
+// buffer of at most max bytes. Writes return as soon as they fit in the
+// buffer, so a slow disk only holds up the download once the buffer is full,
+// and the bandwidth sampled is that of the network rather than the disk.
+// The first error writing to w is returned by every later call.
+type bufferedWriter struct {
+	w   io.Writer
+	max int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	spare   []byte
+	writing bool
+	closed  bool
+	err     error
+
+	start  sync.Once
+	exited chan struct{}
+}
+
+// newBufferedWriter returns a bufferedWriter to w buffering up to max bytes.
+// Its goroutine is started by the first write, and exits once it is closed.
+func newBufferedWriter(w io.Writer, max int) *bufferedWriter {
+	bw := &bufferedWriter{w: w, max: max, exited: make(chan struct{})}
+	bw.cond = sync.NewCond(&bw.mu)
+	return bw
+}
+
+func (bw *bufferedWriter) Write(p []byte) (int, error) {
+	bw.start.Do(func() { go bw.loop() })
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	// A write larger than the buffer is let in once the buffer is empty,
+	// rather than blocking forever.
+	for bw.err == nil && len(bw.buf) > 0 && len(bw.buf)+len(p) > bw.max {
+		bw.cond.Wait()
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	if bw.closed {
+		return 0, os.ErrClosed
+	}
+	bw.buf = append(bw.buf, p...)
+	bw.cond.Broadcast()
+	return len(p), nil
+}
+
+// loop writes the buffered bytes to w until the bufferedWriter is closed and
+// its buffer is empty. The buffer is swapped for a spare one while it is
+// being written, so that writes can carry on filling the buffer.
+func (bw *bufferedWriter) loop() {
+	defer close(bw.exited)
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	for {
+		for len(bw.buf) == 0 && !bw.closed {
+			bw.cond.Wait()
+		}
+		if len(bw.buf) == 0 || bw.err != nil {
+			return
+		}
+		chunk := bw.buf
+		bw.buf, bw.spare = bw.spare[:0], nil
+		bw.writing = true
+		bw.mu.Unlock()
+
+		_, err := bw.w.Write(chunk)
+
+		bw.mu.Lock()
+		bw.writing = false
+		bw.spare = chunk
+		if err != nil {
+			bw.err = err
+		}
+		bw.cond.Broadcast()
+	}
+}
+
+// Flush waits until everything written to the bufferedWriter has been
+// written to w, returning the first error doing so.
+func (bw *bufferedWriter) Flush() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	for bw.err == nil && (len(bw.buf) > 0 || bw.writing) {
+		bw.cond.Wait()
+	}
+	return bw.err
+}
+
+// Close flushes the bufferedWriter and stops its goroutine. It is safe to
+// call Close more than once.
+func (bw *bufferedWriter) Close() error {
+	bw.mu.Lock()
+	bw.closed = true
+	bw.cond.Broadcast()
+	bw.mu.Unlock()
+
+	started := true
+	bw.start.Do(func() {
+		started = false
+		close(bw.exited)
+	})
+	if started {
+		<-bw.exited
+	}
+
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.err
+}
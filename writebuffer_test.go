@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowWriter is a writer to a disk that takes delay for every write.
+type slowWriter struct {
+	buf   bytes.Buffer
+	delay time.Duration
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(sw.delay)
+	return sw.buf.Write(p)
+}
+
+func TestVideoStreamWriteBuffer(t *testing.T) {
+	const size = 4 << 20
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, testFilename, time.Time{}, bytes.NewReader(testData[:size]))
+	}))
+	defer ts.Close()
+
+	stream := func(writeBuffer int) (float64, []byte) {
+		sw := &slowWriter{delay: 5 * time.Millisecond}
+		cfg := Config{SampleBytes: 1 << 20, WriteBufferSize: writeBuffer, Logger: ioutil.Discard}
+		vs, err := NewVideoStreamWriter(context.Background(), ts.URL, time.Second, sw, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vs.Close()
+		res, err := vs.Stream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Bandwidth, sw.buf.Bytes()
+	}
+
+	slow, _ := stream(0)
+	fast, b := stream(size)
+	if !bytes.Equal(b, testData[:size]) {
+		t.Fatal("buffered output did not match the video")
+	}
+	if fast < 4*slow {
+		t.Fatalf("expected the buffered bandwidth to reflect the network, got %v bytes per second against %v unbuffered", fast, slow)
+	}
+}
+
+func TestBufferedWriterError(t *testing.T) {
+	bw := newBufferedWriter(errWriter{}, 16)
+	bw.Write([]byte("video"))
+	if err := bw.Flush(); !errors.Is(err, errWrite) {
+		t.Fatalf("expected %v from Flush, got %v", errWrite, err)
+	}
+	if _, err := bw.Write([]byte("video")); !errors.Is(err, errWrite) {
+		t.Fatalf("expected %v from Write, got %v", errWrite, err)
+	}
+	if err := bw.Close(); !errors.Is(err, errWrite) {
+		t.Fatalf("expected %v from Close, got %v", errWrite, err)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}